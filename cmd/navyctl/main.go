@@ -0,0 +1,265 @@
+// navyctl inspects and operates a navy fleet from outside of it.
+//
+//	navyctl [flags] admiral          print the admiral of the fleet
+//	navyctl [flags] members          list the members of the fleet
+//	navyctl [flags] watch            print the admiral every time it changes
+//	navyctl [flags] leave            make the captain at -address leave the fleet
+//	navyctl [flags] resign           make the captain at -address resign
+//	navyctl [flags] transfer <rank>  make the admiral hand leadership to <rank>
+//
+// The captains must be able to connect back to navyctl (see -listen and
+// -external), and must have remote control enabled for leave, resign and
+// transfer.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thebsdbox/navy/pkg/navy"
+)
+
+// member is a member of the fleet as it is printed.
+type member struct {
+	Rank     int               `json:"rank"`
+	Address  string            `json:"address"`
+	ID       string            `json:"id,omitempty"`
+	Ready    bool              `json:"ready"`
+	Admiral  bool              `json:"admiral"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// change is a change of admiral as it is printed by watch.
+type change struct {
+	Time    time.Time `json:"time"`
+	Admiral *member   `json:"admiral"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func main() {
+	addr := flag.String("address", "127.0.0.1:9990", "The address of a captain in the fleet")
+	callsign := flag.String("callsign", "", "The callsign of the fleet")
+	protocol := flag.String("protocol", "tcp", "The protocol to listen with (tcp, tcp4 or tcp6)")
+	listen := flag.String("listen", "127.0.0.1:0", "The address to listen on for replies from captains (port 0 picks a free port)")
+	external := flag.String("external", "", "The address captains reply to (defaults to -listen)")
+	secret := flag.String("secret", "", "The shared secret of the fleet")
+	token := flag.String("token", "", "The control token of the captains to operate")
+	codec := flag.String("codec", "gob", "The codec to send messages with (gob, json or protobuf)")
+	certFile := flag.String("cert", "", "A TLS certificate to present to captains")
+	keyFile := flag.String("key", "", "The key of the TLS certificate")
+	caFile := flag.String("ca", "", "The CA that captains' certificates are verified against")
+	output := flag.String("output", "table", "The output format (table or json)")
+	timeout := flag.Duration("timeout", 10*time.Second, "How long to wait for a captain to reply")
+	interval := flag.Duration("interval", time.Second, "How often watch asks for the admiral")
+	logLevel := flag.Int("log", 2, "The level of logging, (set to 5 for debug logs)")
+	flag.Usage = usage
+	flag.Parse()
+
+	log.SetLevel(log.Level(*logLevel))
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		log.Fatalf("Unknown output format [%s]", *output)
+	}
+
+	opts := []navy.Option{
+		navy.WithCallSign(*callsign),
+		navy.WithProtocol(*protocol),
+		navy.WithBindAddress(*listen),
+		navy.WithExternalAddress(*external),
+		navy.WithSecret(*secret),
+		navy.WithControlToken(*token),
+	}
+	c, ok := navy.CodecByName(*codec)
+	if !ok {
+		log.Fatalf("Unknown codec [%s]", *codec)
+	}
+	opts = append(opts, navy.WithCodec(c))
+	if *certFile != "" {
+		cfg, err := navy.LoadTLSConfig(*certFile, *keyFile, *caFile, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, navy.WithTLS(cfg))
+	}
+
+	client, err := navy.NewClient(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err = run(ctx, client, flag.Args(), *addr, *output, *timeout, *interval); err != nil {
+		_ = client.Close()
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] admiral|members|watch|leave|resign|transfer <rank>\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// run carries out the command in `args` against the captain at `addr`.
+func run(ctx context.Context, client *navy.Client, args []string, addr, output string, timeout, interval time.Duration) error {
+	request := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	switch args[0] {
+	case "admiral":
+		rctx, cancel := request()
+		defer cancel()
+		admiral, err := client.Admiral(rctx, addr)
+		if err != nil {
+			return err
+		}
+		return printMembers(output, []navy.Member{admiral})
+	case "members":
+		rctx, cancel := request()
+		defer cancel()
+		members, err := client.Members(rctx, addr)
+		if err != nil {
+			return err
+		}
+		return printMembers(output, members)
+	case "watch":
+		return watch(ctx, client, addr, output, timeout, interval)
+	case "leave":
+		rctx, cancel := request()
+		defer cancel()
+		return client.Leave(rctx, addr)
+	case "resign":
+		rctx, cancel := request()
+		defer cancel()
+		return client.Resign(rctx, addr)
+	case "transfer":
+		if len(args) != 2 {
+			return fmt.Errorf("transfer needs the rank of the new admiral")
+		}
+		rank, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("transfer: %v", err)
+		}
+		rctx, cancel := request()
+		defer cancel()
+		// Only the admiral can hand over its leadership
+		admiral, err := client.Admiral(rctx, addr)
+		if err != nil {
+			return err
+		}
+		return client.Transfer(rctx, admiral.Addr, rank)
+	default:
+		return fmt.Errorf("unknown command [%s]", args[0])
+	}
+}
+
+// watch asks the captain at `addr` for the admiral every `interval`, printing
+// the admiral whenever it changes, until `ctx` is done.
+func watch(ctx context.Context, client *navy.Client, addr, output string, timeout, interval time.Duration) error {
+	var last *change
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rctx, cancel := context.WithTimeout(ctx, timeout)
+		admiral, err := client.Admiral(rctx, addr)
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		next := &change{Time: time.Now()}
+		if err != nil {
+			next.Error = err.Error()
+		} else {
+			m := toMember(admiral)
+			next.Admiral = &m
+		}
+		if last == nil || !sameAdmiral(last, next) {
+			if err = printChange(output, next); err != nil {
+				return err
+			}
+			last = next
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sameAdmiral returns `true` if `a` and `b` report the same admiral (or the
+// same error).
+func sameAdmiral(a, b *change) bool {
+	if a.Admiral == nil || b.Admiral == nil {
+		return a.Admiral == b.Admiral && a.Error == b.Error
+	}
+	return a.Admiral.Rank == b.Admiral.Rank && a.Admiral.Address == b.Admiral.Address && a.Admiral.ID == b.Admiral.ID
+}
+
+func toMember(m navy.Member) member {
+	return member{Rank: m.Rank, Address: m.Addr, ID: m.ID, Ready: m.Ready, Admiral: m.Leader, Metadata: m.Metadata}
+}
+
+func printMembers(output string, members []navy.Member) error {
+	printed := make([]member, 0, len(members))
+	for _, m := range members {
+		printed = append(printed, toMember(m))
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(printed)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tADDRESS\tID\tREADY\tADMIRAL\tMETADATA")
+	for _, m := range printed {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%t\t%s\n", m.Rank, m.Address, m.ID, m.Ready, m.Admiral, formatMetadata(m.Metadata))
+	}
+	return w.Flush()
+}
+
+func printChange(output string, c *change) error {
+	if output == "json" {
+		// One object per line, so that the output can be streamed
+		return json.NewEncoder(os.Stdout).Encode(c)
+	}
+	when := c.Time.Format(time.RFC3339)
+	if c.Admiral == nil {
+		_, err := fmt.Printf("%s\tno admiral (%s)\n", when, c.Error)
+		return err
+	}
+	_, err := fmt.Printf("%s\tadmiral is [%s %d] %s\n", when, c.Admiral.Address, c.Admiral.Rank, c.Admiral.ID)
+	return err
+}
+
+// formatMetadata returns `metadata` as sorted key=value pairs.
+func formatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/thebsdbox/navy/pkg/navy"
+)
+
+// config is everything navyd needs to run a captain, read from a YAML or TOML
+// file and then from `NAVY_*` environment variables.
+type config struct {
+	Rank            int               `yaml:"rank" toml:"rank"`
+	BindAddress     string            `yaml:"bindAddress" toml:"bindAddress"`
+	ExternalAddress string            `yaml:"externalAddress" toml:"externalAddress"`
+	Protocol        string            `yaml:"protocol" toml:"protocol"`
+	CallSign        string            `yaml:"callsign" toml:"callsign"`
+	Payload         string            `yaml:"payload" toml:"payload"`
+	Fleet           []string          `yaml:"fleet" toml:"fleet"`
+	Peers           []peer            `yaml:"peers" toml:"peers"`
+	Ready           bool              `yaml:"ready" toml:"ready"`
+	StateDir        string            `yaml:"stateDir" toml:"stateDir"`
+	Metadata        map[string]string `yaml:"metadata" toml:"metadata"`
+	RemoteControl   bool              `yaml:"remoteControl" toml:"remoteControl"`
+	ControlToken    string            `yaml:"controlToken" toml:"controlToken"`
+
+	Secret string    `yaml:"secret" toml:"secret"`
+	Codec  string    `yaml:"codec" toml:"codec"`
+	TLS    tlsConfig `yaml:"tls" toml:"tls"`
+
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval" toml:"heartbeatInterval"`
+	HeartbeatMisses   int           `yaml:"heartbeatMisses" toml:"heartbeatMisses"`
+	LeaseDuration     time.Duration `yaml:"leaseDuration" toml:"leaseDuration"`
+	FleetSize         int           `yaml:"fleetSize" toml:"fleetSize"`
+	Members           []int         `yaml:"members" toml:"members"`
+
+	Hooks          hooks  `yaml:"hooks" toml:"hooks"`
+	LogLevel       string `yaml:"logLevel" toml:"logLevel"`
+	MetricsAddress string `yaml:"metricsAddress" toml:"metricsAddress"`
+}
+
+// peer is a hardcoded peer, the address is kept whole so that IPv6 addresses
+// such as `[::1]:9990` work.
+type peer struct {
+	Rank    int    `yaml:"rank" toml:"rank"`
+	Address string `yaml:"address" toml:"address"`
+}
+
+type tlsConfig struct {
+	Cert   string `yaml:"cert" toml:"cert"`
+	Key    string `yaml:"key" toml:"key"`
+	CA     string `yaml:"ca" toml:"ca"`
+	Mutual bool   `yaml:"mutual" toml:"mutual"`
+}
+
+// hooks are the commands run (with `sh -c`) when this captain is promoted or
+// demoted, `Refuse` gives up leadership if the promotion command fails.
+type hooks struct {
+	Promotion string        `yaml:"promotion" toml:"promotion"`
+	Demotion  string        `yaml:"demotion" toml:"demotion"`
+	Timeout   time.Duration `yaml:"timeout" toml:"timeout"`
+	Refuse    bool          `yaml:"refuse" toml:"refuse"`
+}
+
+// defaultConfig returns the `config` that the file and environment modify.
+func defaultConfig() config {
+	return config{
+		BindAddress: "0.0.0.0:9990",
+		Protocol:    "tcp",
+		Codec:       "gob",
+		LogLevel:    "info",
+		Hooks:       hooks{Timeout: time.Minute},
+	}
+}
+
+// loadConfig reads the config file at `path` (if there is one), picking YAML or
+// TOML from its extension, and then applies the environment.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("loadConfig: %v", err)
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(b, &cfg)
+		case ".toml":
+			err = toml.Unmarshal(b, &cfg)
+		default:
+			return cfg, fmt.Errorf("loadConfig: [%s] should be .yaml, .yml or .toml", path)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("loadConfig: [%s] %v", path, err)
+		}
+	}
+	if err := cfg.fromEnv(os.LookupEnv); err != nil {
+		return cfg, fmt.Errorf("loadConfig: %v", err)
+	}
+	return cfg, nil
+}
+
+// fromEnv overrides `cfg` with any `NAVY_*` environment variables.
+func (cfg *config) fromEnv(lookup func(string) (string, bool)) error {
+	str := func(name string, to *string) {
+		if v, ok := lookup(name); ok {
+			*to = v
+		}
+	}
+	list := func(name string, to *[]string) {
+		if v, ok := lookup(name); ok {
+			*to = split(v)
+		}
+	}
+	var err error
+	num := func(name string, to *int) {
+		if v, ok := lookup(name); ok && err == nil {
+			if *to, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	boolean := func(name string, to *bool) {
+		if v, ok := lookup(name); ok && err == nil {
+			if *to, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	duration := func(name string, to *time.Duration) {
+		if v, ok := lookup(name); ok && err == nil {
+			if *to, err = time.ParseDuration(v); err != nil {
+				err = fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	num("NAVY_RANK", &cfg.Rank)
+	str("NAVY_BIND_ADDRESS", &cfg.BindAddress)
+	str("NAVY_EXTERNAL_ADDRESS", &cfg.ExternalAddress)
+	str("NAVY_PROTOCOL", &cfg.Protocol)
+	str("NAVY_CALLSIGN", &cfg.CallSign)
+	str("NAVY_PAYLOAD", &cfg.Payload)
+	list("NAVY_FLEET", &cfg.Fleet)
+	boolean("NAVY_READY", &cfg.Ready)
+	str("NAVY_STATE_DIR", &cfg.StateDir)
+	boolean("NAVY_REMOTE_CONTROL", &cfg.RemoteControl)
+	str("NAVY_CONTROL_TOKEN", &cfg.ControlToken)
+	str("NAVY_SECRET", &cfg.Secret)
+	str("NAVY_CODEC", &cfg.Codec)
+	str("NAVY_TLS_CERT", &cfg.TLS.Cert)
+	str("NAVY_TLS_KEY", &cfg.TLS.Key)
+	str("NAVY_TLS_CA", &cfg.TLS.CA)
+	boolean("NAVY_TLS_MUTUAL", &cfg.TLS.Mutual)
+	duration("NAVY_HEARTBEAT_INTERVAL", &cfg.HeartbeatInterval)
+	num("NAVY_HEARTBEAT_MISSES", &cfg.HeartbeatMisses)
+	duration("NAVY_LEASE_DURATION", &cfg.LeaseDuration)
+	num("NAVY_FLEET_SIZE", &cfg.FleetSize)
+	str("NAVY_PROMOTION_HOOK", &cfg.Hooks.Promotion)
+	str("NAVY_DEMOTION_HOOK", &cfg.Hooks.Demotion)
+	duration("NAVY_HOOK_TIMEOUT", &cfg.Hooks.Timeout)
+	boolean("NAVY_HOOK_REFUSE", &cfg.Hooks.Refuse)
+	str("NAVY_LOG_LEVEL", &cfg.LogLevel)
+	str("NAVY_METRICS_ADDRESS", &cfg.MetricsAddress)
+	if err != nil {
+		return err
+	}
+
+	// NAVY_PEERS=1=[::1]:9990,2=10.0.0.2:9990
+	if v, ok := lookup("NAVY_PEERS"); ok {
+		cfg.Peers = nil
+		for _, p := range split(v) {
+			rank, addr, found := strings.Cut(p, "=")
+			if !found {
+				return fmt.Errorf("NAVY_PEERS: [%s] should be <rank>=<address>", p)
+			}
+			r, err := strconv.Atoi(rank)
+			if err != nil {
+				return fmt.Errorf("NAVY_PEERS: %v", err)
+			}
+			cfg.Peers = append(cfg.Peers, peer{Rank: r, Address: addr})
+		}
+	}
+	// NAVY_MEMBERS=1,2,3
+	if v, ok := lookup("NAVY_MEMBERS"); ok {
+		cfg.Members = nil
+		for _, m := range split(v) {
+			r, err := strconv.Atoi(m)
+			if err != nil {
+				return fmt.Errorf("NAVY_MEMBERS: %v", err)
+			}
+			cfg.Members = append(cfg.Members, r)
+		}
+	}
+	// NAVY_METADATA=zone=a,version=1.2
+	if v, ok := lookup("NAVY_METADATA"); ok {
+		cfg.Metadata = make(map[string]string)
+		for _, kv := range split(v) {
+			k, val, _ := strings.Cut(kv, "=")
+			cfg.Metadata[k] = val
+		}
+	}
+	return nil
+}
+
+// split returns the comma separated values in `s`, ignoring empty values.
+func split(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// navyConfig returns the `navy.Config` for `cfg`.
+func (cfg config) navyConfig() (navy.Config, error) {
+	n := navy.DefaultConfig()
+	n.Rank = cfg.Rank
+	n.BindAddress = cfg.BindAddress
+	n.ExternalAddress = cfg.ExternalAddress
+	n.Protocol = cfg.Protocol
+	n.CallSign = cfg.CallSign
+	n.Payload = cfg.Payload
+	n.Fleet = cfg.Fleet
+	n.Ready = cfg.Ready
+	n.StateDir = cfg.StateDir
+	n.Metadata = cfg.Metadata
+	n.RemoteControl = cfg.RemoteControl
+	n.ControlToken = cfg.ControlToken
+	n.HeartbeatInterval = cfg.HeartbeatInterval
+	if cfg.HeartbeatMisses != 0 {
+		n.HeartbeatMisses = cfg.HeartbeatMisses
+	}
+	n.LeaseDuration = cfg.LeaseDuration
+	n.FleetSize = cfg.FleetSize
+	n.Members = cfg.Members
+	n.Secret = []byte(cfg.Secret)
+	if len(cfg.Peers) != 0 {
+		n.Peers = make(map[int]string, len(cfg.Peers))
+		for _, p := range cfg.Peers {
+			n.Peers[p.Rank] = p.Address
+		}
+	}
+
+	codec, ok := navy.CodecByName(cfg.Codec)
+	if !ok {
+		return n, fmt.Errorf("unknown codec [%s]", cfg.Codec)
+	}
+	n.Codec = codec
+	if cfg.TLS.Cert != "" {
+		tlsCfg, err := navy.LoadTLSConfig(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.CA, cfg.TLS.Mutual)
+		if err != nil {
+			return n, err
+		}
+		n.TLS = tlsCfg
+	}
+	return n, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes `contents` to a file called `name` in a new directory,
+// returning its path.
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// fileConfig is the config that both `fileYAML` and `fileTOML` describe.
+func fileConfig() config {
+	cfg := defaultConfig()
+	cfg.Rank = 2
+	cfg.BindAddress = "[::]:9990"
+	cfg.ExternalAddress = "[fd00::2]:9990"
+	cfg.CallSign = "fleet"
+	cfg.Fleet = []string{"[fd00::1]:9990", "10.0.0.3:9990"}
+	cfg.Peers = []peer{{Rank: 1, Address: "[fd00::1]:9990"}, {Rank: 3, Address: "10.0.0.3:9990"}}
+	cfg.Metadata = map[string]string{"zone": "a"}
+	cfg.HeartbeatInterval = 500 * time.Millisecond
+	cfg.LeaseDuration = 5 * time.Second
+	cfg.FleetSize = 3
+	cfg.Hooks = hooks{Promotion: "ip addr add 10.0.0.100/24 dev eth0", Timeout: 10 * time.Second, Refuse: true}
+	return cfg
+}
+
+const fileYAML = `rank: 2
+bindAddress: "[::]:9990"
+externalAddress: "[fd00::2]:9990"
+callsign: fleet
+fleet: ["[fd00::1]:9990", "10.0.0.3:9990"]
+peers:
+  - rank: 1
+    address: "[fd00::1]:9990"
+  - rank: 3
+    address: "10.0.0.3:9990"
+metadata:
+  zone: a
+heartbeatInterval: 500ms
+leaseDuration: 5s
+fleetSize: 3
+hooks:
+  promotion: ip addr add 10.0.0.100/24 dev eth0
+  timeout: 10s
+  refuse: true
+`
+
+const fileTOML = `rank = 2
+bindAddress = "[::]:9990"
+externalAddress = "[fd00::2]:9990"
+callsign = "fleet"
+fleet = ["[fd00::1]:9990", "10.0.0.3:9990"]
+heartbeatInterval = "500ms"
+leaseDuration = "5s"
+fleetSize = 3
+
+[[peers]]
+rank = 1
+address = "[fd00::1]:9990"
+
+[[peers]]
+rank = 3
+address = "10.0.0.3:9990"
+
+[metadata]
+zone = "a"
+
+[hooks]
+promotion = "ip addr add 10.0.0.100/24 dev eth0"
+timeout = "10s"
+refuse = true
+`
+
+func TestLoadConfigFile(t *testing.T) {
+	for name, contents := range map[string]string{"navyd.yaml": fileYAML, "navyd.yml": fileYAML, "navyd.toml": fileTOML} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfig(t, name, contents))
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if want := fileConfig(); !reflect.DeepEqual(cfg, want) {
+				t.Errorf("config = %+v, want %+v", cfg, want)
+			}
+
+			// IPv6 peers are kept whole and pass validation
+			n, err := cfg.navyConfig()
+			if err != nil {
+				t.Fatalf("navyConfig: %v", err)
+			}
+			if n.Peers[1] != "[fd00::1]:9990" || n.Peers[3] != "10.0.0.3:9990" {
+				t.Errorf("peers = %v", n.Peers)
+			}
+			if err = n.Validate(); err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"navyd.json":     `{"rank": 1}`,
+		"navyd.yaml":     "rank: [1",
+		"navyd.toml":     "rank = ",
+		"duration.yaml":  "leaseDuration: soon",
+		"duration.toml":  `leaseDuration = "soon"`,
+		"wrongtype.yaml": "rank: first",
+	}
+	for name, contents := range tests {
+		if _, err := loadConfig(writeConfig(t, name, contents)); err == nil {
+			t.Errorf("[%s] was loaded", name)
+		}
+	}
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("a missing file was loaded")
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	env := map[string]string{
+		"NAVY_RANK":               "5",
+		"NAVY_BIND_ADDRESS":       "[::1]:9995",
+		"NAVY_FLEET":              "[::1]:9990, 10.0.0.1:9990,",
+		"NAVY_READY":              "true",
+		"NAVY_HEARTBEAT_INTERVAL": "1s",
+		"NAVY_LEASE_DURATION":     "3s",
+		"NAVY_PEERS":              "1=[::1]:9990,2=10.0.0.2:9990",
+		"NAVY_MEMBERS":            "1,2,5",
+		"NAVY_METADATA":           "zone=b,version=1.2",
+		"NAVY_TLS_MUTUAL":         "1",
+		"NAVY_HOOK_TIMEOUT":       "30s",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	// The environment overrides the file
+	cfg := fileConfig()
+	if err := cfg.fromEnv(lookup); err != nil {
+		t.Fatalf("fromEnv: %v", err)
+	}
+	want := fileConfig()
+	want.Rank = 5
+	want.BindAddress = "[::1]:9995"
+	want.Fleet = []string{"[::1]:9990", "10.0.0.1:9990"}
+	want.Ready = true
+	want.HeartbeatInterval = time.Second
+	want.LeaseDuration = 3 * time.Second
+	want.Peers = []peer{{Rank: 1, Address: "[::1]:9990"}, {Rank: 2, Address: "10.0.0.2:9990"}}
+	want.Members = []int{1, 2, 5}
+	want.Metadata = map[string]string{"zone": "b", "version": "1.2"}
+	want.TLS.Mutual = true
+	want.Hooks.Timeout = 30 * time.Second
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config = %+v, want %+v", cfg, want)
+	}
+
+	for name, value := range map[string]string{
+		"NAVY_RANK":           "five",
+		"NAVY_READY":          "sometimes",
+		"NAVY_LEASE_DURATION": "3",
+		"NAVY_PEERS":          "[::1]:9990",
+		"NAVY_MEMBERS":        "1,two",
+	} {
+		cfg := defaultConfig()
+		err := cfg.fromEnv(func(n string) (string, bool) {
+			if n == name {
+				return value, true
+			}
+			return "", false
+		})
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s=%s gave error [%v]", name, value, err)
+		}
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	path := writeConfig(t, "navyd.yaml", fileYAML)
+	t.Setenv("NAVY_CALLSIGN", "other")
+	t.Setenv("NAVY_PEERS", "4=[fd00::4]:9990")
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.CallSign != "other" || !reflect.DeepEqual(cfg.Peers, []peer{{Rank: 4, Address: "[fd00::4]:9990"}}) {
+		t.Errorf("environment didn't override the file: %+v", cfg)
+	}
+	if cfg.Rank != 2 {
+		t.Errorf("rank = %d, want the [2] from the file", cfg.Rank)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeConfig(t, "navyd.yaml", "rank: 1\ncallsign: fleet\nbindAddress: 127.0.0.1:9990\npayload: first\n")
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	d, err := newDaemon(path, cfg)
+	if err != nil {
+		t.Fatalf("newDaemon: %v", err)
+	}
+
+	// What can change while running is applied straight away
+	if err = os.WriteFile(path, []byte("rank: 4\ncallsign: fleet\nbindAddress: 127.0.0.1:9990\npayload: second\nmetadata:\n  zone: b\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	d.reload()
+	if d.captain.Rank() != 4 {
+		t.Errorf("rank = %d after reloading, want 4", d.captain.Rank())
+	}
+	if payload, version := d.captain.Payload(); string(payload) != "second" || version != 2 {
+		t.Errorf("payload = [%s] at version [%d] after reloading", payload, version)
+	}
+	if zone := d.captain.Metadata()["zone"]; zone != "b" {
+		t.Errorf("metadata zone = [%s] after reloading", zone)
+	}
+
+	// A broken file keeps the running configuration
+	if err = os.WriteFile(path, []byte("rank: [\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	d.reload()
+	if d.captain.Rank() != 4 || d.cfg.Payload != "second" {
+		t.Errorf("a broken file changed the configuration: rank [%d] payload [%s]", d.captain.Rank(), d.cfg.Payload)
+	}
+}
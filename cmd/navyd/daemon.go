@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thebsdbox/navy/pkg/navy"
+)
+
+// daemon is a captain along with the configuration it was started with.
+type daemon struct {
+	path    string
+	captain *navy.Captain
+
+	mu  sync.Mutex
+	cfg config
+}
+
+// setHooks runs the promotion and demotion commands of `hooks` from now on.
+func (d *daemon) setHooks(hooks hooks) {
+	d.captain.OnPromotionExec(navy.ExecHook{Command: hooks.Promotion, Timeout: hooks.Timeout, Refuse: hooks.Refuse})
+	d.captain.OnDemotionExec(navy.ExecHook{Command: hooks.Demotion, Timeout: hooks.Timeout})
+}
+
+// reload reads the configuration again and applies what can be changed while
+// the captain is running: the log level, hooks, payload, metadata and rank.
+func (d *daemon) reload() {
+	log.Infof("[NAVYD] reloading [%s]", d.path)
+	cfg, err := loadConfig(d.path)
+	if err != nil {
+		log.Errorf("[NAVYD] keeping the current configuration: %v", err)
+		return
+	}
+	if err = setLogLevel(cfg.LogLevel); err != nil {
+		log.Errorf("[NAVYD] %v", err)
+	}
+
+	d.mu.Lock()
+	old := d.cfg
+	d.cfg = cfg
+	d.mu.Unlock()
+
+	if cfg.Hooks != old.Hooks {
+		d.setHooks(cfg.Hooks)
+	}
+	if cfg.Payload != old.Payload {
+		if err = d.captain.SetPayloadBytes([]byte(cfg.Payload)); err != nil {
+			log.Errorf("[NAVYD] %v", err)
+		}
+	}
+	if !reflect.DeepEqual(cfg.Metadata, old.Metadata) {
+		d.captain.SetMetadata(cfg.Metadata)
+	}
+	if cfg.Rank != old.Rank {
+		if err = d.captain.SetRank(cfg.Rank); err != nil {
+			log.Errorf("[NAVYD] %v", err)
+		}
+	}
+
+	// Everything else is only read when the captain starts
+	old.LogLevel, old.Hooks, old.Payload, old.Metadata, old.Rank = cfg.LogLevel, cfg.Hooks, cfg.Payload, cfg.Metadata, cfg.Rank
+	if !reflect.DeepEqual(cfg, old) {
+		log.Warnf("[NAVYD] some changes only take effect when navyd is restarted")
+	}
+}
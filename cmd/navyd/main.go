@@ -0,0 +1,129 @@
+// navyd runs a single navy captain as a daemon, configured from a YAML or TOML
+// file and `NAVY_*` environment variables.
+//
+//	navyd -config /etc/navy/navyd.yaml
+//
+// The promotion and demotion hooks are run with `sh -c`, with the leader in
+// the environment (`NAVY_EVENT`, `NAVY_LEADER_RANK`, `NAVY_LEADER_ADDRESS`,
+// `NAVY_PAYLOAD` and `NAVY_TERM`, see `navy.ExecHook`). A SIGHUP reloads the configuration, and a
+// SIGINT or SIGTERM leaves the fleet and exits. With `metricsAddress` set, the
+// Prometheus metrics of the captain are served on `/metrics`, navyd leaves the
+// fleet and exits if they can't be served.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thebsdbox/navy/pkg/navy"
+)
+
+func main() {
+	path := flag.String("config", os.Getenv("NAVY_CONFIG"), "A YAML or TOML config file (NAVY_* environment variables override it)")
+	flag.Parse()
+
+	if err := run(*path); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("[NAVYD] left the fleet")
+}
+
+// run runs the captain configured by the file at `path` until it is signalled
+// to stop, or serving the metrics fails. The captain has left the fleet by the
+// time it returns.
+func run(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err = setLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	d, err := newDaemon(path, cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				d.reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// A failure serving the metrics stops the captain as a signal would, so
+	// that it still leaves the fleet
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	metricsErr := make(chan error, 1)
+	if cfg.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", d.captain.MetricsHandler())
+		metrics := &http.Server{Addr: cfg.MetricsAddress, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Infof("[NAVYD] serving metrics on [%s]", cfg.MetricsAddress)
+			if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				metricsErr <- fmt.Errorf("metrics: %v", err)
+				cancel()
+			}
+		}()
+		defer func() {
+			_ = metrics.Close()
+		}()
+	}
+
+	log.Infof("[NAVYD] captain [%d] listening on [%s]", cfg.Rank, cfg.BindAddress)
+	if err = d.captain.Start(); err != nil {
+		return err
+	}
+	if err = d.captain.Run(ctx); err != nil {
+		return err
+	}
+	select {
+	case err = <-metricsErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// setLogLevel sets the logrus level from its name.
+func setLogLevel(level string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(l)
+	return nil
+}
+
+// newDaemon returns a `daemon` running a captain built from `cfg`.
+func newDaemon(path string, cfg config) (*daemon, error) {
+	n, err := cfg.navyConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := navy.New(navy.WithConfig(n))
+	if err != nil {
+		return nil, err
+	}
+	d := &daemon{path: path, cfg: cfg, captain: c}
+	d.setHooks(cfg.Hooks)
+	return d, nil
+}
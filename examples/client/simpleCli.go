@@ -1,19 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/thebsdbox/navy/pkg/navy"
 )
 
 func main() {
 	log.SetLevel(log.DebugLevel)
 	addr := flag.String("address", "0.0.0.0:9990", "The address of a peer and port")
-	//rank := flag.Int("rank", 0, "The rank of a peer")
-	// ready := flag.Bool("ready", false, "Set this instance to ready")
-	// peers := flag.String("peers", "", "A comma seperated list of peers, each peer should be <rank>:<ADDRESS>:<PORT>")
-	// fleet := flag.String("fleet", "", "The address of an existing fleet member")
-	// callsign := flag.String("callsign", "", "The address of an existing fleet member")
+	listen := flag.String("listen", "127.0.0.1:0", "The address to listen on for the reply")
+	callsign := flag.String("callsign", "", "The callsign of the fleet")
 
 	logLevel := flag.Int("log", 4, "The level of logging, (set to 5 for debug logs)")
 	//Parse the flags
@@ -23,5 +23,18 @@ func main() {
 	log.SetLevel(log.Level(*logLevel))
 
 	log.Infof("Connecting to [%s]", *addr)
+	client, err := navy.NewClient(navy.WithCallSign(*callsign), navy.WithBindAddress(*listen))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
 
+	// cmd/navyctl does a lot more than this, this just asks who the admiral is
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	admiral, err := client.Admiral(ctx, *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("The admiral is [%s %d]", admiral.Addr, admiral.Rank)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thebsdbox/navy/pkg/navy"
+)
+
+// A whole fleet running in a single process over the in-memory transport, the
+// admiral leaves after a while and the remaining captains elect a new one.
+func main() {
+	size := flag.Int("size", 3, "The number of captains in the fleet")
+	logLevel := flag.Int("log", 4, "The level of logging, (set to 5 for debug logs)")
+	flag.Parse()
+
+	// Set the logging level
+	log.SetLevel(log.Level(*logLevel))
+
+	transport := navy.NewMemoryTransport()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	captains := make([]*navy.Captain, 0, *size)
+	for rank := 1; rank <= *size; rank++ {
+		var fleet []string
+		if rank != 1 {
+			fleet = []string{"captain-1:0"}
+		}
+		c, err := navy.New(
+			navy.WithRank(rank*10),
+			navy.WithBindAddress(fmt.Sprintf("captain-%d:0", rank)),
+			navy.WithCallSign("memory"),
+			navy.WithTransport(transport),
+			navy.WithReady(rank == 1),
+			navy.WithFleet(fleet...),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rank := rank * 10
+		c.OnPromotionContext(func(ctx context.Context, leader navy.Leader) error {
+			fmt.Printf("%s -> %d (term %d)\n", time.Now().Format("15:04:05"), rank, leader.Term)
+			return nil
+		}, time.Second)
+		c.OnDemotionContext(func(ctx context.Context, leader navy.Leader) error {
+			fmt.Printf("%s <- %d\n", time.Now().Format("15:04:05"), rank)
+			return nil
+		}, time.Second)
+
+		if err = c.Start(); err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := c.Run(ctx); err != nil {
+				log.Error(err)
+			}
+		}()
+		captains = append(captains, c)
+		// give the fleet a chance to elect an admiral
+		time.Sleep(2 * time.Second)
+	}
+
+	admiral := captains[len(captains)-1]
+	fmt.Printf("Admiral is [%s %d], leaving the fleet\n", admiral.LeaderAddress(), admiral.LeaderRank())
+	admiral.LeaveFleet()
+	time.Sleep(2 * time.Second)
+
+	fmt.Printf("Admiral is now [%s %d]\n", captains[0].LeaderAddress(), captains[0].LeaderRank())
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,6 +24,7 @@ func main() {
 	peers := flag.String("peers", "", "A comma seperated list of peers, each peer should be <rank>:<ADDRESS>:<PORT>")
 	fleet := flag.String("fleet", "", "The address of an existing fleet member")
 	callsign := flag.String("callsign", "", "The address of an existing fleet member")
+	stateDir := flag.String("state", "", "A directory to save the fleet to, so that a restart can rejoin without -fleet")
 
 	logLevel := flag.Int("log", 4, "The level of logging, (set to 5 for debug logs)")
 
@@ -56,7 +60,12 @@ func main() {
 		members = strings.Split(*fleet, ",")
 	}
 
-	b, err := navy.NewCaptainandGo(*rank, *bindaddr, *extadd, "tcp4", *callsign, "", members, *ready, true, remotePeers)
+	var opts []navy.Option
+	if *stateDir != "" {
+		opts = append(opts, navy.WithStateDir(*stateDir))
+	}
+
+	b, err := navy.NewCaptainandGo(*rank, *bindaddr, *extadd, "tcp4", *callsign, "", members, *ready, false, remotePeers, opts...)
 	if err != nil {
 		log.Fatalf("Creating new captain [%v]", err)
 	}
@@ -91,7 +100,11 @@ func main() {
 	b.OnPromotion(promotedFunc)
 	b.OnDemotion(demotionFunc)
 
-	err = b.Run(nil)
+	// The application owns the signal handling, cancelling the context will shut the captain down
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	err = b.Run(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -109,7 +110,7 @@ func main() {
 	c.OnPromotion(promotedFunc)
 	c.OnDemotion(demotionFunc)
 
-	err = c.Run(nil)
+	err = c.Run(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -98,7 +99,7 @@ func main() {
 	b.OnPromotion(promotedFunc)
 	b.OnDemotion(demotionFunc)
 
-	err = b.Run(nil)
+	err = b.Run(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
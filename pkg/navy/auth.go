@@ -0,0 +1,233 @@
+package navy
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// authWindow is how far a message's timestamp may be from the local clock, a
+// message outside of this window is rejected as a replay.
+const authWindow = 30 * time.Second
+
+// authenticator is a `struct` that signs and verifies messages with a key
+// derived from the shared secret and the callsign of the fleet.
+type authenticator struct {
+	key []byte
+
+	mu     sync.Mutex
+	nonces map[uint64]bool // nonces seen within the window
+	expiry nonceHeap       // the nonces in `nonces`, soonest to be forgotten first
+}
+
+// seenNonce is a nonce and when it can be forgotten.
+type seenNonce struct {
+	nonce  uint64
+	expiry time.Time
+}
+
+// nonceHeap is a min-heap of `seenNonce`s ordered by expiry, so that expired
+// nonces are forgotten without scanning every nonce in the window.
+type nonceHeap []seenNonce
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expiry.Before(h[j].expiry) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(seenNonce)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// newAuthenticator returns a new `authenticator` for the fleet `callsign`, the
+// callsign is mixed into the key so that a secret can't be reused across
+// fleets.
+func newAuthenticator(secret []byte, callsign string) *authenticator {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(callsign))
+	return &authenticator{
+		key:    mac.Sum(nil),
+		nonces: make(map[uint64]bool),
+	}
+}
+
+// sign sets the recipient, timestamp, nonce and MAC of `msg`. `to` is the
+// address of the captain the message is for, or empty when the sender can't
+// be sure of the address the recipient knows itself by (such as a seed).
+func (a *authenticator) sign(msg *Message, to string) {
+	var nonce [8]byte
+	msg.To = to
+	_, _ = rand.Read(nonce[:])
+	msg.Timestamp = time.Now().UnixNano()
+	msg.Nonce = binary.BigEndian.Uint64(nonce[:])
+	msg.MAC = a.mac(msg)
+}
+
+// verify checks the MAC of `msg`, that it is for one of the addresses in
+// `self` and that it isn't a replay, returning an `error` describing why it
+// was rejected.
+//
+// NOTE: This function is thread-safe.
+func (a *authenticator) verify(msg *Message, self ...string) error {
+	if len(msg.MAC) == 0 {
+		return fmt.Errorf("message isn't signed")
+	}
+	if !hmac.Equal(msg.MAC, a.mac(msg)) {
+		return fmt.Errorf("message signature is invalid")
+	}
+	if msg.To != "" && !contains(self, msg.To) {
+		return fmt.Errorf("message is for [%s]", msg.To)
+	}
+
+	now := time.Now()
+	sent := time.Unix(0, msg.Timestamp)
+	if sent.Before(now.Add(-authWindow)) || sent.After(now.Add(authWindow)) {
+		return fmt.Errorf("message timestamp [%s] is outside of the window", sent.Format(time.RFC3339))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.expiry.Len() > 0 && now.After(a.expiry[0].expiry) {
+		delete(a.nonces, heap.Pop(&a.expiry).(seenNonce).nonce)
+	}
+	if a.nonces[msg.Nonce] {
+		return fmt.Errorf("message nonce [%d] has already been seen", msg.Nonce)
+	}
+	// a nonce only needs remembering for as long as its timestamp is accepted
+	a.nonces[msg.Nonce] = true
+	heap.Push(&a.expiry, seenNonce{nonce: msg.Nonce, expiry: sent.Add(authWindow)})
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mac returns the MAC of every field of `msg`, other than the MAC itself.
+func (a *authenticator) mac(msg *Message) []byte {
+	h := hmac.New(sha256.New, a.key)
+	writeInt(h, int64(msg.Rank))
+	writeString(h, msg.Addr)
+	writeInt(h, int64(msg.Type))
+	writeString(h, msg.CallSign)
+	writeBool(h, msg.OneShot)
+	writeInt(h, int64(len(msg.Peers)))
+	for _, peer := range msg.Peers {
+		writeInt(h, int64(peer.Rank))
+		writeString(h, peer.Addr)
+		writeBool(h, peer.Ready)
+		writeString(h, peer.ID)
+	}
+	writeString(h, msg.Payload)
+	writeString(h, string(msg.Data))
+	writeInt(h, int64(msg.PayloadVersion))
+	writeInt(h, int64(msg.Term))
+	writeInt(h, msg.Timestamp)
+	writeInt(h, int64(msg.Nonce))
+	writeInt(h, int64(msg.Version))
+	writeInt(h, int64(len(msg.Metadata)))
+	for _, md := range msg.Metadata {
+		writeInt(h, int64(md.Rank))
+		writeString(h, md.Addr)
+		writeInt(h, int64(md.Version))
+		writeString(h, md.ID)
+		writeInt(h, md.Incarnation)
+		keys := make([]string, 0, len(md.Metadata))
+		for k := range md.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeInt(h, int64(len(keys)))
+		for _, k := range keys {
+			writeString(h, k)
+			writeString(h, md.Metadata[k])
+		}
+	}
+	writeInt(h, int64(msg.OldRank))
+	writeInt(h, int64(msg.Target))
+	writeString(h, msg.ID)
+	writeString(h, msg.Command)
+	writeString(h, msg.Error)
+	writeString(h, msg.To)
+	writeString(h, msg.Token)
+	writeInt(h, int64(msg.Seq))
+	writeInt(h, int64(len(msg.Entries)))
+	for _, entry := range msg.Entries {
+		writeString(h, entry.Key)
+		writeString(h, string(entry.Value))
+		writeBool(h, entry.Deleted)
+	}
+	writeInt(h, int64(len(msg.Types)))
+	for _, t := range msg.Types {
+		writeInt(h, int64(t))
+	}
+	return h.Sum(nil)
+}
+
+func writeInt(h hash.Hash, v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	h.Write(b[:])
+}
+
+func writeString(h hash.Hash, s string) {
+	writeInt(h, int64(len(s)))
+	h.Write([]byte(s))
+}
+
+func writeBool(h hash.Hash, v bool) {
+	if v {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+}
+
+// seal stamps `msg` with the ID of this captain (when it is the sender) and
+// signs it for the captain at `to` when this captain has a shared secret, and
+// returns it. Every message is sealed just before it is written, by `write` or
+// `encode`.
+func (c *Captain) seal(msg *Message, to string) *Message {
+	if msg.ID == "" && msg.Addr == c.extaddr {
+		msg.ID = c.id
+	}
+	if c.auth != nil {
+		c.auth.sign(msg, to)
+	}
+	return msg
+}
+
+// authentic returns `true` if `msg` should be processed, a message that fails
+// verification is reported with a `MessageRejected` event.
+func (c *Captain) authentic(msg *Message) bool {
+	if c.auth == nil {
+		return true
+	}
+	if err := c.auth.verify(msg, c.extaddr, c.bindaddr); err != nil {
+		c.messageRejected(msg, err)
+		return false
+	}
+	return true
+}
+
+// messageRejected reports a message that failed verification.
+func (c *Captain) messageRejected(msg *Message, err error) {
+	log.Warnf("[AUTH] rejected [%s] from [%s %d] [%v]", MessageStrings[msg.Type], msg.Addr, msg.Rank, err)
+	c.emit(Event{Type: MessageRejected, Rank: msg.Rank, Addr: msg.Addr, Err: err})
+}
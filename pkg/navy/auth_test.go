@@ -0,0 +1,80 @@
+package navy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func signed(a *authenticator, to string) *Message {
+	msg := &Message{Rank: 2, Addr: "captain-2:7946", Type: HEARTBEAT, CallSign: "fleet", Term: 1}
+	a.sign(msg, to)
+	return msg
+}
+
+func TestAuthRecipient(t *testing.T) {
+	a := newAuthenticator([]byte("secret"), "fleet")
+
+	if err := a.verify(signed(a, "captain-1:7946"), "captain-1:7946"); err != nil {
+		t.Errorf("message for this captain: %v", err)
+	}
+	if err := a.verify(signed(a, ""), "captain-1:7946"); err != nil {
+		t.Errorf("message for any captain: %v", err)
+	}
+	// A message captured on its way to one captain can't be replayed to another
+	err := a.verify(signed(a, "captain-3:7946"), "captain-1:7946")
+	if err == nil || !strings.Contains(err.Error(), "is for") {
+		t.Errorf("message for another captain wasn't rejected: %v", err)
+	}
+	msg := signed(a, "captain-3:7946")
+	msg.To = "captain-1:7946"
+	if err = a.verify(msg, "captain-1:7946"); err == nil {
+		t.Errorf("readdressed message wasn't rejected")
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	a := newAuthenticator([]byte("secret"), "fleet")
+
+	msg := signed(a, "")
+	if err := a.verify(msg); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := a.verify(msg); err == nil {
+		t.Errorf("replayed message wasn't rejected")
+	}
+	if err := a.verify(signed(newAuthenticator([]byte("other"), "fleet"), "")); err == nil {
+		t.Errorf("message signed with another secret wasn't rejected")
+	}
+}
+
+func TestAuthNonceExpiry(t *testing.T) {
+	a := newAuthenticator([]byte("secret"), "fleet")
+
+	// A nonce is remembered until its timestamp falls out of the window
+	old := signed(a, "")
+	old.Timestamp = time.Now().Add(-authWindow + 50*time.Millisecond).UnixNano()
+	old.MAC = a.mac(old)
+	if err := a.verify(old); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := a.verify(signed(a, "")); err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+	}
+	if len(a.nonces) != 4 || a.expiry.Len() != 4 {
+		t.Fatalf("remembering %d nonces (%d in the heap), want 4", len(a.nonces), a.expiry.Len())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := a.verify(signed(a, "")); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(a.nonces) != 4 || a.expiry.Len() != 4 {
+		t.Errorf("remembering %d nonces (%d in the heap), want 4", len(a.nonces), a.expiry.Len())
+	}
+	if a.nonces[old.Nonce] {
+		t.Errorf("expired nonce is still remembered")
+	}
+}
@@ -0,0 +1,263 @@
+package navy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Leader is a `struct` describing the admiral of the fleet, it is passed to the
+// promotion and demotion functions.
+type Leader struct {
+	Rank           int
+	Addr           string
+	Payload        string
+	PayloadVersion uint64 // incremented by the leader every time its payload changes
+	Term           uint64 // the fencing token of this leadership
+}
+
+// CallbackFunc is a promotion or demotion function. The `ctx` is cancelled
+// when the callback timeout expires or the captain is shut down.
+type CallbackFunc func(ctx context.Context, leader Leader) error
+
+// callback is a `CallbackFunc` along with its optional timeout.
+type callback struct {
+	name    string
+	fn      CallbackFunc
+	timeout time.Duration
+}
+
+// callbackJob is a single invocation of a `callback`.
+type callbackJob struct {
+	cb     callback
+	leader Leader
+}
+
+// dispatcher is a `struct` that executes callbacks in order on a single
+// worker, outside of any of the captain's locks.
+type dispatcher struct {
+	mu      sync.Mutex
+	queue   []callbackJob
+	started bool
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	onError func(name string, err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newDispatcher returns a new `dispatcher`, failed callbacks are passed to
+// `onError`. Callbacks are queued until its worker is started with `start`.
+func newDispatcher(onError func(name string, err error)) *dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dispatcher{
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		onError: onError,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// start starts the worker, unless it has already been started or the
+// dispatcher has been closed.
+//
+// NOTE: This function is thread-safe.
+func (d *dispatcher) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started || d.closed {
+		return
+	}
+	d.started = true
+	go d.work()
+}
+
+// enqueue adds `cb` to the queue, it never blocks so it is safe to call while
+// holding a lock.
+//
+// NOTE: This function is thread-safe.
+func (d *dispatcher) enqueue(cb callback, leader Leader) {
+	if cb.fn == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		log.Warnf("[CALLBACK] dispatcher closed, dropping [%s]", cb.name)
+		return
+	}
+	d.queue = append(d.queue, callbackJob{cb: cb, leader: leader})
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the next job from the queue, returning `false` once the queue is
+// empty and closed.
+func (d *dispatcher) next() (callbackJob, bool) {
+	for {
+		d.mu.Lock()
+		if len(d.queue) != 0 {
+			job := d.queue[0]
+			d.queue = d.queue[1:]
+			d.mu.Unlock()
+			return job, true
+		}
+		closed := d.closed
+		d.mu.Unlock()
+		if closed {
+			return callbackJob{}, false
+		}
+		<-d.wake
+	}
+}
+
+// work executes the queued callbacks in order.
+//
+// NOTE: this function loops until the dispatcher is closed and drained.
+func (d *dispatcher) work() {
+	defer close(d.done)
+	for {
+		job, ok := d.next()
+		if !ok {
+			return
+		}
+		if err := d.run(job); err != nil {
+			d.onError(job.cb.name, err)
+		}
+	}
+}
+
+// run executes a single callback, returning once it has completed or its
+// context has expired. A callback that ignores its context is abandoned so
+// that it can't hold up the callbacks queued behind it.
+func (d *dispatcher) run(job callbackJob) error {
+	ctx := d.ctx
+	if job.cb.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.cb.timeout)
+		defer cancel()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		result <- job.cb.fn(ctx, job.leader)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops the dispatcher accepting callbacks and waits for the queued ones
+// to complete. If `ctx` expires first, the running callback is cancelled. The
+// callbacks of a dispatcher that was never started are dropped.
+func (d *dispatcher) close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	started := d.started
+	if !started && len(d.queue) != 0 {
+		log.Warnf("[CALLBACK] dispatcher never started, dropping [%d] callbacks", len(d.queue))
+		d.queue = nil
+	}
+	d.mu.Unlock()
+
+	if !started {
+		d.cancel()
+		return nil
+	}
+
+	select {
+	case <-d.done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		return fmt.Errorf("callbacks: %v", ctx.Err())
+	}
+}
+
+// legacyCallback adapts a function that closes `exit` when it has completed
+// into a `CallbackFunc`.
+func legacyCallback(fn func(chan interface{})) CallbackFunc {
+	if fn == nil {
+		return nil
+	}
+	return func(ctx context.Context, _ Leader) error {
+		exit := make(chan interface{})
+		go fn(exit)
+		select {
+		case <-exit:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// OnPromotion sets the function that is called when this captain is promoted
+// to admiral, the function must close `exit` once it has completed.
+//
+// NOTE: The function is called with the timeout from `Config.CallbackTimeout`.
+func (c *Captain) OnPromotion(promotion func(chan interface{})) {
+	c.OnPromotionContext(legacyCallback(promotion), c.callbackTimeout)
+}
+
+// OnDemotion sets the function that is called when this captain is demoted
+// from admiral, the function must close `exit` once it has completed.
+//
+// NOTE: The function is called with the timeout from `Config.CallbackTimeout`.
+func (c *Captain) OnDemotion(demotion func(chan interface{})) {
+	c.OnDemotionContext(legacyCallback(demotion), c.callbackTimeout)
+}
+
+// OnPromotionContext sets the function that is called when this captain is
+// promoted to admiral. A `timeout` of zero means the function is never timed
+// out.
+//
+// NOTE: Callbacks are executed in order on a dedicated worker, so they are
+// free to call any of the captain's functions.
+func (c *Captain) OnPromotionContext(promotion CallbackFunc, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.promoted = callback{name: "promotion", fn: promotion, timeout: timeout}
+}
+
+// OnDemotionContext sets the function that is called when this captain is
+// demoted from admiral, it is passed the new leader (if there is one). A
+// `timeout` of zero means the function is never timed out.
+//
+// NOTE: Callbacks are executed in order on a dedicated worker, so they are
+// free to call any of the captain's functions.
+func (c *Captain) OnDemotionContext(demotion CallbackFunc, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.demoted = callback{name: "demotion", fn: demotion, timeout: timeout}
+}
+
+// callbackFailed reports a callback that returned an error or timed out.
+func (c *Captain) callbackFailed(name string, err error) {
+	log.Errorf("[CALLBACK] %s function failed [%v]", name, err)
+	c.emit(Event{Type: CallbackFailed, Rank: c.Rank(), Addr: c.extaddr, Err: fmt.Errorf("%s: %v", name, err)})
+}
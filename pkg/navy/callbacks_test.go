@@ -0,0 +1,167 @@
+package navy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failures records the callbacks that a `dispatcher` reports as failed.
+type failures struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (f *failures) record(name string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[string]error)
+	}
+	f.errs[name] = err
+}
+
+func (f *failures) get(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.errs[name]
+}
+
+// closeDispatcher closes `d`, failing the test if its callbacks don't complete.
+func closeDispatcher(t *testing.T, d *dispatcher) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestCallbackOrder(t *testing.T) {
+	d := newDispatcher(func(string, error) {})
+	var mu sync.Mutex
+	var terms []uint64
+	record := callback{name: "record", fn: func(_ context.Context, leader Leader) error {
+		mu.Lock()
+		defer mu.Unlock()
+		terms = append(terms, leader.Term)
+		return nil
+	}}
+
+	// Callbacks queued before the worker starts are run first
+	d.enqueue(record, Leader{Term: 1})
+	d.start()
+	for term := uint64(2); term <= 50; term++ {
+		d.enqueue(record, Leader{Term: term})
+	}
+	closeDispatcher(t, d)
+
+	if len(terms) != 50 {
+		t.Fatalf("[%d] callbacks ran, want [50]", len(terms))
+	}
+	for i, term := range terms {
+		if term != uint64(i+1) {
+			t.Fatalf("callback [%d] ran for term [%d], callbacks ran out of order: %v", i, term, terms)
+		}
+	}
+
+	// A closed dispatcher doesn't accept callbacks
+	d.enqueue(record, Leader{Term: 51})
+	if len(terms) != 50 {
+		t.Error("a callback ran after the dispatcher was closed")
+	}
+}
+
+func TestCallbackTimeout(t *testing.T) {
+	var failed failures
+	d := newDispatcher(failed.record)
+	d.start()
+
+	release := make(chan struct{})
+	defer close(release)
+	ran := make(chan struct{})
+	// One callback respects its context, the other ignores it and is abandoned
+	d.enqueue(callback{name: "slow", timeout: 20 * time.Millisecond, fn: func(ctx context.Context, _ Leader) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}, Leader{})
+	d.enqueue(callback{name: "stuck", timeout: 20 * time.Millisecond, fn: func(context.Context, Leader) error {
+		<-release
+		return nil
+	}}, Leader{})
+	d.enqueue(callback{name: "next", fn: func(context.Context, Leader) error {
+		close(ran)
+		return nil
+	}}, Leader{})
+
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a timed out callback held up the callbacks queued behind it")
+	}
+	for _, name := range []string{"slow", "stuck"} {
+		if err := failed.get(name); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("[%s] failed with [%v], want [%v]", name, err, context.DeadlineExceeded)
+		}
+	}
+	if err := failed.get("next"); err != nil {
+		t.Errorf("[next] failed with [%v]", err)
+	}
+	closeDispatcher(t, d)
+}
+
+func TestCallbackPanic(t *testing.T) {
+	var failed failures
+	d := newDispatcher(failed.record)
+	d.start()
+
+	ran := false
+	d.enqueue(callback{name: "panic", fn: func(context.Context, Leader) error {
+		panic("boom")
+	}}, Leader{})
+	d.enqueue(callback{name: "next", fn: func(context.Context, Leader) error {
+		ran = true
+		return nil
+	}}, Leader{})
+	closeDispatcher(t, d)
+
+	if err := failed.get("panic"); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("panic reported as [%v]", err)
+	}
+	if !ran {
+		t.Error("a panicking callback stopped the callbacks queued behind it")
+	}
+}
+
+func TestCallbacksWithoutStart(t *testing.T) {
+	// A captain that is never started has no worker to wait for
+	c, err := New(WithRank(1), WithCallSign("test"), WithBindAddress("captain-1:7946"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.OnPromotionContext(func(context.Context, Leader) error {
+		t.Error("callback ran without the captain being started")
+		return nil
+	}, 0)
+	c.mu.Lock()
+	c.promote(Leader{Rank: 1, Addr: c.extaddr})
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = c.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	// Nor is one started once the captain has shut down
+	c.dispatcher.start()
+	c.dispatcher.mu.Lock()
+	started := c.dispatcher.started
+	c.dispatcher.mu.Unlock()
+	if started {
+		t.Error("the worker was started after the captain shut down")
+	}
+}
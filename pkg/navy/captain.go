@@ -1,52 +1,206 @@
 package navy
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// NewCaptain returns a new `Captain` or an `error`.
+// New returns a new `Captain` built from the `Option`s, or an `error` if the
+// resulting `Config` is invalid.
 //
-// NOTE: All connections to `Peer`s are established during this function.
-//
-// NOTE: The `proto` value can be one of this list: `tcp`, `tcp4`, `tcp6`.
-func NewCaptain(rank int, bindaddr, extaddr, proto, callsign string, fleet []string, ready, interupt bool, peers map[int]string) *Captain {
+// NOTE: No connections are established by this function, call `Start` to
+// listen and join the fleet.
+func New(opts ...Option) (*Captain, error) {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("new: %v", err)
+	}
+	c := newCaptain(cfg)
+	if err := c.restore(cfg); err != nil {
+		return nil, fmt.Errorf("new: %v", err)
+	}
+	return c, nil
+}
+
+// newCaptain builds a `Captain` from `cfg` without validating it.
+func newCaptain(cfg Config) *Captain {
 	c := &Captain{
-		quit:         make(chan interface{}),
-		rank:         rank,
-		bindaddr:     bindaddr,
-		extaddr:      extaddr,
-		proto:        proto,
-		Ready:        ready,
-		fleet:        fleet,
-		callsign:     callsign,
-		peers:        NewPeerMap(),
-		mu:           &sync.RWMutex{},
-		electionChan: make(chan Message, 1),
-		receiveChan:  make(chan Message),
-		discoverChan: make(chan Message),
-		interupt:     interupt,
+		quit:            make(chan interface{}),
+		conns:           make(map[io.Closer]struct{}),
+		rank:            cfg.Rank,
+		id:              cfg.ID,
+		bindaddr:        cfg.BindAddress,
+		extaddr:         cfg.ExternalAddress,
+		proto:           cfg.Protocol,
+		transport:       cfg.Transport,
+		codec:           cfg.Codec,
+		legacyPeers:     make(map[string]time.Time),
+		peerTypes:       make(map[string]map[int]bool),
+		Ready:           cfg.Ready,
+		fleet:           cfg.Fleet,
+		callsign:        cfg.CallSign,
+		peers:           NewPeerMap(),
+		staticPeers:     cfg.Peers,
+		mu:              &sync.RWMutex{},
+		electionChan:    make(chan Message, 1),
+		receiveChan:     make(chan Message, receiveBuffer),
+		discoverChan:    make(chan Message),
+		interupt:        cfg.Interrupt,
+		maxPayloadSize:  cfg.MaxPayloadSize,
+		callbackTimeout: cfg.CallbackTimeout,
+
+		heartbeatInterval: cfg.HeartbeatInterval,
+		heartbeatMisses:   cfg.HeartbeatMisses,
+
+		leaseDuration: cfg.LeaseDuration,
+		leaseAcks:     make(map[int]time.Time),
+
+		healthCheckInterval: cfg.HealthCheckInterval,
+
+		fleetSize:      cfg.FleetSize,
+		admiralAckChan: make(chan Message, admiralAckBuffer),
+		transferChan:   make(chan Message, 1),
+		healthNow:      make(chan struct{}, 1),
+		incarnation:    time.Now().UnixNano(),
+		remoteControl:  cfg.RemoteControl,
+		controlToken:   cfg.ControlToken,
+	}
+	if len(cfg.Members) != 0 {
+		c.fleetSize = len(cfg.Members)
+		c.members = make(map[int]bool)
+		for _, rank := range cfg.Members {
+			c.members[rank] = true
+		}
+	}
+	if c.heartbeatInterval > 0 && c.heartbeatMisses < 1 {
+		c.heartbeatMisses = defaultHeartbeatMisses
+	}
+	if c.healthCheckInterval == 0 {
+		c.healthCheckInterval = defaultHealthCheckInterval
+	}
+	c.dispatcher = newDispatcher(c.callbackFailed)
+	if c.maxPayloadSize == 0 {
+		c.maxPayloadSize = DefaultMaxPayloadSize
+	}
+	if cfg.Payload != "" {
+		c.internalPayload = []byte(cfg.Payload)
+		c.payloadVersion = 1
+	}
+	if c.codec == nil {
+		c.codec = GobCodec{}
+	}
+	if c.id == "" {
+		c.id = newID()
+	}
+	if len(cfg.Secret) != 0 {
+		c.auth = newAuthenticator(cfg.Secret, c.callsign)
+	}
+
+	// default to the TCP transport
+	if c.transport == nil {
+		c.transport = NewTCPTransport(c.proto)
+	}
+	if cfg.TLS != nil {
+		c.transport = NewTLSTransport(c.transport, cfg.TLS)
 	}
 
 	// if the external address is left blank then default to using the binded address
-	if extaddr == "" {
+	if c.extaddr == "" {
 		c.extaddr = c.bindaddr
 	}
 
+	self := MemberMetadata{Rank: c.rank, Addr: c.extaddr}
+	if len(cfg.Metadata) != 0 {
+		c.metadataVersion = 1
+		self.Version = c.metadataVersion
+		self.Metadata = copyMetadata(cfg.Metadata)
+	}
+	c.metadata = map[int]MemberMetadata{c.rank: self}
+	c.state = make(map[string][]byte)
+
 	return c
 }
 
-func NewCaptainandGo(rank int, bindaddr, extaddr, proto, callsign, payload string, fleet []string, ready, interupt bool, peers map[int]string) (*Captain, error) {
+// NewCaptain returns a new `Captain`.
+//
+// NOTE: The `proto` value can be one of this list: `tcp`, `tcp4`, `tcp6`.
+//
+// Deprecated: use `New`, which validates its configuration.
+func NewCaptain(rank int, bindaddr, extaddr, proto, callsign string, fleet []string, ready, interupt bool, peers map[int]string) *Captain {
+	return newCaptain(Config{
+		Rank:            rank,
+		BindAddress:     bindaddr,
+		ExternalAddress: extaddr,
+		Protocol:        proto,
+		CallSign:        callsign,
+		Fleet:           fleet,
+		Peers:           peers,
+		Ready:           ready,
+		Interrupt:       interupt,
+	})
+}
+
+// NewCaptainandGo returns a new `Captain` that has already joined the fleet,
+// or an `error`. Any `Option`s (such as `WithStateDir`) are applied on top of
+// the arguments.
+//
+// Deprecated: use `New` followed by `Start`.
+func NewCaptainandGo(rank int, bindaddr, extaddr, proto, callsign, payload string, fleet []string, ready, interupt bool, peers map[int]string, opts ...Option) (*Captain, error) {
+	cfg := Config{
+		Rank:            rank,
+		BindAddress:     bindaddr,
+		ExternalAddress: extaddr,
+		Protocol:        proto,
+		CallSign:        callsign,
+		Payload:         payload,
+		Fleet:           fleet,
+		Peers:           peers,
+		Ready:           ready,
+		Interrupt:       interupt,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	c := newCaptain(cfg)
+	if err := c.restore(cfg); err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	c := NewCaptain(rank, bindaddr, extaddr, proto, callsign, fleet, ready, interupt, peers)
-	c.internalPayload = payload
+// Start listens for peers, discovers the fleet (if fleet members were
+// provided, or saved in the state directory) and connects to any hardcoded
+// peers.
+//
+// NOTE: All connections to `Peer`s are established during this function.
+func (c *Captain) Start() error {
 	if err := c.Listen(); err != nil {
-		return nil, fmt.Errorf("new: %v", err)
+		return fmt.Errorf("new: %v", err)
+	}
+
+	// Callbacks queued from here on are run in order on their own worker
+	c.dispatcher.start()
+
+	// Keep saving the fleet as it changes, from the moment we join it
+	if c.stateDir != "" {
+		c.wg.Add(1)
+		go c.persist(c.Events())
 	}
 
 	// enable the interupt handler
@@ -57,118 +211,258 @@ func NewCaptainandGo(rank int, bindaddr, extaddr, proto, callsign, payload strin
 
 	// Do basic discovery on the fleet
 
-	if len(fleet) != 0 {
-		//Discover!
-		readyWatcher := make(chan interface{})
-		go c.DiscoverResponse(readyWatcher)
-		err := c.Discover()
+	if len(c.seeds()) != 0 {
+		err := c.join()
+		if err != nil && (len(c.savedPeers()) == 0 || errors.Is(err, ErrDuplicateRank)) {
+			return err
+		}
 		if err != nil {
-			return nil, fmt.Errorf("discovery failure [%v]", err)
+			// Whoever is left of the saved fleet elects an admiral once we're connected
+			log.Warnf("[STATE] unable to rejoin the fleet, connecting to the saved peers: %v", err)
+			c.Connect(c.savedPeers())
+			c.Ready = true
 		}
-		<-readyWatcher
 	}
 
 	// attempt to connect with hardcoded peers
-	if len(peers) != 0 {
-		c.Connect(proto, peers)
+	if len(c.staticPeers) != 0 {
+		c.Connect(c.staticPeers)
 	}
 
-	return c, nil
-}
-
-func (c *Captain) SetPayload(payload string) {
-	c.internalPayload = payload
+	return nil
 }
 
-func (c *Captain) GetLeaderPayload() string {
-	return c.leaderPayload
+// join discovers the fleet from the seeds and waits until this captain is part
+// of it. A captain with saved peers gives up after `rejoinTimeout`, as they may
+// be restarting too.
+func (c *Captain) join() error {
+	readyWatcher := make(chan interface{})
+	discoverErr := make(chan error, 1)
+	go func() {
+		discoverErr <- c.DiscoverResponse(readyWatcher)
+	}()
+	started := time.Now()
+	err := c.Discover()
+	if err != nil {
+		return fmt.Errorf("discovery failure [%w]", err)
+	}
+	var timeout <-chan time.Time
+	if len(c.savedPeers()) != 0 {
+		timeout = time.After(rejoinTimeout)
+	}
+	select {
+	case <-readyWatcher:
+		c.metrics.discovery.Store(int64(time.Since(started)))
+	case err := <-discoverErr:
+		if err != nil {
+			return fmt.Errorf("discovery failure [%w]", err)
+		}
+	case <-timeout:
+		return fmt.Errorf("discovery failure [no admiral after %s]", rejoinTimeout)
+	case <-c.quit:
+		return fmt.Errorf("discovery failure [captain has shut down]")
+	}
+	return nil
 }
 
+// DemoteOnQuit catches SIGINT/SIGTERM and shuts the captain down, which in
+// turn causes `Run` to return.
+//
+// NOTE: Applications that own their signal handling should leave this disabled
+// and cancel the context passed to `Run` instead.
 func (c *Captain) DemoteOnQuit() {
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-s
-		log.Infoln("[SIGNAL] caught syscall signal, ending")
-		c.Resign()
-		os.Exit(0)
+		defer signal.Stop(s)
+		select {
+		case <-s:
+			log.Infoln("[SIGNAL] caught syscall signal, ending")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := c.Shutdown(ctx); err != nil {
+				log.Error(err)
+			}
+		case <-c.quit:
+		}
 	}()
 }
 
-func (c *Captain) OnPromotion(promotion func(chan interface{})) {
-	c.promoted = promotion
+// SetLeader sets the leader of the fleet if `rank` outranks the current leader,
+// queueing the promotion or demotion function if this captain is affected.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) SetLeader(Addr, payload string, rank int) {
+	var data []byte
+	if payload != "" {
+		data = []byte(payload)
+	}
+	c.setLeader(Addr, rank, "", data, 0, 0)
 }
 
-func (c *Captain) OnDemotion(demotion func(chan interface{})) {
-	c.demoted = demotion
+// follows returns `true` if this captain would accept the captain at `Addr` as
+// its leader, either because there is no leader or because it outranks the
+// current one.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) follows(Addr string, rank int, id string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.leaderAddr == "" || (rank == c.leaderRank && Addr == c.leaderAddr) {
+		return true
+	}
+	return outranks(rank, id, c.leaderRank, c.leaderID)
 }
 
+// setLeader is `SetLeader` with the ID, versioned payload and `term` of the
+// leader (zero when it isn't known), a tie in rank is broken by the ID. It
+// returns `false` if this captain was to be promoted for a term it no longer
+// holds the vote for.
+//
 // NOTE: This function is thread-safe.
-func (c *Captain) SetLeader(Addr, payload string, rank int) {
+func (c *Captain) setLeader(Addr string, rank int, id string, payload []byte, version uint64, term uint64) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	fmt.Printf("rank %d leader %d myrank %d\n", rank, c.leaderRank, c.rank)
+	log.Debugf("[LEADER] rank %d leader %d myrank %d", rank, c.leaderRank, c.rank)
 
-	// If the new leader has a higher rank they become leader
-	if rank > c.leaderRank {
-
-		// are we the current leader (i.e does the current leader, match our rank)
-		// If this is true then we're leading
-		if c.leaderRank <= c.rank {
+	// The same leader may be announced by a captain that didn't know its ID
+	if rank == c.leaderRank && Addr == c.leaderAddr {
+		if id != "" {
+			c.leaderID = id
+		}
+		return true
+	}
 
-			// Is the incoming rank higher, if so we're being demoted
-			if rank > c.rank {
-				if c.demoted != nil {
-					c.leaderPayload = payload
-					exit := make(chan interface{})
-					c.demoted(exit)
-					fmt.Printf("Demotion function complete")
+	self := rank == c.rank && (id == "" || id == c.id)
+	if self && c.fleetSize > 0 && term != 0 && (term <= c.term || c.votedTerm != term || c.votedFor != c.extaddr) {
+		// We gave way to another proposal, or the fleet has moved on, after ours was acknowledged
+		log.Warnf("[QUORUM] not taking term [%d], the vote for it has been given to [%s]", term, c.votedFor)
+		return false
+	}
 
-					<-exit
-				}
-			}
+	// If the new leader outranks the current leader they become leader
+	if outranks(rank, id, c.leaderRank, c.leaderID) {
+		leader := Leader{Rank: rank, Addr: Addr, Payload: string(payload), PayloadVersion: version, Term: term}
 
-			// If the incoming rank is our rank, we're being promoted
-			if rank == c.rank {
-				if c.promoted != nil {
-					c.leaderPayload = payload
-					exit := make(chan interface{})
-					c.promoted(exit)
-					<-exit
-				}
-			}
+		// Does the incoming leader outrank us, if so we're being demoted
+		if !self && outranks(rank, id, c.rank, c.id) {
+			c.demote(leader)
+		}
 
+		// If the incoming leader is us, we're being promoted
+		if self {
+			c.promote(leader)
 		}
 
-		// Set all leader details
+		c.emit(Event{Type: LeaderChanged, Rank: rank, Addr: Addr, OldRank: c.leaderRank, OldAddr: c.leaderAddr, Payload: string(payload), PayloadVersion: version, Term: c.term})
+
+		// Set all leader details, the callbacks are only run once the lock is released
 		c.leaderRank = rank
 		c.leaderAddr = Addr
+		c.leaderID = id
 		c.leaderPayload = payload
+		c.leaderPayloadVersion = version
+		c.leaderTerm = c.term
 	}
-
+	return true
 }
 
+// ResetLeader picks the highest ranked member of the fleet (including this
+// captain) as the leader, after the leader has been lost.
+//
+// NOTE: This function is thread-safe.
 func (c *Captain) ResetLeader(Addr string, rank int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	oldRank, oldAddr := c.leaderRank, c.leaderAddr
 	c.leaderRank = c.rank
 	c.leaderAddr = c.extaddr
-	c.leaderPayload = c.internalPayload
+	c.leaderID = c.id
+	// Unhealthy captains (including this one) aren't fit to lead
+	found := !c.abstaining
 	for _, peer := range c.peers.PeerData() {
-		if peer.Rank > c.leaderRank {
+		if !peer.Ready {
+			continue
+		}
+		if !found || outranks(peer.Rank, peer.ID, c.leaderRank, c.leaderID) {
 			c.leaderRank = peer.Rank
 			c.leaderAddr = peer.Addr
+			c.leaderID = peer.ID
+			found = true
 		}
 
 	}
-	if c.rank == c.leaderRank {
-		if c.promoted != nil {
-			exit := make(chan interface{})
-			c.promoted(exit)
-			<-exit
+	if !found {
+		c.leaderRank = 0
+		c.leaderAddr = ""
+		c.leaderID = ""
+	}
+	// The payload and term of another captain are only known once it announces itself
+	c.leaderPayload = nil
+	c.leaderPayloadVersion = 0
+	c.leaderTerm = 0
+	if c.rank == c.leaderRank && c.extaddr == c.leaderAddr {
+		if c.fleetSize > 0 {
+			// In quorum mode we're leaderless until the election gathers a majority
+			c.leaderRank = 0
+			c.leaderAddr = ""
+			c.leaderID = ""
+		} else {
+			c.leaderPayload = c.internalPayload
+			c.leaderPayloadVersion = c.payloadVersion
+			c.promote(Leader{Rank: c.rank, Addr: c.extaddr, Payload: string(c.internalPayload), PayloadVersion: c.payloadVersion})
+			c.leaderTerm = c.term
 		}
 	}
+	if c.leaderRank != oldRank || c.leaderAddr != oldAddr {
+		c.emit(Event{Type: LeaderChanged, Rank: c.leaderRank, Addr: c.leaderAddr, OldRank: oldRank, OldAddr: oldAddr, Payload: string(c.leaderPayload), PayloadVersion: c.leaderPayloadVersion, Term: c.term})
+	}
+}
+
+// promote marks this captain as the admiral, starting `leader.Term` (or the
+// term after the current one when it is zero) and queueing the promotion
+// function.
+//
+// NOTE: The caller must hold `c.mu`.
+func (c *Captain) promote(leader Leader) {
+	if c.leading {
+		return
+	}
+	c.leading = true
+	c.appointed = false
+	if leader.Term > c.term {
+		c.term = leader.Term
+	} else {
+		c.term++
+	}
+	c.resetLease()
+	leader.Term = c.term
+	c.dispatcher.enqueue(c.promoted, leader)
+}
+
+// demote marks this captain as no longer being the admiral, queueing the
+// demotion function with the new `leader` (if there is one).
+//
+// NOTE: The caller must hold `c.mu`.
+func (c *Captain) demote(leader Leader) {
+	if !c.leading {
+		return
+	}
+	c.leading = false
+	c.appointed = false
+	leader.Term = c.term
+	c.dispatcher.enqueue(c.demoted, leader)
+}
+
+// Rank returns the rank of this captain.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) Rank() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.rank
 }
 
 func (c *Captain) LeaderAddress() string {
@@ -185,8 +479,59 @@ func (c *Captain) LeaderRank() int {
 	return c.leaderRank
 }
 
+// Addr returns the address this captain is listening on, or `nil` if it isn't
+// listening.
+func (c *Captain) Addr() net.Addr {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
+
+// Term returns the current term of the fleet, it increases every time a
+// captain is promoted to admiral and can be used as a fencing token.
+func (c *Captain) Term() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.term
+}
+
+// LeaveFleet informs all peers that this captain is leaving and then shuts it
+// down.
 func (c *Captain) LeaveFleet() {
 	log.Info("[Leave] this captain is leaving from the fleet")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		log.Error(err)
+	}
+}
+
+// Resign stops this captain from processing any more messages, without
+// informing the rest of the fleet.
+func (c *Captain) Resign() {
+	log.Info("[Leave] this captain is resigning from duty")
+	c.stop()
+}
+
+// Shutdown notifies all peers with a `CLOSE`, runs the demotion function if
+// this captain is leading, stops the listener and waits for all of the
+// receiving goroutines to finish. It returns an `error` if `ctx` expires
+// before this has completed.
+//
+// NOTE: This function is safe to call more than once, only the first call
+// performs the shutdown.
+func (c *Captain) Shutdown(ctx context.Context) error {
+	var err error
+	c.shutdownOnce.Do(func() {
+		err = c.shutdown(ctx)
+	})
+	return err
+}
+
+func (c *Captain) shutdown(ctx context.Context) error {
+	log.Info("[SHUTDOWN] this captain is shutting down")
 	for _, peers := range c.peers.PeerData() {
 		err := c.Send(peers.Rank, peers.Addr, CLOSE)
 		if err != nil {
@@ -194,24 +539,46 @@ func (c *Captain) LeaveFleet() {
 		}
 	}
 
-	// if the demotion funcion is set and we're the leader, then call the demotion function
-	if c.demoted != nil && c.rank == c.leaderRank {
-		exit := make(chan interface{})
-		c.demoted(exit)
-		<-exit
-	}
-	close(c.quit)    // Annouce the quit
-	err := c.Close() // Close the networking
-	if err != nil {
+	// if we're the leader, then queue the demotion function (there is no new leader)
+	c.mu.Lock()
+	c.demote(Leader{})
+	c.mu.Unlock()
+
+	// wait for the callbacks (including the demotion) to complete
+	if err := c.dispatcher.close(ctx); err != nil {
 		log.Error(err)
 	}
-	c.wg.Wait() // wait for all work to complete
 
+	c.stop() // Annouce the quit
+	defer c.closeEvents()
+	if c.listener != nil {
+		if err := c.listener.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+	c.closeConns()
+	for _, peer := range c.peers.PeerData() {
+		c.peers.Delete(peer.Rank)
+	}
+
+	// wait for all work to complete
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown: %v", ctx.Err())
+	}
 }
 
-func (c *Captain) Resign() {
-	log.Info("[Leave] this captain is resigning from duty")
-	// Stop processing any more messages
-	close(c.discoverChan)
-	close(c.receiveChan)
+// stop closes the `quit` channel, announcing to every goroutine that this
+// captain is no longer processing messages.
+func (c *Captain) stop() {
+	c.stopOnce.Do(func() {
+		close(c.quit)
+	})
 }
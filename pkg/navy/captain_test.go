@@ -0,0 +1,138 @@
+package navy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunReturnsWhenCancelled(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	c := f.create(1, WithReady(true))
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	events := c.Events()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	waitForLeader(t, 1, c)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatal("Run didn't return once its context was cancelled")
+	}
+
+	// Cancelling the context shut the captain down
+	if _, err := f.transport.Dial(f.addr(1)); err == nil {
+		t.Error("captain is still listening")
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for range events {
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(shutdownTimeout):
+		t.Error("events weren't closed")
+	}
+}
+
+func TestRunReturnsOnShutdown(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	c := f.create(1, WithReady(true))
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+	waitForLeader(t, 1, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatal("Run didn't return once the captain was shut down")
+	}
+}
+
+func TestShutdownWaitsForWork(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	c := f.create(1, WithReady(true))
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// Work that takes a while to finish once the captain quits
+	var finished atomic.Bool
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		<-c.quit
+		time.Sleep(100 * time.Millisecond)
+		finished.Store(true)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if !finished.Load() {
+		t.Error("Shutdown returned before the work was done")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	c := f.create(1, WithReady(true))
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// Work that never finishes holds the shutdown up until its deadline
+	release := make(chan struct{})
+	defer close(release)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		<-release
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err := c.Shutdown(ctx)
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) || err == nil {
+		t.Fatalf("Shutdown = %v, want the deadline to be exceeded", err)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Errorf("Shutdown took [%s] with a deadline of [100ms]", waited)
+	}
+}
@@ -0,0 +1,314 @@
+package navy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ObserverRank is the rank of a `Client`, captains answer it with one-shot
+// messages rather than adding it to the fleet.
+const ObserverRank = -1
+
+// Commands carried by a `CONTROL` message.
+const (
+	CommandLeave    = "leave"    // leave the fleet, as with `LeaveFleet`
+	CommandResign   = "resign"   // stop without telling the fleet, as with `Resign`
+	CommandTransfer = "transfer" // hand leadership to `Target`, as with `TransferLeadership`
+)
+
+// ErrNoAdmiral is returned by a `Client` when the fleet currently has no
+// admiral.
+var ErrNoAdmiral = errors.New("the fleet has no admiral")
+
+// control carries out a `CONTROL` from a `Client`, and tells the client the
+// result with a `CONTROL_ACK` written to `reply`, the connection the command
+// arrived on.
+func (c *Captain) control(msg Message, reply encoder) {
+	if reply == nil {
+		// Only a client speaking the framed protocol can be answered
+		log.Warnf("[CONTROL] ignoring [%s] from [%s], it can't be answered", msg.Command, msg.Addr)
+		return
+	}
+	if !c.remoteControl {
+		log.Warnf("[CONTROL] ignoring [%s] from [%s], remote control is disabled", msg.Command, msg.Addr)
+		c.controlAck(reply, msg, fmt.Errorf("remote control is disabled"))
+		return
+	}
+	if err := c.authorise(msg); err != nil {
+		log.Warnf("[CONTROL] ignoring [%s] from [%s], %v", msg.Command, msg.Addr, err)
+		c.controlAck(reply, msg, err)
+		return
+	}
+
+	log.Infof("[CONTROL] [%s] from [%s]", msg.Command, msg.Addr)
+	switch msg.Command {
+	case CommandLeave:
+		// The client is answered first, as there is nobody to answer it afterwards
+		c.controlAck(reply, msg, nil)
+		go c.LeaveFleet()
+	case CommandResign:
+		c.controlAck(reply, msg, nil)
+		go c.Resign()
+	case CommandTransfer:
+		// A transfer can take a while, and needs the messages that we handle
+		go func() {
+			c.controlAck(reply, msg, c.TransferLeadership(msg.Target))
+		}()
+	default:
+		c.controlAck(reply, msg, fmt.Errorf("unknown command [%s]", msg.Command))
+	}
+}
+
+// authorise returns an `error` unless the client that sent `msg` may operate
+// this captain. With a control token the client must present it, otherwise it
+// must have signed `msg` with the shared secret (which `receive` has already
+// verified). The callsign is sent in the clear, so it is never enough.
+func (c *Captain) authorise(msg Message) error {
+	if msg.CallSign != c.callsign {
+		return fmt.Errorf("callsign [%s] isn't this fleet", msg.CallSign)
+	}
+	if c.controlToken != "" {
+		if subtle.ConstantTimeCompare([]byte(msg.Token), []byte(c.controlToken)) != 1 {
+			return fmt.Errorf("control token is invalid")
+		}
+		return nil
+	}
+	if c.auth == nil {
+		return fmt.Errorf("remote control requires a secret or a control token")
+	}
+	return nil
+}
+
+// controlAck tells the client that sent `msg` the result of its command over
+// `reply`, rather than to whichever address the client claims to be.
+func (c *Captain) controlAck(reply encoder, msg Message, err error) {
+	ack := &Message{Rank: c.Rank(), Addr: c.extaddr, Type: CONTROL_ACK, CallSign: c.callsign, Term: c.Term(), OneShot: true, Command: msg.Command}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	if err = c.encode(reply, ack, msg.Addr); err != nil {
+		log.Errorf("[CONTROL] [%s] %v", msg.Addr, err)
+	}
+}
+
+// oneShot sends `msg` to `addr` on a connection of its own, followed by a
+// `CLOSE`.
+func (c *Captain) oneShot(addr string, msg *Message) error {
+	sock, err := c.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sock.Close()
+	}()
+	encoder := newEncoder(sock)
+
+	if err = c.encode(encoder, msg, addr); err != nil {
+		return fmt.Errorf("oneShot: %v", err)
+	}
+	return c.encode(encoder, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: CLOSE, CallSign: c.callsign, Term: c.Term()}, addr)
+}
+
+// Client queries and operates a fleet from outside of it, for tools such as
+// navyctl. It listens for the replies of captains, but never joins the fleet.
+//
+// NOTE: The captains must be able to connect to the external address of the
+// client, and must have remote control enabled to be operated.
+type Client struct {
+	c  *Captain
+	mu sync.Mutex // one request at a time, as the replies aren't matched to requests
+}
+
+// NewClient returns a `Client` built from the `Option`s, listening on its bind
+// address (a port of 0 picks a free port). Only the callsign, addresses,
+// transport, TLS, secret and codec options apply to a client.
+func NewClient(opts ...Option) (*Client, error) {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.Rank = MinRank
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("NewClient: %v", err)
+	}
+
+	c := newCaptain(cfg)
+	c.rank = ObserverRank
+	if err := c.Listen(); err != nil {
+		return nil, fmt.Errorf("NewClient: %v", err)
+	}
+	if _, port, err := net.SplitHostPort(c.extaddr); err == nil && port == "0" {
+		c.extaddr = c.listener.Addr().String()
+	}
+	return &Client{c: c}, nil
+}
+
+// Address returns the address that captains reply to.
+func (cl *Client) Address() string {
+	return cl.c.extaddr
+}
+
+// Close stops the client listening for replies.
+func (cl *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return cl.c.Shutdown(ctx)
+}
+
+// Admiral asks the captain at `addr` who the admiral of its fleet is, it
+// returns `ErrNoAdmiral` if there isn't one.
+func (cl *Client) Admiral(ctx context.Context, addr string) (Member, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.admiral(ctx, addr)
+}
+
+func (cl *Client) admiral(ctx context.Context, addr string) (Member, error) {
+	if err := cl.c.SendOneShot(addr, WHOISLEADER); err != nil {
+		return Member{}, fmt.Errorf("Admiral: %v", err)
+	}
+	msg, err := cl.reply(ctx, LEADER, UNREADY)
+	if err != nil {
+		return Member{}, fmt.Errorf("Admiral: %w", err)
+	}
+	if msg.Type == UNREADY {
+		return Member{}, fmt.Errorf("Admiral: [%s] %w", addr, ErrNoAdmiral)
+	}
+	return Member{Rank: msg.Rank, Addr: msg.Addr, ID: msg.ID, Ready: true, Leader: true}, nil
+}
+
+// Members asks the admiral of the fleet of the captain at `addr` for every
+// member of the fleet, sorted by rank.
+func (cl *Client) Members(ctx context.Context, addr string) ([]Member, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	admiral, err := cl.admiral(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Members: %w", err)
+	}
+	if err = cl.c.SendOneShot(admiral.Addr, PEERS); err != nil {
+		return nil, fmt.Errorf("Members: %v", err)
+	}
+	msg, err := cl.reply(ctx, PEERLIST)
+	if err != nil {
+		return nil, fmt.Errorf("Members: %w", err)
+	}
+
+	members := []Member{admiral}
+	for _, peer := range msg.Peers {
+		members = append(members, Member{Rank: peer.Rank, Addr: peer.Addr, ID: peer.ID, Ready: peer.Ready})
+	}
+	for i := range members {
+		for _, md := range msg.Metadata {
+			if md.Rank == members[i].Rank && md.Addr == members[i].Addr {
+				members[i].Version = md.Version
+				members[i].Metadata = copyMetadata(md.Metadata)
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Rank < members[j].Rank })
+	return members, nil
+}
+
+// Leave makes the captain at `addr` leave the fleet.
+func (cl *Client) Leave(ctx context.Context, addr string) error {
+	return cl.command(ctx, addr, &Message{Command: CommandLeave})
+}
+
+// Resign makes the captain at `addr` stop, without telling the fleet.
+func (cl *Client) Resign(ctx context.Context, addr string) error {
+	return cl.command(ctx, addr, &Message{Command: CommandResign})
+}
+
+// Transfer makes the captain at `addr`, which must be the admiral, hand its
+// leadership to the captain with `rank`.
+func (cl *Client) Transfer(ctx context.Context, addr string, rank int) error {
+	return cl.command(ctx, addr, &Message{Command: CommandTransfer, Target: rank})
+}
+
+// command sends `msg` as a `CONTROL` to the captain at `addr`, and waits for
+// the result on the same connection.
+func (cl *Client) command(ctx context.Context, addr string, msg *Message) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	c := cl.c
+	msg.Rank, msg.Addr, msg.Type, msg.CallSign, msg.OneShot = ObserverRank, c.extaddr, CONTROL, c.callsign, true
+	msg.Token = c.controlToken
+	sock, err := c.dial(addr)
+	if err != nil {
+		return fmt.Errorf("%s: %v", msg.Command, err)
+	}
+	defer func() {
+		_ = sock.Close()
+	}()
+	encoder := newEncoder(sock)
+	if err = c.encode(encoder, msg, addr); err != nil {
+		return fmt.Errorf("%s: %v", msg.Command, err)
+	}
+
+	// Closing the connection gives up on the reply when `ctx` is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = sock.Close()
+		case <-done:
+		}
+	}()
+	ack, err := cl.controlAck(newDecoder(sock))
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", msg.Command, err)
+	}
+	_ = c.encode(encoder, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: CLOSE, CallSign: c.callsign, Term: c.Term()}, addr)
+	if ack.Error != "" {
+		return fmt.Errorf("%s: [%s] %s", msg.Command, addr, ack.Error)
+	}
+	return nil
+}
+
+// controlAck reads messages from `dec` until the captain answers a command.
+func (cl *Client) controlAck(dec decoder) (Message, error) {
+	for {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			return Message{}, err
+		}
+		if cl.c.authentic(&msg) && msg.Type == CONTROL_ACK {
+			return msg, nil
+		}
+	}
+}
+
+// reply waits until `ctx` is done for a message of one of `types`, any other
+// replies are left over from earlier requests and are dropped.
+func (cl *Client) reply(ctx context.Context, types ...int) (Message, error) {
+	for {
+		select {
+		case msg := <-cl.c.discoverChan:
+			if msg.Type == UNKNOWN {
+				return Message{}, fmt.Errorf("callsign [%s] rejected by [%s]", cl.c.callsign, msg.Addr)
+			}
+			for _, t := range types {
+				if msg.Type == t {
+					return msg, nil
+				}
+			}
+			log.Debugf("[CLIENT] dropping [%s] from [%s]", MessageStrings[msg.Type], msg.Addr)
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package navy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client returns a `Client` of the fleet listening on `addr`, which is closed
+// at the end of the test.
+func (f *testFleet) client(addr string, opts ...Option) *Client {
+	f.t.Helper()
+	opts = append([]Option{
+		WithBindAddress(addr),
+		WithCallSign("test"),
+		WithTransport(f.transport),
+	}, opts...)
+	cl, err := NewClient(opts...)
+	if err != nil {
+		f.t.Fatalf("NewClient: %v", err)
+	}
+	f.t.Cleanup(func() {
+		_ = cl.Close()
+	})
+	return cl
+}
+
+func TestRemoteControlToken(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(2, WithRemoteControl(true), WithControlToken("t0ken"))
+	ctx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancel()
+
+	// The callsign alone isn't enough to operate a captain
+	err := f.client("intruder:7946").Transfer(ctx, f.addr(2), 1)
+	if err == nil || !strings.Contains(err.Error(), "control token is invalid") {
+		t.Fatalf("transfer without the token wasn't refused: %v", err)
+	}
+	err = f.client("guesser:7946", WithControlToken("guess")).Transfer(ctx, f.addr(2), 1)
+	if err == nil || !strings.Contains(err.Error(), "control token is invalid") {
+		t.Fatalf("transfer with the wrong token wasn't refused: %v", err)
+	}
+	if !captains[1].isAdmiral() {
+		t.Fatal("a refused transfer changed the admiral")
+	}
+
+	// The answer comes back on the same connection, not to the claimed address
+	cl := f.client("navyctl:7946", WithControlToken("t0ken"), WithExternalAddress("unreachable:7946"))
+	if err = cl.Transfer(ctx, f.addr(2), 1); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	waitForLeader(t, 1, captains...)
+}
+
+func TestRemoteControlSecret(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(2, WithRemoteControl(true), WithSecret("s3cret"))
+	ctx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancel()
+
+	// A client without the secret isn't even heard, so it never gets an answer
+	short, cancelShort := context.WithTimeout(ctx, time.Second)
+	defer cancelShort()
+	if err := f.client("intruder:7946").Leave(short, f.addr(1)); err == nil {
+		t.Fatal("leave without the secret wasn't refused")
+	}
+
+	if err := f.client("navyctl:7946", WithSecret("s3cret")).Leave(ctx, f.addr(1)); err != nil {
+		t.Fatalf("Leave: %v", err)
+	}
+	eventually(t, settleTimeout, func() bool {
+		return len(captains[1].peers.PeerData()) == 0
+	}, "the captain didn't leave the fleet")
+}
+
+func TestRemoteControlRequiresAuthentication(t *testing.T) {
+	_, err := New(WithRank(1), WithCallSign("test"), WithRemoteControl(true))
+	if err == nil || !strings.Contains(err.Error(), "requires a secret or a control token") {
+		t.Errorf("remote control with only a callsign was allowed: %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package navy
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec IDs, these are sent when a connection is established so they must
+// never change.
+const (
+	GobCodecID      byte = 1
+	JSONCodecID     byte = 2
+	ProtobufCodecID byte = 3
+)
+
+// Codec is an `interface` that encodes a `Message` into a single frame of the
+// wire protocol, and decodes it again.
+//
+// NOTE: This project offers gob (the default, as used by older captains), JSON
+// and protobuf codecs. The protobuf schema is in `message.proto`, so that
+// clients not written in Go can talk to a fleet.
+type Codec interface {
+	ID() byte
+	Name() string
+	Marshal(msg *Message) ([]byte, error)
+	Unmarshal(data []byte, msg *Message) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{}
+)
+
+func init() {
+	RegisterCodec(GobCodec{})
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(ProtobufCodec{})
+}
+
+// RegisterCodec makes `codec` available to connections that ask for it by its
+// ID, replacing any codec already registered with that ID.
+//
+// NOTE: This function is thread-safe.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.ID()] = codec
+}
+
+// lookupCodec returns the registered codec with `id`.
+//
+// NOTE: This function is thread-safe.
+func lookupCodec(id byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[id]
+	return codec, ok
+}
+
+// CodecByName returns the registered codec called `name` (such as `gob`,
+// `json` or `protobuf`), for choosing a codec from configuration.
+//
+// NOTE: This function is thread-safe.
+func CodecByName(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// GobCodec is a `Codec` using `encoding/gob`, each frame is a self-contained
+// gob stream.
+type GobCodec struct{}
+
+func (GobCodec) ID() byte     { return GobCodecID }
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Marshal(msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, msg *Message) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(msg)
+}
+
+// JSONCodec is a `Codec` using `encoding/json`.
+type JSONCodec struct{}
+
+func (JSONCodec) ID() byte     { return JSONCodecID }
+func (JSONCodec) Name() string { return "json" }
+
+func (JSONCodec) Marshal(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (JSONCodec) Unmarshal(data []byte, msg *Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+// Protobuf field numbers of a `Message`, matching `message.proto`.
+const (
+	pbRank      protowire.Number = 1
+	pbAddr      protowire.Number = 2
+	pbType      protowire.Number = 3
+	pbCallSign  protowire.Number = 4
+	pbOneShot   protowire.Number = 5
+	pbPeers     protowire.Number = 6
+	pbPayload   protowire.Number = 7
+	pbTerm      protowire.Number = 8
+	pbTimestamp protowire.Number = 9
+	pbNonce     protowire.Number = 10
+	pbMAC       protowire.Number = 11
+	pbVersion   protowire.Number = 12
+	pbTypes     protowire.Number = 13
+	pbData      protowire.Number = 14
+	pbPayloadV  protowire.Number = 15
+	pbMetadata  protowire.Number = 16
+	pbSeq       protowire.Number = 17
+	pbEntries   protowire.Number = 18
+	pbOldRank   protowire.Number = 19
+	pbTarget    protowire.Number = 20
+	pbID        protowire.Number = 21
+	pbCommand   protowire.Number = 22
+	pbError     protowire.Number = 23
+	pbTo        protowire.Number = 24
+	pbToken     protowire.Number = 25
+
+	pbPeerRank  protowire.Number = 1
+	pbPeerAddr  protowire.Number = 2
+	pbPeerReady protowire.Number = 3
+	pbPeerID    protowire.Number = 4
+
+	pbMetaRank     protowire.Number = 1
+	pbMetaAddr     protowire.Number = 2
+	pbMetaVersion  protowire.Number = 3
+	pbMetaMetadata protowire.Number = 4
+	pbMetaID       protowire.Number = 5
+	pbMetaIncarn   protowire.Number = 6
+
+	pbEntryKey   protowire.Number = 1
+	pbEntryValue protowire.Number = 2
+
+	pbStateKey     protowire.Number = 1
+	pbStateValue   protowire.Number = 2
+	pbStateDeleted protowire.Number = 3
+)
+
+// ProtobufCodec is a `Codec` using the protobuf wire format, as described by
+// `message.proto`.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ID() byte     { return ProtobufCodecID }
+func (ProtobufCodec) Name() string { return "protobuf" }
+
+func (ProtobufCodec) Marshal(msg *Message) ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, pbRank, uint64(msg.Rank))
+	b = appendString(b, pbAddr, msg.Addr)
+	b = appendVarint(b, pbType, uint64(msg.Type))
+	b = appendString(b, pbCallSign, msg.CallSign)
+	if msg.OneShot {
+		b = appendVarint(b, pbOneShot, 1)
+	}
+	for _, peer := range msg.Peers {
+		var p []byte
+		p = appendVarint(p, pbPeerRank, uint64(peer.Rank))
+		p = appendString(p, pbPeerAddr, peer.Addr)
+		if peer.Ready {
+			p = appendVarint(p, pbPeerReady, 1)
+		}
+		p = appendString(p, pbPeerID, peer.ID)
+		b = protowire.AppendTag(b, pbPeers, protowire.BytesType)
+		b = protowire.AppendBytes(b, p)
+	}
+	b = appendString(b, pbPayload, msg.Payload)
+	b = appendVarint(b, pbTerm, msg.Term)
+	b = appendVarint(b, pbTimestamp, uint64(msg.Timestamp))
+	b = appendVarint(b, pbNonce, msg.Nonce)
+	if len(msg.MAC) != 0 {
+		b = protowire.AppendTag(b, pbMAC, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg.MAC)
+	}
+	b = appendVarint(b, pbVersion, uint64(msg.Version))
+	if len(msg.Types) != 0 {
+		var packed []byte
+		for _, t := range msg.Types {
+			packed = protowire.AppendVarint(packed, uint64(t))
+		}
+		b = protowire.AppendTag(b, pbTypes, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	}
+	if msg.Data != nil {
+		b = protowire.AppendTag(b, pbData, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg.Data)
+	}
+	b = appendVarint(b, pbPayloadV, msg.PayloadVersion)
+	for _, md := range msg.Metadata {
+		var m []byte
+		m = appendVarint(m, pbMetaRank, uint64(md.Rank))
+		m = appendString(m, pbMetaAddr, md.Addr)
+		m = appendVarint(m, pbMetaVersion, md.Version)
+		m = appendString(m, pbMetaID, md.ID)
+		m = appendVarint(m, pbMetaIncarn, uint64(md.Incarnation))
+		for k, v := range md.Metadata {
+			var entry []byte
+			entry = appendString(entry, pbEntryKey, k)
+			entry = appendString(entry, pbEntryValue, v)
+			m = protowire.AppendTag(m, pbMetaMetadata, protowire.BytesType)
+			m = protowire.AppendBytes(m, entry)
+		}
+		b = protowire.AppendTag(b, pbMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	b = appendVarint(b, pbSeq, msg.Seq)
+	for _, entry := range msg.Entries {
+		var e []byte
+		e = appendString(e, pbStateKey, entry.Key)
+		if len(entry.Value) != 0 {
+			e = protowire.AppendTag(e, pbStateValue, protowire.BytesType)
+			e = protowire.AppendBytes(e, entry.Value)
+		}
+		if entry.Deleted {
+			e = appendVarint(e, pbStateDeleted, 1)
+		}
+		b = protowire.AppendTag(b, pbEntries, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	b = appendVarint(b, pbOldRank, uint64(msg.OldRank))
+	b = appendVarint(b, pbTarget, uint64(msg.Target))
+	b = appendString(b, pbID, msg.ID)
+	b = appendString(b, pbCommand, msg.Command)
+	b = appendString(b, pbError, msg.Error)
+	b = appendString(b, pbTo, msg.To)
+	b = appendString(b, pbToken, msg.Token)
+	return b, nil
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, msg *Message) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch num {
+		case pbRank:
+			msg.Rank = int(int64(v))
+		case pbAddr:
+			msg.Addr = string(raw)
+		case pbType:
+			msg.Type = int(int64(v))
+		case pbCallSign:
+			msg.CallSign = string(raw)
+		case pbOneShot:
+			msg.OneShot = v != 0
+		case pbPeers:
+			var peer struct {
+				Rank  int
+				Addr  string
+				Ready bool
+				ID    string
+			}
+			err := consumeFields(raw, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+				switch num {
+				case pbPeerRank:
+					peer.Rank = int(int64(v))
+				case pbPeerAddr:
+					peer.Addr = string(raw)
+				case pbPeerReady:
+					peer.Ready = v != 0
+				case pbPeerID:
+					peer.ID = string(raw)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Peers = append(msg.Peers, peer)
+		case pbPayload:
+			msg.Payload = string(raw)
+		case pbTerm:
+			msg.Term = v
+		case pbTimestamp:
+			msg.Timestamp = int64(v)
+		case pbNonce:
+			msg.Nonce = v
+		case pbMAC:
+			msg.MAC = append([]byte(nil), raw...)
+		case pbData:
+			msg.Data = append([]byte{}, raw...)
+		case pbPayloadV:
+			msg.PayloadVersion = v
+		case pbMetadata:
+			md, err := unmarshalMetadata(raw)
+			if err != nil {
+				return err
+			}
+			msg.Metadata = append(msg.Metadata, md)
+		case pbOldRank:
+			msg.OldRank = int(int64(v))
+		case pbTarget:
+			msg.Target = int(int64(v))
+		case pbID:
+			msg.ID = string(raw)
+		case pbCommand:
+			msg.Command = string(raw)
+		case pbError:
+			msg.Error = string(raw)
+		case pbTo:
+			msg.To = string(raw)
+		case pbToken:
+			msg.Token = string(raw)
+		case pbSeq:
+			msg.Seq = v
+		case pbEntries:
+			var entry StateEntry
+			err := consumeFields(raw, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+				switch num {
+				case pbStateKey:
+					entry.Key = string(raw)
+				case pbStateValue:
+					entry.Value = append([]byte(nil), raw...)
+				case pbStateDeleted:
+					entry.Deleted = v != 0
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Entries = append(msg.Entries, entry)
+		case pbVersion:
+			msg.Version = int(int64(v))
+		case pbTypes:
+			// repeated fields may be either packed or one value per field
+			if typ == protowire.VarintType {
+				msg.Types = append(msg.Types, int(int64(v)))
+				break
+			}
+			for len(raw) > 0 {
+				t, n := protowire.ConsumeVarint(raw)
+				if n < 0 {
+					return fmt.Errorf("protobuf: %v", protowire.ParseError(n))
+				}
+				msg.Types = append(msg.Types, int(int64(t)))
+				raw = raw[n:]
+			}
+		}
+		return nil
+	})
+}
+
+// unmarshalMetadata decodes a protobuf `MemberMetadata`.
+func unmarshalMetadata(data []byte) (MemberMetadata, error) {
+	var md MemberMetadata
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch num {
+		case pbMetaRank:
+			md.Rank = int(int64(v))
+		case pbMetaAddr:
+			md.Addr = string(raw)
+		case pbMetaVersion:
+			md.Version = v
+		case pbMetaID:
+			md.ID = string(raw)
+		case pbMetaIncarn:
+			md.Incarnation = int64(v)
+		case pbMetaMetadata:
+			var key, value string
+			err := consumeFields(raw, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+				switch num {
+				case pbEntryKey:
+					key = string(raw)
+				case pbEntryValue:
+					value = string(raw)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if md.Metadata == nil {
+				md.Metadata = make(map[string]string)
+			}
+			md.Metadata[key] = value
+		}
+		return nil
+	})
+	return md, err
+}
+
+// appendVarint appends a varint field, leaving out the default (zero) value.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendString appends a string field, leaving out the default (empty) value.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// consumeFields calls `field` for every varint and length-delimited field in
+// `data`, skipping fields of any other type.
+func consumeFields(data []byte, field func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("protobuf: %v", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		var v uint64
+		var raw []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			raw, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("protobuf: %v", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			if err := field(num, typ, v, raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package navy
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// populatedMessage returns a `Message` with every field set, so that a field
+// that a codec leaves out fails the round trip.
+func populatedMessage() Message {
+	msg := Message{
+		Rank:     3,
+		Addr:     "captain-3:7946",
+		ID:       "4f0c5c1e-8b1a-4c8e-9d3a-2b7f6e5d4c3b",
+		Type:     PEERLIST,
+		CallSign: "fleet",
+		OneShot:  true,
+		Payload:  "payload",
+
+		Data:           []byte{0, 1, 2, 255},
+		PayloadVersion: 7,
+
+		Metadata: []MemberMetadata{
+			{Rank: 1, Addr: "captain-1:7946", Version: 2, Metadata: map[string]string{"zone": "a", "role": "db"}, ID: "0b5a8f3e-6d2c-4e1b-a9f8-7c6d5e4f3a2b", Incarnation: 1700000000000000001},
+			{Rank: 2, Addr: "captain-2:7946", Version: 1, Metadata: map[string]string{"zone": "b"}},
+		},
+		Term: 42,
+
+		Seq: 9,
+		Entries: []StateEntry{
+			{Key: "config", Value: []byte("value")},
+			{Key: "removed", Deleted: true},
+		},
+
+		Timestamp: 1700000000123456789,
+		Nonce:     1<<63 + 5,
+		MAC:       []byte{0xde, 0xad, 0xbe, 0xef},
+		To:        "captain-1:7946",
+
+		OldRank: -1,
+		Target:  2,
+
+		Command: "transfer",
+		Token:   "token",
+		Error:   "refused",
+
+		Version: 1,
+		Types:   []int{ELECTION, OK, ADMIRAL, PROPOSE},
+	}
+	msg.Peers = append(msg.Peers, struct {
+		Rank  int
+		Addr  string
+		Ready bool
+		ID    string
+	}{Rank: 1, Addr: "captain-1:7946", Ready: true, ID: "0b5a8f3e-6d2c-4e1b-a9f8-7c6d5e4f3a2b"})
+	msg.Peers = append(msg.Peers, struct {
+		Rank  int
+		Addr  string
+		Ready bool
+		ID    string
+	}{Rank: 2, Addr: "captain-2:7946"})
+	return msg
+}
+
+// checkPopulated fails the test for any field of `v` (or of the structs within
+// it) that has been left at its zero value.
+func checkPopulated(t *testing.T, v reflect.Value, path string) {
+	t.Helper()
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			checkPopulated(t, v.Field(i), path+"."+v.Type().Field(i).Name)
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			t.Errorf("%s is empty", path)
+		}
+		if v.Type().Elem().Kind() == reflect.Struct {
+			// A field only needs to be set in one of the elements
+			for i := 0; i < v.Type().Elem().NumField(); i++ {
+				set := false
+				for j := 0; j < v.Len(); j++ {
+					set = set || !v.Index(j).Field(i).IsZero()
+				}
+				if !set {
+					t.Errorf("%s.%s isn't set", path, v.Type().Elem().Field(i).Name)
+				}
+			}
+		}
+	default:
+		if v.IsZero() {
+			t.Errorf("%s isn't set", path)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	full := populatedMessage()
+	checkPopulated(t, reflect.ValueOf(full), "Message")
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}, ProtobufCodec{}} {
+		byName, ok := CodecByName(codec.Name())
+		if !ok || byName.ID() != codec.ID() {
+			t.Errorf("%s: isn't registered", codec.Name())
+		}
+		for _, tt := range []struct {
+			name string
+			msg  Message
+		}{
+			{"populated", full},
+			{"minimal", Message{Rank: 1, Addr: "captain-1:7946", Type: HEARTBEAT, CallSign: "fleet"}},
+		} {
+			t.Run(codec.Name()+"/"+tt.name, func(t *testing.T) {
+				in := tt.msg
+				data, err := codec.Marshal(&in)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				var out Message
+				if err = codec.Unmarshal(data, &out); err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				if !reflect.DeepEqual(in, out) {
+					t.Errorf("round trip changed the message\n in: %+v\nout: %+v", in, out)
+				}
+			})
+		}
+	}
+}
+
+func TestProtobufUnknownFields(t *testing.T) {
+	// A newer captain may send fields that this one doesn't know about
+	in := populatedMessage()
+	data, err := ProtobufCodec{}.Marshal(&in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	data = protowire.AppendTag(data, 99, protowire.VarintType)
+	data = protowire.AppendVarint(data, 1)
+	data = protowire.AppendTag(data, 100, protowire.BytesType)
+	data = protowire.AppendString(data, "unknown")
+
+	var out Message
+	if err = (ProtobufCodec{}).Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("unknown fields changed the message\n in: %+v\nout: %+v", in, out)
+	}
+}
@@ -0,0 +1,425 @@
+package navy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Rank boundaries, a rank must sit within this range to be a valid member of
+// the fleet.
+const (
+	MinRank = 0
+	MaxRank = math.MaxInt32
+)
+
+// Config is a `struct` holding everything needed to build a new `Captain`.
+//
+// NOTE: A `Config` can either be populated directly and passed to `New` with
+// `WithConfig`, or built up with the functional `Option`s.
+type Config struct {
+	Rank            int    // the rank of this captain
+	ID              string // optional, the unique ID of this captain (defaults to a random UUID, which changes on every restart)
+	IDFile          string // optional, file the ID is loaded from (or saved to), so it survives a restart
+	StateDir        string // optional, directory the ID, peers, leader and term are saved to for a fast restart
+	BindAddress     string // the address:port to listen on
+	ExternalAddress string // the address:port advertised to peers (defaults to BindAddress)
+	Protocol        string // one of `tcp`, `tcp4`, `tcp6`
+	CallSign        string // the callsign of the fleet
+	Payload         string // optional, the payload to transmit when leading
+	MaxPayloadSize  int    // optional, the largest payload accepted (defaults to `DefaultMaxPayloadSize`)
+
+	Metadata        map[string]string // optional, metadata published to the fleet (zone, version, capacity, labels)
+	Fleet           []string          // addresses of existing fleet members used for discovery
+	Peers           map[int]string    // optional, hardcoded peers (rank -> address)
+	Ready           bool              // start an election straight away
+	Interrupt       bool              // resign when a SIGINT/SIGTERM is caught
+	CallbackTimeout time.Duration     // optional, timeout for `OnPromotion`/`OnDemotion` functions
+
+	HeartbeatInterval time.Duration // optional, how often peers are sent a heartbeat (0 disables heartbeats)
+	HeartbeatMisses   int           // how many heartbeat intervals a peer can miss before it is lost
+
+	LeaseDuration time.Duration // optional, how long the admiral's lease lasts without renewal (0 disables leases)
+
+	HealthCheckInterval time.Duration // optional, how often the function given to `SetHealthCheck` is run (defaults to 1s)
+
+	FleetSize int   // optional, the expected size of the fleet, enables quorum mode
+	Members   []int // optional, the ranks of a static fleet, enables quorum mode
+
+	Transport Transport   // optional, defaults to a `TCPTransport` using `Protocol`
+	TLS       *tls.Config // optional, wraps all connections between captains in TLS
+
+	Secret []byte // optional, shared secret used to authenticate every message
+
+	Codec Codec // optional, the codec used to encode messages (defaults to `GobCodec`)
+
+	RemoteControl bool   // optional, lets a `Client` (such as navyctl) make this captain leave, resign or transfer leadership
+	ControlToken  string // optional, the token a `Client` must present to operate this captain
+}
+
+// Option is a function that modifies a `Config`.
+type Option func(*Config)
+
+// DefaultConfig returns a `Config` with the defaults that `New` starts from.
+func DefaultConfig() Config {
+	return Config{
+		Protocol:        "tcp4",
+		HeartbeatMisses: defaultHeartbeatMisses,
+	}
+}
+
+// WithConfig replaces the whole configuration with `cfg`, any options that
+// follow it will modify `cfg`.
+func WithConfig(cfg Config) Option {
+	return func(c *Config) {
+		*c = cfg
+	}
+}
+
+// WithRank sets the rank of the captain.
+func WithRank(rank int) Option {
+	return func(c *Config) {
+		c.Rank = rank
+	}
+}
+
+// WithID sets the unique ID of the captain, used to break a tie in rank.
+func WithID(id string) Option {
+	return func(c *Config) {
+		c.ID = id
+	}
+}
+
+// WithIDFile keeps the unique ID of the captain in `path`, a new ID is saved
+// there the first time. The fleet recognises a captain with the same ID when
+// it comes back on a new address.
+//
+// NOTE: Without an ID file (or `WithStateDir` or `WithID`) the ID is random
+// and changes on every restart, so a restarted captain is a stranger to the
+// fleet.
+func WithIDFile(path string) Option {
+	return func(c *Config) {
+		c.IDFile = path
+	}
+}
+
+// WithStateDir keeps the ID of the captain, along with the peers, leader and
+// term it last saw, in `dir`. A restarted captain rejoins the fleet from this
+// state when it has no fleet members to discover from, or they can't be
+// reached.
+func WithStateDir(dir string) Option {
+	return func(c *Config) {
+		c.StateDir = dir
+	}
+}
+
+// WithBindAddress sets the address:port the captain listens on.
+func WithBindAddress(addr string) Option {
+	return func(c *Config) {
+		c.BindAddress = addr
+	}
+}
+
+// WithExternalAddress sets the address:port the captain advertises to peers.
+func WithExternalAddress(addr string) Option {
+	return func(c *Config) {
+		c.ExternalAddress = addr
+	}
+}
+
+// WithProtocol sets the network protocol (`tcp`, `tcp4` or `tcp6`).
+func WithProtocol(proto string) Option {
+	return func(c *Config) {
+		c.Protocol = proto
+	}
+}
+
+// WithCallSign sets the callsign of the fleet.
+func WithCallSign(callsign string) Option {
+	return func(c *Config) {
+		c.CallSign = callsign
+	}
+}
+
+// WithPayload sets the payload transmitted by this captain when it leads.
+func WithPayload(payload string) Option {
+	return func(c *Config) {
+		c.Payload = payload
+	}
+}
+
+// WithFleet sets the addresses of existing fleet members used for discovery.
+func WithFleet(members ...string) Option {
+	return func(c *Config) {
+		c.Fleet = members
+	}
+}
+
+// WithPeers sets hardcoded peers (rank -> address) to connect to on start.
+func WithPeers(peers map[int]string) Option {
+	return func(c *Config) {
+		c.Peers = peers
+	}
+}
+
+// WithReady marks the captain as ready, meaning it will start an election.
+func WithReady(ready bool) Option {
+	return func(c *Config) {
+		c.Ready = ready
+	}
+}
+
+// WithInterrupt enables the SIGINT/SIGTERM handler.
+func WithInterrupt(interrupt bool) Option {
+	return func(c *Config) {
+		c.Interrupt = interrupt
+	}
+}
+
+// WithCallbackTimeout sets the timeout applied to the functions passed to
+// `OnPromotion` and `OnDemotion`.
+func WithCallbackTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.CallbackTimeout = timeout
+	}
+}
+
+// WithHeartbeat enables heartbeats, every `interval` each peer is sent a
+// heartbeat and a peer that is silent for `misses` intervals is lost.
+func WithHeartbeat(interval time.Duration, misses int) Option {
+	return func(c *Config) {
+		c.HeartbeatInterval = interval
+		c.HeartbeatMisses = misses
+	}
+}
+
+// WithLease enables leader leases, the admiral must have its lease renewed by
+// a majority of the fleet within `duration` or it will step down.
+//
+// NOTE: Leases require quorum mode (`WithQuorum` or `WithMembers`), so that the
+// majority is based upon the size of the fleet.
+func WithLease(duration time.Duration) Option {
+	return func(c *Config) {
+		c.LeaseDuration = duration
+	}
+}
+
+// WithHealthCheckInterval sets how often the function given to
+// `SetHealthCheck` is run, and how long it has to complete.
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.HealthCheckInterval = interval
+	}
+}
+
+// WithQuorum enables quorum mode for a fleet of `size` captains, a majority
+// must acknowledge an admiral before it is promoted.
+func WithQuorum(size int) Option {
+	return func(c *Config) {
+		c.FleetSize = size
+	}
+}
+
+// WithMembers enables quorum mode for a static fleet made up of the captains
+// with `ranks`, only these captains count towards a majority.
+func WithMembers(ranks ...int) Option {
+	return func(c *Config) {
+		c.Members = ranks
+	}
+}
+
+// WithTransport sets the `Transport` used for all connections between
+// captains.
+func WithTransport(t Transport) Option {
+	return func(c *Config) {
+		c.Transport = t
+	}
+}
+
+// WithTLS wraps all connections between captains in TLS using `cfg`, see
+// `LoadTLSConfig` for building one from certificate files.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Config) {
+		c.TLS = cfg
+	}
+}
+
+// WithSecret enables authenticated messages, every message is signed with a
+// key derived from `secret` and the callsign, and messages that fail
+// verification are dropped.
+func WithSecret(secret string) Option {
+	return func(c *Config) {
+		c.Secret = []byte(secret)
+	}
+}
+
+// WithCodec sets the `Codec` used to encode the messages this captain sends,
+// messages are decoded with whichever codec the sending captain chose.
+func WithCodec(codec Codec) Option {
+	return func(c *Config) {
+		c.Codec = codec
+	}
+}
+
+// WithMaxPayloadSize sets the largest payload that this captain will send or
+// accept from the admiral.
+func WithMaxPayloadSize(size int) Option {
+	return func(c *Config) {
+		c.MaxPayloadSize = size
+	}
+}
+
+// WithRemoteControl lets a `Client` (such as navyctl) make this captain leave
+// the fleet, resign or transfer its leadership. It requires a shared secret
+// (`WithSecret`) or a control token (`WithControlToken`), so that only clients
+// that know one of them are obeyed.
+func WithRemoteControl(enabled bool) Option {
+	return func(c *Config) {
+		c.RemoteControl = enabled
+	}
+}
+
+// WithControlToken sets the token that a `Client` must present to operate a
+// captain with remote control enabled, and that a `Client` presents to the
+// captains it operates.
+//
+// NOTE: The token is sent as it is, so it should be paired with TLS when the
+// fleet has no shared secret.
+func WithControlToken(token string) Option {
+	return func(c *Config) {
+		c.ControlToken = token
+	}
+}
+
+// WithMetadata sets the metadata this captain publishes to the fleet, it can be
+// changed later with `Captain.SetMetadata`.
+func WithMetadata(metadata map[string]string) Option {
+	return func(c *Config) {
+		c.Metadata = metadata
+	}
+}
+
+// Validate checks the `Config` and returns a descriptive `error` for the first
+// problem found.
+func (cfg *Config) Validate() error {
+	if cfg.Rank < MinRank || cfg.Rank > MaxRank {
+		return fmt.Errorf("rank [%d] must be between %d and %d", cfg.Rank, MinRank, MaxRank)
+	}
+	switch cfg.Protocol {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("protocol [%s] must be one of tcp, tcp4 or tcp6", cfg.Protocol)
+	}
+	if cfg.CallbackTimeout < 0 {
+		return fmt.Errorf("callback timeout [%s] must not be negative", cfg.CallbackTimeout)
+	}
+	if cfg.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat interval [%s] must not be negative", cfg.HeartbeatInterval)
+	}
+	if cfg.HeartbeatInterval > 0 && cfg.HeartbeatMisses < 1 {
+		return fmt.Errorf("heartbeat misses [%d] must be at least 1", cfg.HeartbeatMisses)
+	}
+	if cfg.HealthCheckInterval < 0 {
+		return fmt.Errorf("health check interval [%s] must not be negative", cfg.HealthCheckInterval)
+	}
+	if cfg.LeaseDuration < 0 {
+		return fmt.Errorf("lease duration [%s] must not be negative", cfg.LeaseDuration)
+	}
+	if cfg.LeaseDuration > 0 {
+		// Without a known fleet size the majority shrinks along with the peers, so
+		// an admiral cut off from the fleet would keep renewing its own lease
+		if cfg.FleetSize == 0 && len(cfg.Members) == 0 {
+			return fmt.Errorf("leases require quorum mode (a fleet size or members)")
+		}
+		if cfg.LeaseDuration < minLeaseDuration {
+			return fmt.Errorf("lease duration [%s] must be at least %s", cfg.LeaseDuration, minLeaseDuration)
+		}
+		if cfg.HeartbeatInterval > 0 && cfg.LeaseDuration < 3*cfg.HeartbeatInterval {
+			return fmt.Errorf("lease duration [%s] must be at least three heartbeat intervals [%s]", cfg.LeaseDuration, 3*cfg.HeartbeatInterval)
+		}
+	}
+	if cfg.RemoteControl && len(cfg.Secret) == 0 && cfg.ControlToken == "" {
+		// The callsign is sent in the clear, so it can't keep anyone out
+		return fmt.Errorf("remote control requires a secret or a control token")
+	}
+	if cfg.MaxPayloadSize < 0 {
+		return fmt.Errorf("max payload size [%d] must not be negative", cfg.MaxPayloadSize)
+	}
+	maxPayload := cfg.MaxPayloadSize
+	if maxPayload == 0 {
+		maxPayload = DefaultMaxPayloadSize
+	}
+	if len(cfg.Payload) > maxPayload {
+		return fmt.Errorf("payload [%d] bytes exceeds the max payload size [%d]", len(cfg.Payload), maxPayload)
+	}
+	if cfg.FleetSize < 0 {
+		return fmt.Errorf("fleet size [%d] must not be negative", cfg.FleetSize)
+	}
+	if len(cfg.Members) != 0 {
+		if cfg.FleetSize != 0 && cfg.FleetSize != len(cfg.Members) {
+			return fmt.Errorf("fleet size [%d] doesn't match the [%d] members", cfg.FleetSize, len(cfg.Members))
+		}
+		found := false
+		for _, rank := range cfg.Members {
+			if rank == cfg.Rank {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("rank [%d] must be one of the members %v", cfg.Rank, cfg.Members)
+		}
+	}
+	if cfg.TLS != nil && len(cfg.TLS.Certificates) == 0 && cfg.TLS.GetCertificate == nil {
+		return fmt.Errorf("tls requires a certificate")
+	}
+	if cfg.CallSign == "" {
+		return fmt.Errorf("callsign must not be empty")
+	}
+	if cfg.BindAddress == "" {
+		return fmt.Errorf("bind address must not be empty")
+	}
+	// In-memory addresses are only names, so there is no format to check
+	validateAddress := validateAddress
+	if _, ok := cfg.Transport.(*MemoryTransport); ok {
+		validateAddress = func(string) error { return nil }
+	}
+	if err := validateAddress(cfg.BindAddress); err != nil {
+		return fmt.Errorf("bind address: %v", err)
+	}
+	if cfg.ExternalAddress != "" {
+		if err := validateAddress(cfg.ExternalAddress); err != nil {
+			return fmt.Errorf("external address: %v", err)
+		}
+	}
+	for x := range cfg.Fleet {
+		if err := validateAddress(cfg.Fleet[x]); err != nil {
+			return fmt.Errorf("fleet member: %v", err)
+		}
+	}
+	for rank, addr := range cfg.Peers {
+		if rank < MinRank || rank > MaxRank {
+			return fmt.Errorf("peer rank [%d] must be between %d and %d", rank, MinRank, MaxRank)
+		}
+		if err := validateAddress(addr); err != nil {
+			return fmt.Errorf("peer [%d]: %v", rank, err)
+		}
+	}
+	return nil
+}
+
+// validateAddress ensures that `addr` is in the form host:port with a valid
+// port number.
+func validateAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("[%s] %v", addr, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("[%s] invalid port [%s]", addr, port)
+	}
+	return nil
+}
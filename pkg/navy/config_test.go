@@ -0,0 +1,66 @@
+package navy
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		err    string // a substring of the error, empty when the config is valid
+	}{
+		{name: "valid", modify: func(cfg *Config) {}},
+		{name: "negative rank", modify: func(cfg *Config) { cfg.Rank = -1 }, err: "rank [-1] must be between"},
+		{name: "bad protocol", modify: func(cfg *Config) { cfg.Protocol = "udp" }, err: "protocol [udp] must be one of"},
+		{name: "negative callback timeout", modify: func(cfg *Config) { cfg.CallbackTimeout = -time.Second }, err: "callback timeout [-1s] must not be negative"},
+		{name: "negative heartbeat interval", modify: func(cfg *Config) { cfg.HeartbeatInterval = -time.Second }, err: "heartbeat interval [-1s] must not be negative"},
+		{name: "no heartbeat misses", modify: func(cfg *Config) { cfg.HeartbeatInterval, cfg.HeartbeatMisses = time.Second, 0 }, err: "heartbeat misses [0] must be at least 1"},
+		{name: "negative health check interval", modify: func(cfg *Config) { cfg.HealthCheckInterval = -time.Second }, err: "health check interval [-1s] must not be negative"},
+		{name: "negative lease", modify: func(cfg *Config) { cfg.LeaseDuration = -time.Second }, err: "lease duration [-1s] must not be negative"},
+		{name: "zero lease", modify: func(cfg *Config) { cfg.LeaseDuration = 0 }},
+		{name: "lease without quorum", modify: func(cfg *Config) { cfg.LeaseDuration = time.Second }, err: "leases require quorum mode"},
+		{name: "short lease", modify: func(cfg *Config) { cfg.LeaseDuration, cfg.FleetSize = time.Millisecond, 3 }, err: "lease duration [1ms] must be at least"},
+		{name: "lease within heartbeats", modify: func(cfg *Config) {
+			cfg.LeaseDuration, cfg.FleetSize, cfg.HeartbeatInterval = time.Second, 3, time.Second
+		}, err: "must be at least three heartbeat intervals"},
+		{name: "remote control without a secret", modify: func(cfg *Config) { cfg.RemoteControl = true }, err: "remote control requires a secret or a control token"},
+		{name: "remote control with a token", modify: func(cfg *Config) { cfg.RemoteControl, cfg.ControlToken = true, "token" }},
+		{name: "negative max payload", modify: func(cfg *Config) { cfg.MaxPayloadSize = -1 }, err: "max payload size [-1] must not be negative"},
+		{name: "payload too large", modify: func(cfg *Config) { cfg.MaxPayloadSize, cfg.Payload = 4, "payload" }, err: "payload [7] bytes exceeds the max payload size [4]"},
+		{name: "negative fleet size", modify: func(cfg *Config) { cfg.FleetSize = -1 }, err: "fleet size [-1] must not be negative"},
+		{name: "fleet size and members disagree", modify: func(cfg *Config) { cfg.FleetSize, cfg.Members = 2, []int{1, 2, 3} }, err: "fleet size [2] doesn't match the [3] members"},
+		{name: "rank not a member", modify: func(cfg *Config) { cfg.Members = []int{2, 3} }, err: "rank [1] must be one of the members"},
+		{name: "tls without a certificate", modify: func(cfg *Config) { cfg.TLS = &tls.Config{} }, err: "tls requires a certificate"},
+		{name: "empty callsign", modify: func(cfg *Config) { cfg.CallSign = "" }, err: "callsign must not be empty"},
+		{name: "empty bind address", modify: func(cfg *Config) { cfg.BindAddress = "" }, err: "bind address must not be empty"},
+		{name: "bad bind address", modify: func(cfg *Config) { cfg.BindAddress = "captain-1" }, err: "bind address: [captain-1]"},
+		{name: "bad bind port", modify: func(cfg *Config) { cfg.BindAddress = "captain-1:99999" }, err: "bind address: [captain-1:99999] invalid port"},
+		{name: "ipv6 bind address", modify: func(cfg *Config) { cfg.BindAddress = "[::1]:7946" }},
+		{name: "bad external address", modify: func(cfg *Config) { cfg.ExternalAddress = "::1:7946" }, err: "external address: [::1:7946]"},
+		{name: "bad fleet member", modify: func(cfg *Config) { cfg.Fleet = []string{"captain-2:port"} }, err: "fleet member: [captain-2:port] invalid port"},
+		{name: "negative peer rank", modify: func(cfg *Config) { cfg.Peers = map[int]string{-2: "captain-2:7946"} }, err: "peer rank [-2] must be between"},
+		{name: "bad peer address", modify: func(cfg *Config) { cfg.Peers = map[int]string{2: "captain-2"} }, err: "peer [2]: [captain-2]"},
+		{name: "memory address", modify: func(cfg *Config) { cfg.Transport, cfg.BindAddress = NewMemoryTransport(), "captain-1" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Rank, cfg.CallSign, cfg.BindAddress = 1, "test", "captain-1:7946"
+			test.modify(&cfg)
+
+			err := cfg.Validate()
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case test.err != "" && err == nil:
+				t.Errorf("Validate succeeded, want an error containing [%s]", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("Validate: %v, want an error containing [%s]", err, test.err)
+			}
+		})
+	}
+}
@@ -15,7 +15,7 @@ type Backoff struct {
 
 // Discover will discover the cluster
 func (c *Captain) Discover() error {
-	if len(c.fleet) == 0 {
+	if len(c.seeds()) == 0 {
 		return fmt.Errorf("[Discover] No Fleet address")
 	}
 	err := c.discover()
@@ -26,7 +26,7 @@ func (c *Captain) Discover() error {
 }
 
 func (c *Captain) DiscoverWithBackoff(b Backoff) error {
-	if len(c.fleet) == 0 {
+	if len(c.seeds()) == 0 {
 		return fmt.Errorf("[Discover] No Fleet address")
 	}
 	return RetryWithBackoff(b, c.discover)
@@ -51,9 +51,9 @@ func RetryWithBackoff(b Backoff, retryFunc func() error) error {
 }
 
 func (c *Captain) discover() (err error) {
-	for member := range c.fleet {
+	for _, seed := range c.seeds() {
 		// Ask the seed, who is the current leader
-		err = c.SendOneShot(c.fleet[member], WHOISLEADER)
+		err = c.SendOneShot(seed, WHOISLEADER)
 		if err == nil {
 			return err
 		}
@@ -62,13 +62,20 @@ func (c *Captain) discover() (err error) {
 }
 
 func (c *Captain) DiscoverResponse(ready chan interface{}) error {
-	for msg := range c.discoverChan {
+	for {
+		var msg Message
+		select {
+		case msg = <-c.discoverChan:
+		case <-c.quit:
+			return nil
+		}
 
 		switch msg.Type {
 		case LEADER:
 			// We've recieved the leader
 			log.Infof("[LEADER] being updated to [%s %d]", msg.Addr, msg.Rank)
-			c.SetLeader(msg.Addr, msg.Payload, msg.Rank)
+			c.acceptTerm(msg.Term, msg.Rank, msg.Addr)
+			c.setLeader(msg.Addr, msg.Rank, msg.ID, msg.payload(), msg.PayloadVersion, msg.Term)
 
 			//Ask the leader for all the peers
 			err := c.SendOneShot(msg.Addr, PEERS)
@@ -80,20 +87,23 @@ func (c *Captain) DiscoverResponse(ready chan interface{}) error {
 			// We should recieve the peer list for the current leader
 			log.Infof("[PEERLIST] from [%s %d]", msg.Addr, msg.Rank)
 			// Add the leader as a peer
-			err := c.connect(c.proto, msg.Addr, msg.Rank)
+			err := c.connect(msg.Addr, msg.Rank, msg.ID)
 			if err != nil {
 				return err
 			}
+			c.peers.Identify(msg.Rank, msg.Addr, msg.ID)
 			if c.LeaderRank() != msg.Rank {
 				log.Errorf("Ignoring peers from [%s]", msg.Addr)
 			} else {
+				c.mergeMetadata(msg.Metadata)
 				for x := range msg.Peers {
 					// Stop loopback connections
-					if msg.Peers[x].Addr != c.extaddr && msg.Peers[x].Rank != c.rank {
-						err := c.connect(c.proto, msg.Peers[x].Addr, msg.Peers[x].Rank)
+					if msg.Peers[x].Addr != c.extaddr && msg.Peers[x].Rank != c.Rank() {
+						err := c.connect(msg.Peers[x].Addr, msg.Peers[x].Rank, msg.Peers[x].ID)
 						if err != nil {
 							return err
 						}
+						c.peers.Identify(msg.Peers[x].Rank, msg.Peers[x].Addr, msg.Peers[x].ID)
 						err = c.Send(msg.Peers[x].Rank, msg.Peers[x].Addr, READY)
 						if err != nil {
 							log.Error(err)
@@ -102,6 +112,7 @@ func (c *Captain) DiscoverResponse(ready chan interface{}) error {
 				}
 				log.Debugf("[PEERS] %v", c.peers.PeerData())
 				c.Ready = true
+				c.emit(Event{Type: DiscoveryCompleted, Rank: msg.Rank, Addr: msg.Addr})
 				close(ready)
 				//c.Elect()
 				return nil
@@ -109,8 +120,17 @@ func (c *Captain) DiscoverResponse(ready chan interface{}) error {
 		case UNREADY:
 			log.Warnf("[UNREADY] no leader currently exists in the cluster from [%s]", msg.Addr)
 		case UNKNOWN:
-			log.Fatalf("[UNKNOWN] this peer has the wrong callsign for the fleet from [%s %d]", msg.Addr, msg.Rank)
+			log.Errorf("[UNKNOWN] this peer has the wrong callsign for the fleet from [%s %d]", msg.Addr, msg.Rank)
+			c.emit(Event{Type: CallsignRejected, Rank: c.Rank(), Addr: c.extaddr})
+			return fmt.Errorf("[Discover] callsign [%s] rejected by [%s]", c.callsign, msg.Addr)
+		case DUPLICATE:
+			owner := ""
+			if len(msg.Peers) != 0 {
+				owner = msg.Peers[0].Addr
+			}
+			log.Errorf("[DUPLICATE] rank [%d] already belongs to [%s], according to [%s %d]", c.Rank(), owner, msg.Addr, msg.Rank)
+			c.emit(Event{Type: RankRejected, Rank: c.Rank(), Addr: owner})
+			return fmt.Errorf("[Discover] %w, rank [%d] belongs to [%s]", ErrDuplicateRank, c.Rank(), owner)
 		}
 	}
-	return nil
 }
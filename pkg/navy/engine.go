@@ -1,6 +1,9 @@
 package navy
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -10,17 +13,31 @@ import (
 
 const maxRetries = 5
 
+// shutdownTimeout is how long a shutdown that wasn't given a deadline (i.e.
+// from a signal or a cancelled `Run`) waits for the fleet connections to close.
+const shutdownTimeout = 5 * time.Second
+
+// receiveBuffer is the number of messages that can be queued for the `Run`
+// loop, so that an `OK` isn't held up behind messages that arrived while an
+// election is waiting for it.
+const receiveBuffer = 64
+
 // Captain is a `struct` representing a single node used by the `Bully Algorithm`.
 //
 // NOTE: More details about the `Bully algorithm` can be found here
 // https://en.wikipedia.org/wiki/Bully_algorithm .
 type Captain struct {
 	// handle the networking
-	*net.TCPListener
+	transport Transport
+	listener  net.Listener
 
 	// handle all of the closing of connections
-	quit chan interface{}
-	wg   sync.WaitGroup
+	quit         chan interface{}
+	wg           sync.WaitGroup
+	stopOnce     sync.Once
+	shutdownOnce sync.Once
+	connMu       sync.Mutex
+	conns        map[io.Closer]struct{}
 
 	// cluster confoguration
 	rank         int
@@ -29,28 +46,111 @@ type Captain struct {
 	proto        string
 	leaderAddr   string
 	leaderRank   int
+	leaderID     string
+	id           string
+	idPersisted  bool // the ID is set or saved, so it survives a restart
 	Ready        bool
 	fleet        []string
 	callsign     string
 	peers        Peers
+	staticPeers  map[int]string
 	mu           *sync.RWMutex
 	receiveChan  chan Message
 	discoverChan chan Message
 	electionChan chan Message
-	promoted     func(chan interface{})
-	demoted      func(chan interface{})
+	promoted     callback
+	demoted      callback
+
+	callbackTimeout time.Duration // the timeout for the legacy promotion/demotion functions
+	dispatcher      *dispatcher   // executes the promotion/demotion functions in order
 
 	interupt bool
 
-	internalPayload string // optional, contains our local payload to transmit
-	leaderPayload   string // optional, contains the payload of the current leader
+	events events // subscribers to the `Event`s of this captain
+
+	heartbeatInterval time.Duration // how often peers are sent a heartbeat
+	heartbeatMisses   int           // how many intervals a peer can miss before it is lost
+	lostMu            sync.Mutex    // serialises the removal of lost peers
+
+	leading       bool              // this captain is the admiral (guarded by `mu`)
+	appointed     bool              // this captain was made admiral by a transfer, so it holds on to leadership in elections (guarded by `mu`)
+	term          uint64            // the highest term seen by this captain (guarded by `mu`)
+	leaseDuration time.Duration     // how long the admiral's lease lasts
+	leaseMu       sync.Mutex        // guards the lease state
+	leaseAcks     map[int]time.Time // when each peer last renewed the lease
+	leaseExpiry   time.Time         // when the current lease runs out
+	leaseHeld     bool              // a majority has renewed the lease for the current term
+
+	healthCheck         func(ctx context.Context) error // optional, decides if this captain is fit to lead (guarded by `mu`)
+	healthCheckInterval time.Duration                   // how often the health check is run
+	abstaining          bool                            // the last health check failed, so this captain won't stand for election (guarded by `mu`)
+	healthNow           chan struct{}                   // asks for the health check to be run straight away
+
+	auth *authenticator // signs and verifies messages, nil without a shared secret
+
+	codec       Codec                // the codec used for messages sent by this captain
+	legacyMu    sync.Mutex           // protects legacyPeers
+	legacyPeers map[string]time.Time // addresses of peers that didn't send a greeting, and when they last didn't
+
+	transferMu   sync.Mutex   // serialises leadership transfers
+	transferChan chan Message // acknowledgements of a leadership transfer
+
+	metaMu          sync.RWMutex
+	metadata        map[int]MemberMetadata // metadata published by each captain (by rank), including ourselves
+	metadataVersion uint64                 // incremented every time our metadata changes
+	incarnation     int64                  // when this captain started (unix nanoseconds), published with its metadata
+
+	stateMu      sync.RWMutex
+	stateWriteMu sync.Mutex        // serialises writes by the admiral, so updates are sent in order
+	state        map[string][]byte // the state replicated from the admiral
+	stateSeq     uint64            // the sequence number of the last change to the state
+	stateRank    int               // the rank of the admiral the state came from
+	stateAddr    string            // the address of the admiral the state came from
+
+	stateDir string     // the directory the fleet is saved to, empty when it isn't saved
+	savedMu  sync.Mutex // serialises saving the fleet
+	saved    savedFleet // the fleet as last saved (or restored)
+
+	typesMu   sync.RWMutex
+	peerTypes map[string]map[int]bool // message types supported by each peer (by address), learned from `HELLO`
+
+	fleetSize      int          // the expected size of the fleet (0 disables quorum mode)
+	members        map[int]bool // optional, the ranks of a static fleet
+	admiralAckChan chan Message // acknowledgements of our admiral proposals
+	votedTerm      uint64       // the highest term a proposal has been acknowledged (or made) for, protected by `mu`
+	votedFor       string       // the address of the captain acknowledged for `votedTerm`, protected by `mu`
+
+	internalPayload      []byte // optional, contains our local payload to transmit
+	payloadVersion       uint64 // incremented every time our payload changes
+	leaderPayload        []byte // optional, contains the payload of the current leader
+	leaderPayloadVersion uint64 // the version of the payload of the current leader
+	leaderTerm           uint64 // the term the current leader announced itself for, zero if it hasn't
+	maxPayloadSize       int    // the largest payload that is accepted
+
+	remoteControl bool   // a `Client` may make this captain leave, resign or transfer leadership
+	controlToken  string // the token a `Client` presents, to operate this captain or the captains it operates
+
+	metrics metrics // counters exposed by `Collector`
 }
 
 // Elect handles the leader election mechanism of the `Bully algorithm`.
 func (c *Captain) Elect() {
-	log.Debugf("[ELECTION] Current Rank %d, Peers: %v", c.rank, c.peers.PeerData())
+	// An unhealthy captain leaves the election to its peers
+	if !c.Healthy() {
+		log.Infof("[ELECTION] abstaining, this captain is unhealthy")
+		return
+	}
+	log.Debugf("[ELECTION] Current Rank %d, Peers: %v", c.Rank(), c.peers.PeerData())
+	next := c.nextTerm()
+	c.emit(Event{Type: ElectionStarted, Rank: c.Rank(), Addr: c.extaddr})
+
+	// Throw away any OK left over from a previous election
+	select {
+	case <-c.electionChan:
+	default:
+	}
 	for _, peers := range c.peers.PeerData() {
-		//if peers.Rank > c.rank {
+		//if peers.Rank > c.Rank() {
 		err := c.Send(peers.Rank, peers.Addr, ELECTION)
 		if err != nil {
 			log.Error(err)
@@ -61,29 +161,68 @@ func (c *Captain) Elect() {
 	select {
 	case <-c.electionChan:
 		return
+	case <-c.quit:
+		return
 	case <-time.After(time.Second):
-		// Timer for election has expired
-		c.SetLeader(c.extaddr, c.internalPayload, c.rank)
+		// The health check may have started failing during the election
+		if !c.Healthy() {
+			log.Infof("[ELECTION] not announcing, this captain is unhealthy")
+			return
+		}
+		// Timer for election has expired, in quorum mode a majority has to agree
+		// to the term before this captain takes it
+		term := uint64(0)
+		if c.fleetSize > 0 {
+			if !c.propose(next) {
+				return
+			}
+			term = next
+		}
+		payload, version := c.Payload()
+		if !c.setLeader(c.extaddr, c.Rank(), c.id, payload, version, term) {
+			return
+		}
+		c.emit(Event{Type: ElectionWon, Rank: c.Rank(), Addr: c.extaddr})
 		for _, peers := range c.peers.PeerData() {
 			log.Infof("[ELECTION] leader [%s], informing [%s]", c.extaddr, peers.Addr)
 			err := c.Send(peers.Rank, peers.Addr, ADMIRAL)
 			if err != nil {
 				log.Error(err)
 			}
+			// The fleet takes on the state of the new admiral
+			err = c.Send(peers.Rank, peers.Addr, STATE_SNAPSHOT)
+			if err != nil {
+				log.Error(err)
+			}
 		}
 		return
 	}
 }
 
-// Run launches the two main goroutine. The first one is tied to the
-// execution of `workFunc` while the other one is the `Bully algorithm`.
-//
-// NOTE: This function is an infinite loop.
-func (c *Captain) Run(workFunc func()) error {
-	// Additional callback if needed
-	if workFunc != nil {
-		go workFunc()
+// Run starts the `Bully algorithm`, processing messages from the fleet until
+// `ctx` is cancelled or the captain is shut down. When `ctx` is cancelled the
+// captain is shut down before `Run` returns.
+func (c *Captain) Run(ctx context.Context) error {
+	// A captain that was joined to the fleet without `Start` runs its callbacks
+	// from here
+	c.dispatcher.start()
+
+	// Start checking that our peers are still alive
+	if c.heartbeatInterval > 0 {
+		c.wg.Add(1)
+		go c.heartbeat()
 	}
+
+	// Keep renewing our lease while we're the admiral
+	if c.leaseDuration > 0 {
+		c.wg.Add(1)
+		go c.lease()
+	}
+
+	// Keep checking that we're fit to lead
+	c.wg.Add(1)
+	go c.health()
+
 	// If this node is ready and has no other peers then run the election process
 	// This effectively makes this node the leader
 	if c.Ready {
@@ -93,7 +232,7 @@ func (c *Captain) Run(workFunc func()) error {
 	// If this node isn't marked as ready, but has some peers then ask thos peers who is the leader
 	if !c.Ready && len(c.peers.PeerData()) != 0 {
 		for _, peer := range c.peers.PeerData() {
-			if peer.Rank > c.rank || peer.Rank == 0 {
+			if peer.Rank > c.Rank() || peer.Rank == 0 {
 				err := c.Send(peer.Rank, peer.Addr, WHOISLEADER)
 				if err != nil {
 					log.Error(err)
@@ -102,60 +241,175 @@ func (c *Captain) Run(workFunc func()) error {
 		}
 	}
 
-	for msg := range c.receiveChan {
-		// format, _ := json.MarshalIndent(msg, "", "   ")
-		// log.Debugf("%s", format)
-		switch msg.Type {
-		case ELECTION:
-			if c.Ready {
-				if msg.Rank < c.rank {
-					log.Warnf("[ELECTION] new election [%s %d]", msg.Addr, msg.Rank)
-					err := c.Send(msg.Rank, msg.Addr, OK)
-					if err != nil {
-						log.Error(err)
-					}
-					c.Elect()
-				}
+	for {
+		select {
+		case <-ctx.Done():
+			sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return c.Shutdown(sctx)
+		case <-c.quit:
+			return nil
+		case msg := <-c.receiveChan:
+			// A message that can't be handled shouldn't take the captain down
+			if err := c.handle(msg); err != nil {
+				log.Errorf("[%s] from [%s %d] %v", MessageStrings[msg.Type], msg.Addr, msg.Rank, err)
 			}
-		case ADMIRAL:
-			log.Infof("[ELECTION] setting new leader [%s %d]", msg.Addr, msg.Rank)
-			c.SetLeader(msg.Addr, msg.Payload, msg.Rank)
-
-		case WHOISLEADER:
-			if msg.CallSign != c.callsign {
-				log.Warnf("[WHOISLEADER] unknown callsign from [%s %d]", msg.Addr, msg.Rank)
-				err := c.SendOneShot(msg.Addr, UNKNOWN)
-				if err != nil {
-					log.Error(err)
+		}
+	}
+}
+
+// handle processes a single `Message` received from the fleet.
+func (c *Captain) handle(msg Message) error {
+	// format, _ := json.MarshalIndent(msg, "", "   ")
+	// log.Debugf("%s", format)
+	switch msg.Type {
+	case ELECTION:
+		// A captain standing for election is healthy
+		c.peers.SetReady(msg.Rank, msg.Addr, true)
+		if c.Ready {
+			if c.isAppointed() {
+				c.holdLeadership(msg)
+				break
+			}
+			if outranks(c.Rank(), c.id, msg.Rank, msg.ID) {
+				if !c.Healthy() {
+					log.Infof("[ELECTION] abstaining from the election by [%s %d]", msg.Addr, msg.Rank)
+					break
 				}
-			} else {
-				log.Infof("[WHOISLEADER] from [%s %d]", msg.Addr, msg.Rank)
-				err := c.SendOneShot(msg.Addr, LEADER)
+				log.Warnf("[ELECTION] new election [%s %d]", msg.Addr, msg.Rank)
+				err := c.Send(msg.Rank, msg.Addr, OK)
 				if err != nil {
 					log.Error(err)
 				}
+				c.Elect()
 			}
-		case PEERS:
-			log.Infof("[PEERS] from [%s %d]", msg.Addr, msg.Rank)
-
-			err := c.Send(msg.Rank, msg.Addr, PEERLIST)
+		}
+	case ADMIRAL:
+		if msg.CallSign != c.callsign {
+			log.Warnf("[ELECTION] ignoring admiral [%s %d] with unknown callsign", msg.Addr, msg.Rank)
+			c.emit(Event{Type: CallsignRejected, Rank: msg.Rank, Addr: msg.Addr})
+			break
+		}
+		if !c.acceptTerm(msg.Term, msg.Rank, msg.Addr) {
+			log.Warnf("[ELECTION] ignoring admiral [%s %d] with stale term [%d], leader is [%s %d]", msg.Addr, msg.Rank, msg.Term, c.LeaderAddress(), c.LeaderRank())
+			err := c.Send(msg.Rank, msg.Addr, STALE)
 			if err != nil {
 				log.Error(err)
 			}
-		case READY:
-			log.Debugf("[READY] member [%s / %d]", msg.Addr, msg.Rank)
-			err := c.connect(c.proto, msg.Addr, msg.Rank)
+			break
+		}
+		log.Infof("[ELECTION] setting new leader [%s %d]", msg.Addr, msg.Rank)
+		c.peers.SetReady(msg.Rank, msg.Addr, true)
+		c.setLeader(msg.Addr, msg.Rank, msg.ID, msg.payload(), msg.PayloadVersion, msg.Term)
+		// Only acknowledge an admiral that we've accepted
+		if c.LeaderRank() == msg.Rank {
+			err := c.Send(msg.Rank, msg.Addr, ADMIRAL_ACK)
 			if err != nil {
-				return err
+				log.Error(err)
 			}
-		case PROMOTION:
-			log.Debugf("[PROMOTION] member [%s / %d]", msg.Addr, msg.Rank)
+		}
 
-		default:
-			log.Warnf("Unknown message [%d]", msg.Type)
+	case WHOISLEADER:
+		if msg.CallSign != c.callsign {
+			log.Warnf("[WHOISLEADER] unknown callsign from [%s %d]", msg.Addr, msg.Rank)
+			c.emit(Event{Type: CallsignRejected, Rank: msg.Rank, Addr: msg.Addr})
+			err := c.SendOneShot(msg.Addr, UNKNOWN)
+			if err != nil {
+				log.Error(err)
+			}
+		} else if owner, ok := c.duplicate(msg.Rank, msg.Addr); ok {
+			err := c.rejectDuplicate(msg.Addr, msg.Rank, owner)
+			if err != nil {
+				log.Error(err)
+			}
+		} else {
+			log.Infof("[WHOISLEADER] from [%s %d]", msg.Addr, msg.Rank)
+			err := c.SendOneShot(msg.Addr, LEADER)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	case PEERS:
+		log.Infof("[PEERS] from [%s %d]", msg.Addr, msg.Rank)
+		if msg.Rank == ObserverRank {
+			// A client only wants to know who is in the fleet, not to join it
+			return c.SendOneShot(msg.Addr, PEERLIST)
+		}
+		if owner, ok := c.duplicate(msg.Rank, msg.Addr); ok {
+			return c.rejectDuplicate(msg.Addr, msg.Rank, owner)
+		}
 
+		err := c.Send(msg.Rank, msg.Addr, PEERLIST)
+		if err != nil {
+			log.Error(err)
+		}
+		// A new captain is sent the replicated state after the peers
+		if c.HasLease() {
+			err = c.Send(msg.Rank, msg.Addr, STATE_SNAPSHOT)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	case READY:
+		log.Debugf("[READY] member [%s / %d]", msg.Addr, msg.Rank)
+		err := c.connect(msg.Addr, msg.Rank, msg.ID)
+		if err != nil {
+			return err
+		}
+		c.peers.Identify(msg.Rank, msg.Addr, msg.ID)
+	case PAYLOAD_UPDATE:
+		c.updateLeaderPayload(msg)
+	case RANK:
+		c.peerRankChanged(msg)
+	case TRANSFER, TRANSFER_COMMIT:
+		c.handleTransfer(msg)
+	case ABSTAIN:
+		c.abstained(msg)
+	case STATE_UPDATE:
+		c.updateState(msg)
+	case STATE_SNAPSHOT:
+		c.restoreState(msg)
+	case STATE_SYNC:
+		if c.HasLease() {
+			err := c.Send(msg.Rank, msg.Addr, STATE_SNAPSHOT)
+			if err != nil {
+				log.Error(err)
+			}
 		}
+	case PROMOTION:
+		log.Debugf("[PROMOTION] member [%s / %d]", msg.Addr, msg.Rank)
+
+	default:
+		log.Warnf("Unknown message [%d]", msg.Type)
 
 	}
 	return nil
 }
+
+// peerLost removes the peer at `addr` with `rank` (if it is an actual peer)
+// and starts a new election if that peer was the leader.
+func (c *Captain) peerLost(addr string, rank int) {
+	c.lostMu.Lock()
+	//check if this is an actual peer
+	if !c.peers.Find(Peer{addr: addr, rank: rank}) {
+		c.lostMu.Unlock()
+		return
+	}
+	log.Warnf("[PEER] lost [%s] Rank [%d] leaderRank [%d]", addr, rank, c.LeaderRank())
+	c.peers.Delete(rank)
+	c.lostMu.Unlock()
+	c.forgetMetadata(rank, addr)
+
+	c.emit(Event{Type: PeerLost, Rank: rank, Addr: addr})
+	// Check if this peer was the leader! (after a transfer the leader may not have the highest rank)
+	if leaderAddr := c.LeaderAddress(); leaderAddr == "" || (rank == c.LeaderRank() && addr == leaderAddr) {
+		log.Errorf("[LEADER] lost [%s] ID [%d]", addr, rank)
+		c.ResetLeader(addr, rank)
+		c.Elect()
+		return
+	}
+	// In quorum mode, an admiral that is left in the minority has to step down
+	if c.fleetSize > 0 && len(c.peers.PeerData())+1 < c.quorum() {
+		c.quorumLost(fmt.Errorf("only [%d] of the [%d] captains are reachable", len(c.peers.PeerData())+1, c.fleetSize))
+	}
+}
@@ -0,0 +1,158 @@
+package navy
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventBuffer is the size of the buffer of each event subscription, events
+// are dropped for a subscriber that falls this far behind.
+const eventBuffer = 64
+
+// EventType identifies what an `Event` is reporting.
+type EventType int
+
+// Event Types.
+const (
+	LeaderChanged      EventType = iota // the admiral of the fleet has changed
+	PeerJoined                          // a new peer has been connected to
+	PeerLost                            // a peer has left or been lost
+	ElectionStarted                     // this captain has started an election
+	ElectionWon                         // this captain has won an election
+	DiscoveryCompleted                  // this captain has discovered the fleet
+	CallsignRejected                    // a callsign didn't match the fleet
+	CallbackFailed                      // a promotion/demotion function failed or timed out
+	SteppedDown                         // this captain gave up leadership (lease lost or stale term)
+	QuorumLost                          // this captain can't reach a quorum, so the fleet is leaderless
+	TLSRejected                         // a TLS handshake with a peer failed
+	MessageRejected                     // a message failed authentication
+	ProtocolRejected                    // a peer couldn't agree on the protocol version or codec
+	PayloadChanged                      // the admiral has updated its payload
+	MetadataChanged                     // a member of the fleet has published new metadata
+	StateChanged                        // a key of the replicated state has changed
+	RankChanged                         // a captain (possibly this one) has changed its rank
+	RankRejected                        // the rank of this captain already belongs to another captain
+	PeerMoved                           // a peer has come back with the same ID on a new address
+	HealthChanged                       // the health check of this captain has started (`Err` is set) or stopped failing
+)
+
+var EventStrings map[EventType]string
+
+func init() {
+	EventStrings = make(map[EventType]string)
+	EventStrings[LeaderChanged] = "LeaderChanged"
+	EventStrings[PeerJoined] = "PeerJoined"
+	EventStrings[PeerLost] = "PeerLost"
+	EventStrings[ElectionStarted] = "ElectionStarted"
+	EventStrings[ElectionWon] = "ElectionWon"
+	EventStrings[DiscoveryCompleted] = "DiscoveryCompleted"
+	EventStrings[CallsignRejected] = "CallsignRejected"
+	EventStrings[CallbackFailed] = "CallbackFailed"
+	EventStrings[SteppedDown] = "SteppedDown"
+	EventStrings[QuorumLost] = "QuorumLost"
+	EventStrings[TLSRejected] = "TLSRejected"
+	EventStrings[MessageRejected] = "MessageRejected"
+	EventStrings[ProtocolRejected] = "ProtocolRejected"
+	EventStrings[PayloadChanged] = "PayloadChanged"
+	EventStrings[MetadataChanged] = "MetadataChanged"
+	EventStrings[StateChanged] = "StateChanged"
+	EventStrings[RankChanged] = "RankChanged"
+	EventStrings[RankRejected] = "RankRejected"
+	EventStrings[PeerMoved] = "PeerMoved"
+	EventStrings[HealthChanged] = "HealthChanged"
+}
+
+func (t EventType) String() string {
+	return EventStrings[t]
+}
+
+// Event is a `struct` describing a change in leadership or membership of the
+// fleet, as seen by this captain.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	Rank int    // rank of the captain the event is about (the new leader for `LeaderChanged`)
+	Addr string // address of the captain the event is about
+
+	OldRank int    // `LeaderChanged`, `RankChanged` and `PeerMoved` only, the rank of the previous leader (or of the captain)
+	OldAddr string // `LeaderChanged` and `PeerMoved` only, the address of the previous leader (or of the captain)
+	ID      string // `PeerMoved` only, the unique ID of the captain
+
+	Payload        string // `LeaderChanged` and `PayloadChanged` only, the payload of the leader
+	PayloadVersion uint64 // `LeaderChanged` and `PayloadChanged` only, the version of the payload
+
+	Metadata map[string]string // `MetadataChanged` only, the metadata of the member
+
+	Key     string // `StateChanged` only, the key that has changed
+	Value   []byte // `StateChanged` only, the new value of the key
+	Deleted bool   // `StateChanged` only, the key has been removed
+	Seq     uint64 // `StateChanged` only, the sequence number of the replicated state
+
+	Term uint64 // `LeaderChanged` and `SteppedDown` only, the term of the leadership
+
+	Err error // `CallbackFailed`, `SteppedDown`, `QuorumLost`, `TLSRejected`, `MessageRejected` and `ProtocolRejected` only, why it happened
+}
+
+// events is a `struct` that fans out `Event`s to all of the subscribers.
+type events struct {
+	mu          sync.Mutex
+	closed      bool
+	subscribers []chan Event
+}
+
+// Events returns a new subscription to the `Event`s of this captain. Each call
+// returns a new channel, which is closed when the captain shuts down.
+//
+// NOTE: Events are dropped for a subscriber that doesn't keep up.
+func (c *Captain) Events() <-chan Event {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+
+	ch := make(chan Event, eventBuffer)
+	if c.events.closed {
+		close(ch)
+		return ch
+	}
+	c.events.subscribers = append(c.events.subscribers, ch)
+	return ch
+}
+
+// emit delivers `e` to all subscribers without blocking.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) emit(e Event) {
+	c.metrics.observe(e)
+
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+
+	if c.events.closed {
+		return
+	}
+	e.Time = time.Now()
+	for _, ch := range c.events.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Warnf("[EVENT] subscriber is full, dropping [%s]", e.Type)
+		}
+	}
+}
+
+// closeEvents closes all of the subscriptions.
+func (c *Captain) closeEvents() {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+
+	if c.events.closed {
+		return
+	}
+	c.events.closed = true
+	for _, ch := range c.events.subscribers {
+		close(ch)
+	}
+	c.events.subscribers = nil
+}
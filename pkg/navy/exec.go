@@ -0,0 +1,179 @@
+package navy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExecHook is a command that is run with `sh -c` when this captain is promoted
+// or demoted. The command is given the leader in its environment:
+//
+//	NAVY_EVENT            promotion or demotion
+//	NAVY_RANK             the rank of this captain
+//	NAVY_ID               the ID of this captain
+//	NAVY_LEADER_RANK      the rank of the leader (zero if there isn't one)
+//	NAVY_LEADER_ADDRESS   the address of the leader
+//	NAVY_PAYLOAD          the payload of the leader
+//	NAVY_PAYLOAD_VERSION  the version of the payload
+//	NAVY_TERM             the term of the leadership
+//
+// Its output is logged one line at a time.
+type ExecHook struct {
+	Command string               // the command, run with `sh -c`
+	Env     []string             // optional, extra `KEY=value` variables for the command
+	Timeout time.Duration        // optional, the command is killed once it has run for this long
+	OnError func(err *HookError) // optional, called when the command fails or is killed
+
+	// Refuse gives up leadership when the promotion command fails, handing it
+	// to the highest ranked peer (or stepping down if that isn't possible).
+	Refuse bool
+}
+
+// HookError is returned when an `ExecHook` command fails or is killed.
+type HookError struct {
+	Event   string
+	Command string
+	Output  []byte
+	Err     error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook [%s] failed: %v", e.Event, e.Command, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// OnPromotionExec runs `hook` when this captain is promoted to admiral, in
+// place of any promotion function. An empty `Command` removes the hook.
+//
+// NOTE: The hook is queued with the other callbacks, so a demotion hook never
+// runs before the promotion hook that preceded it has completed.
+func (c *Captain) OnPromotionExec(hook ExecHook) {
+	if hook.Command == "" {
+		c.OnPromotionContext(nil, 0)
+		return
+	}
+	c.OnPromotionContext(func(ctx context.Context, leader Leader) error {
+		err := c.runHook(ctx, "promotion", hook, leader)
+		if err != nil && hook.Refuse {
+			// A transfer waits on the fleet, and would hold up the callbacks queued
+			// behind this one
+			go c.refuseLeadership(leader.Term, err)
+		}
+		return err
+	}, 0)
+}
+
+// OnDemotionExec runs `hook` when this captain is demoted from admiral, in
+// place of any demotion function. An empty `Command` removes the hook.
+func (c *Captain) OnDemotionExec(hook ExecHook) {
+	if hook.Command == "" {
+		c.OnDemotionContext(nil, 0)
+		return
+	}
+	c.OnDemotionContext(func(ctx context.Context, leader Leader) error {
+		return c.runHook(ctx, "demotion", hook, leader)
+	}, 0)
+}
+
+// runHook runs the command of `hook` for `event`, killing it (along with
+// anything it started) if `ctx` is done or its timeout expires.
+func (c *Captain) runHook(ctx context.Context, event string, hook ExecHook, leader Leader) error {
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.Command("sh", "-c", hook.Command)
+	cmd.Env = append(os.Environ(),
+		"NAVY_EVENT="+event,
+		"NAVY_RANK="+strconv.Itoa(c.Rank()),
+		"NAVY_ID="+c.ID(),
+		"NAVY_LEADER_RANK="+strconv.Itoa(leader.Rank),
+		"NAVY_LEADER_ADDRESS="+leader.Addr,
+		"NAVY_PAYLOAD="+leader.Payload,
+		"NAVY_PAYLOAD_VERSION="+strconv.FormatUint(leader.PayloadVersion, 10),
+		"NAVY_TERM="+strconv.FormatUint(leader.Term, 10),
+	)
+	cmd.Env = append(cmd.Env, hook.Env...)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	setProcessGroup(cmd)
+
+	log.Infof("[HOOK] running the %s hook", event)
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+			<-done
+			err = fmt.Errorf("killed: %v", ctx.Err())
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output.Bytes()))
+	for scanner.Scan() {
+		log.Infof("[HOOK] [%s] %s", event, scanner.Text())
+	}
+	if err == nil {
+		return nil
+	}
+	herr := &HookError{Event: event, Command: hook.Command, Output: output.Bytes(), Err: err}
+	if hook.OnError != nil {
+		hook.OnError(herr)
+	}
+	return herr
+}
+
+// refuseLeadership gives up the leadership of `term` after the promotion hook
+// failed, handing it to the highest ranked peer. If there isn't a peer, or it
+// can't take over, then this captain steps down and another election takes
+// place.
+func (c *Captain) refuseLeadership(term uint64, reason error) {
+	// The hook may have run for a term that is already over
+	if !c.leadingTerm(term) {
+		return
+	}
+	rank, id, found := 0, "", false
+	for _, peer := range c.peers.PeerData() {
+		if peer.Ready && (!found || outranks(peer.Rank, peer.ID, rank, id)) {
+			rank, id, found = peer.Rank, peer.ID, true
+		}
+	}
+	if found {
+		log.Warnf("[HOOK] refusing leadership, handing it to [%d]", rank)
+		err := c.TransferLeadership(rank)
+		if err == nil {
+			return
+		}
+		log.Errorf("[HOOK] %v", err)
+	}
+	if c.leadingTerm(term) {
+		c.stepDown(reason)
+	}
+}
+
+// leadingTerm returns `true` if this captain is the admiral for `term`.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) leadingTerm(term uint64) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.leading && c.term == term
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package navy
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing, as process groups are only available on unix.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills `cmd`, anything that it started is left running.
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
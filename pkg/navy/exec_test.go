@@ -0,0 +1,39 @@
+//go:build unix
+
+package navy
+
+import (
+	"testing"
+)
+
+func TestRefusedPromotion(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	first := f.start(1, WithReady(true))
+	waitForLeader(t, 1, first)
+
+	// Captain 2 wins the election, but can't take on the role so hands it back
+	refuser := f.create(2, WithReady(true), WithFleet(f.addr(1)))
+	refuser.OnPromotionExec(ExecHook{Command: "exit 1", Refuse: true})
+	events := refuser.Events()
+	f.run(refuser)
+
+	waitForEvent(t, events, ElectionWon)
+	waitForEvent(t, events, CallbackFailed)
+	waitForLeader(t, 1, first, refuser)
+}
+
+func TestRefusedPromotionStepsDown(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	// Without a peer to hand over to, the captain steps down
+	refuser := f.create(1, WithReady(true))
+	refuser.OnPromotionExec(ExecHook{Command: "exit 1", Refuse: true})
+	events := refuser.Events()
+	f.run(refuser)
+
+	e := waitForEvent(t, events, SteppedDown)
+	if e.Err == nil {
+		t.Error("stepping down didn't give the reason")
+	}
+}
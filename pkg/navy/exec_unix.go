@@ -0,0 +1,19 @@
+//go:build unix
+
+package navy
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts `cmd` in a process group of its own, so that anything
+// it starts can be killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills `cmd` and everything in its process group.
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
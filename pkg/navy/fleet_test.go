@@ -0,0 +1,466 @@
+package navy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// settleTimeout is how long a fleet is given to agree on an admiral.
+const settleTimeout = 20 * time.Second
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.PanicLevel)
+	os.Exit(m.Run())
+}
+
+// testFleet runs captains in memory, any of which can be cut off from the rest
+// of the fleet.
+type testFleet struct {
+	t         *testing.T
+	transport *MemoryTransport
+
+	mu       sync.Mutex
+	isolated map[string]bool
+}
+
+func newTestFleet(t *testing.T) *testFleet {
+	return &testFleet{t: t, transport: NewMemoryTransport(), isolated: make(map[string]bool)}
+}
+
+// addr returns the address of the captain with `rank`.
+func (f *testFleet) addr(rank int) string {
+	return fmt.Sprintf("captain-%d:7946", rank)
+}
+
+// start creates a captain with `rank`, starts it and runs it until the end of
+// the test.
+func (f *testFleet) start(rank int, opts ...Option) *Captain {
+	f.t.Helper()
+	c := f.create(rank, opts...)
+	f.run(c)
+	return c
+}
+
+// create creates a captain with `rank` in the fleet, without starting it.
+func (f *testFleet) create(rank int, opts ...Option) *Captain {
+	f.t.Helper()
+	addr := f.addr(rank)
+	opts = append([]Option{
+		WithRank(rank),
+		WithBindAddress(addr),
+		WithCallSign("test"),
+		WithTransport(&partitionTransport{fleet: f, addr: addr}),
+	}, opts...)
+	c, err := New(opts...)
+	if err != nil {
+		f.t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+// run starts `c` and runs it until the end of the test.
+func (f *testFleet) run(c *Captain) {
+	f.t.Helper()
+	if err := c.Start(); err != nil {
+		f.t.Fatalf("Start: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.Run(ctx)
+	}()
+	f.t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(shutdownTimeout):
+		}
+	})
+}
+
+// startQuorum starts a fleet of `size` captains in quorum mode, connected by
+// static peers and ranked from 1 to `size`, and waits for the highest rank to
+// become the admiral.
+func (f *testFleet) startQuorum(size int, opts ...Option) []*Captain {
+	f.t.Helper()
+	peers := make(map[int]string)
+	for rank := 1; rank <= size; rank++ {
+		peers[rank] = f.addr(rank)
+	}
+	var captains []*Captain
+	for rank := 1; rank <= size; rank++ {
+		others := make(map[int]string)
+		for r, addr := range peers {
+			if r != rank {
+				others[r] = addr
+			}
+		}
+		captains = append(captains, f.start(rank, append([]Option{WithReady(true), WithPeers(others), WithQuorum(size)}, opts...)...))
+		// Each captain joins a fleet that has settled, rather than every captain
+		// standing for election at once
+		time.Sleep(300 * time.Millisecond)
+	}
+	waitForLeader(f.t, size, captains...)
+	return captains
+}
+
+// startFleet starts a fleet of `size` captains ranked from 1 to `size`, the
+// first is ready and the rest discover the fleet through it, and waits for the
+// highest rank to become the admiral.
+func (f *testFleet) startFleet(size int, opts ...Option) []*Captain {
+	f.t.Helper()
+	captains := []*Captain{f.start(1, append([]Option{WithReady(true)}, opts...)...)}
+	waitForLeader(f.t, 1, captains...)
+	for rank := 2; rank <= size; rank++ {
+		captains = append(captains, f.start(rank, append([]Option{WithFleet(f.addr(1))}, opts...)...))
+		waitForLeader(f.t, rank, captains...)
+	}
+	return captains
+}
+
+// isolate cuts the captain at `addr` off from the rest of the fleet, the
+// messages it sends and those sent to it are silently dropped and it can't be
+// connected to.
+func (f *testFleet) isolate(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isolated[addr] = true
+}
+
+// heal reconnects the captain at `addr` to the rest of the fleet, anything
+// sent while it was isolated stays lost.
+func (f *testFleet) heal(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.isolated, addr)
+}
+
+// cut returns `true` if messages between `from` and `to` are being dropped.
+func (f *testFleet) cut(from, to string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.isolated[from] != f.isolated[to]
+}
+
+// partitionTransport is the `Transport` of a single captain in a `testFleet`,
+// as a captain only writes to the connections it dials dropping those writes
+// is enough to partition it.
+type partitionTransport struct {
+	fleet *testFleet
+	addr  string
+}
+
+func (p *partitionTransport) Listen(addr string) (net.Listener, error) {
+	return p.fleet.transport.Listen(addr)
+}
+
+func (p *partitionTransport) Dial(addr string) (net.Conn, error) {
+	if p.fleet.cut(p.addr, addr) {
+		return nil, fmt.Errorf("connect: [%s] unreachable", addr)
+	}
+	conn, err := p.fleet.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &partitionConn{Conn: conn, fleet: p.fleet, from: p.addr, to: addr}, nil
+}
+
+// partitionConn drops writes while its ends are partitioned, a frame is always
+// written in one go so whole messages are lost.
+type partitionConn struct {
+	net.Conn
+	fleet    *testFleet
+	from, to string
+}
+
+func (c *partitionConn) Write(p []byte) (int, error) {
+	if c.fleet.cut(c.from, c.to) {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// eventually fails the test if `cond` doesn't become `true` within `timeout`.
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitForLeader waits for all of `captains` to follow the captain with `rank`,
+// and for that captain to be leading.
+func waitForLeader(t *testing.T, rank int, captains ...*Captain) {
+	t.Helper()
+	agreed := func() bool {
+		for _, c := range captains {
+			if c.LeaderRank() != rank || c.LeaderAddress() == "" {
+				return false
+			}
+			if c.Rank() == rank && !c.isAdmiral() {
+				return false
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(settleTimeout)
+	for !agreed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("captains didn't agree on [%d] as the admiral: %s", rank, leaders(captains))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitForEvent waits for an event of type `eventType` from `events`.
+func waitForEvent(t *testing.T, events <-chan Event, eventType EventType) Event {
+	t.Helper()
+	timeout := time.After(settleTimeout)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == eventType {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no [%s] event", eventType)
+		}
+	}
+}
+
+// leaders describes who each of `captains` follows.
+func leaders(captains []*Captain) string {
+	s := ""
+	for _, c := range captains {
+		s += fmt.Sprintf("[%d -> %d %q] ", c.Rank(), c.LeaderRank(), c.LeaderAddress())
+	}
+	return s
+}
+
+// isAdmiral returns `true` if this captain is leading the fleet.
+func (c *Captain) isAdmiral() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.leading
+}
+
+func TestElection(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3)
+
+	// Only the admiral is leading, and the term is the same across the fleet
+	for _, c := range captains[:2] {
+		if c.isAdmiral() {
+			t.Errorf("captain [%d] is leading as well as the admiral", c.Rank())
+		}
+	}
+	eventually(t, settleTimeout, func() bool {
+		return captains[0].Term() == captains[2].Term() && captains[1].Term() == captains[2].Term()
+	}, "captains didn't agree on the term")
+}
+
+func TestAuthenticatedFailover(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3, WithSecret("s3cret"))
+	events := []<-chan Event{captains[0].Events(), captains[1].Events()}
+
+	// Every message is bound to the captain it is for, none of them should be
+	// rejected on the way to a new admiral
+	captains[2].LeaveFleet()
+	waitForLeader(t, 2, captains[:2]...)
+	for i, ch := range events {
+		for len(ch) > 0 {
+			if e := <-ch; e.Type == MessageRejected {
+				t.Errorf("captain [%d] rejected a message from [%s]: %v", i+1, e.Addr, e.Err)
+			}
+		}
+	}
+}
+
+func TestPeerLoss(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3)
+	promoted := make(chan interface{}, 1)
+	captains[1].OnPromotion(func(chan interface{}) { promoted <- nil })
+
+	captains[2].LeaveFleet()
+	waitForLeader(t, 2, captains[:2]...)
+	select {
+	case <-promoted:
+	case <-time.After(settleTimeout):
+		t.Fatal("the next rank wasn't promoted")
+	}
+	if len(captains[0].peers.PeerData()) != 1 {
+		t.Errorf("the captain that left is still a peer: %v", captains[0].peers.PeerData())
+	}
+}
+
+func TestQuorumLoss(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startQuorum(3, WithHeartbeat(500*time.Millisecond, 4))
+	admiral := captains[2]
+	events := admiral.Events()
+
+	// The admiral is in the minority once it's cut off, the majority elects the next rank
+	f.isolate(admiral.extaddr)
+	waitForEvent(t, events, QuorumLost)
+	waitForEvent(t, events, SteppedDown)
+	waitForLeader(t, 2, captains[:2]...)
+
+	// On its own the old admiral stays leaderless
+	time.Sleep(2 * time.Second)
+	if admiral.isAdmiral() || admiral.LeaderAddress() != "" {
+		t.Errorf("isolated captain follows [%d %q]", admiral.LeaderRank(), admiral.LeaderAddress())
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	lease := 500 * time.Millisecond
+	captains := f.startQuorum(3, WithLease(lease))
+	admiral := captains[2]
+	eventually(t, lease, admiral.HasLease, "the admiral doesn't hold its lease")
+	events := admiral.Events()
+
+	// Without heartbeats only the lease notices that the fleet has gone quiet
+	f.isolate(admiral.extaddr)
+	isolated := time.Now()
+	e := waitForEvent(t, events, SteppedDown)
+	if elapsed := time.Since(isolated); elapsed < lease/2 {
+		t.Errorf("stepped down after [%s], before the lease could have expired", elapsed)
+	}
+	if admiral.HasLease() || admiral.isAdmiral() {
+		t.Error("the admiral is still leading after its lease expired")
+	}
+	if e.Err == nil {
+		t.Error("stepping down didn't give a reason")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3)
+	term := captains[2].Term()
+
+	if err := captains[2].TransferLeadership(1); err != nil {
+		t.Fatalf("TransferLeadership: %v", err)
+	}
+	waitForLeader(t, 1, captains...)
+	if captains[2].isAdmiral() {
+		t.Error("the old admiral is still leading")
+	}
+	if captains[0].Term() <= term {
+		t.Errorf("the new admiral is at term [%d], it was [%d] before the transfer", captains[0].Term(), term)
+	}
+
+	// Only the admiral can transfer leadership
+	if err := captains[1].TransferLeadership(2); err == nil {
+		t.Error("a captain that isn't the admiral transferred leadership")
+	}
+}
+
+func TestRankChange(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3)
+
+	// Raising the lowest rank above the admiral makes it the admiral
+	if err := captains[0].SetRank(4); err != nil {
+		t.Fatalf("SetRank: %v", err)
+	}
+	waitForLeader(t, 4, captains...)
+
+	// A rank that belongs to a peer is refused
+	if err := captains[1].SetRank(3); err == nil {
+		t.Error("a captain took the rank of a peer")
+	}
+
+	// Lowering the admiral hands leadership back to the highest rank
+	if err := captains[0].SetRank(1); err != nil {
+		t.Fatalf("SetRank: %v", err)
+	}
+	waitForLeader(t, 3, captains...)
+}
+
+func TestDuplicateRank(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(2)
+	admiralID := captains[1].ID()
+
+	// Another captain with the admiral's rank can't join the fleet
+	addr := "captain-2b:7946"
+	joiner, err := New(WithRank(2), WithBindAddress(addr), WithCallSign("test"), WithTransport(&partitionTransport{fleet: f, addr: addr}), WithFleet(f.addr(1)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = joiner.Shutdown(ctx)
+	})
+	events := joiner.Events()
+	if err = joiner.Start(); !errors.Is(err, ErrDuplicateRank) {
+		t.Fatalf("Start = %v, want %v", err, ErrDuplicateRank)
+	}
+	if e := waitForEvent(t, events, RankRejected); e.Addr != f.addr(2) {
+		t.Errorf("rank was rejected in favour of [%s], want [%s]", e.Addr, f.addr(2))
+	}
+
+	// The captain that already has the rank carries on as the admiral
+	waitForLeader(t, 2, captains...)
+	if !captains[1].isAdmiral() || captains[0].LeaderID() != admiralID {
+		t.Errorf("the admiral was replaced by the duplicate: %s", leaders(captains))
+	}
+	for _, peer := range captains[0].peers.PeerData() {
+		if peer.Addr == addr {
+			t.Errorf("the duplicate was added to the fleet as [%d]", peer.Rank)
+		}
+	}
+}
+
+func TestTransferSurvivesElection(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3)
+	if err := captains[2].TransferLeadership(1); err != nil {
+		t.Fatalf("TransferLeadership: %v", err)
+	}
+	waitForLeader(t, 1, captains...)
+	term := captains[0].Term()
+
+	// A captain that outranks the new admiral stands for election
+	captains[2].Elect()
+	waitForLeader(t, 1, captains...)
+
+	// As does a higher rank that joins the fleet
+	captains = append(captains, f.start(4, WithFleet(f.addr(1))))
+	time.Sleep(2 * time.Second)
+	waitForLeader(t, 1, captains...)
+	if captains[0].Term() != term {
+		t.Errorf("the admiral moved from term [%d] to [%d]", term, captains[0].Term())
+	}
+
+	// Once the appointed admiral has gone, ranks decide the election again
+	captains[0].LeaveFleet()
+	waitForLeader(t, 4, captains[1:]...)
+}
@@ -0,0 +1,124 @@
+package navy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultHealthCheckInterval is how often the health check is run when no
+// interval has been configured.
+const defaultHealthCheckInterval = time.Second
+
+// SetHealthCheck sets the function that decides whether this captain is fit to
+// lead, such as by checking the service it guards. It is run on a goroutine of
+// its own as soon as it is set and then every health check interval, and
+// elections only go by its latest result. While it returns an error this
+// captain abstains from elections (and its peers stop considering it for
+// leadership), an admiral that becomes unhealthy steps down so that the next
+// rank takes over. Once it is healthy again the captain stands for election
+// again. A `nil` function removes the health check.
+//
+// NOTE: The function is given a context that expires after the health check
+// interval, a slow check only delays its own next result.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) SetHealthCheck(check func(ctx context.Context) error) {
+	c.mu.Lock()
+	c.healthCheck = check
+	c.mu.Unlock()
+
+	select {
+	case c.healthNow <- struct{}{}:
+	default:
+	}
+}
+
+// Healthy returns `false` if this captain is abstaining from elections because
+// its last health check failed. It never runs the health check itself.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) Healthy() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.abstaining
+}
+
+// checkHealth runs the health check (if there is one) and records whether this
+// captain is fit to lead. When the result changes the fleet is told, and an
+// admiral that has become unhealthy steps down. It returns `true` if the
+// captain has just recovered.
+//
+// NOTE: Only `health` runs the check, so that it never holds up the messages
+// and elections that go by its result.
+func (c *Captain) checkHealth() (recovered bool) {
+	c.mu.RLock()
+	check := c.healthCheck
+	c.mu.RUnlock()
+
+	var err error
+	if check != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), c.healthCheckInterval)
+		err = check(ctx)
+		cancel()
+	}
+
+	c.mu.Lock()
+	wasAbstaining := c.abstaining
+	c.abstaining = err != nil
+	leading := c.leading
+	c.mu.Unlock()
+
+	switch {
+	case err != nil && !wasAbstaining:
+		log.Warnf("[HEALTH] unhealthy, abstaining from elections [%v]", err)
+		c.emit(Event{Type: HealthChanged, Rank: c.Rank(), Addr: c.extaddr, Err: err})
+		for _, peer := range c.peers.PeerData() {
+			if err := c.Send(peer.Rank, peer.Addr, ABSTAIN); err != nil {
+				log.Error(err)
+			}
+		}
+		if leading {
+			c.stepDown(fmt.Errorf("health check failed: %v", err))
+		}
+	case err == nil && wasAbstaining:
+		log.Infof("[HEALTH] healthy, standing for election again")
+		c.emit(Event{Type: HealthChanged, Rank: c.Rank(), Addr: c.extaddr})
+		return true
+	}
+	return false
+}
+
+// abstained marks the peer that sent an `ABSTAIN` as unfit to lead, starting
+// an election if it was the admiral.
+func (c *Captain) abstained(msg Message) {
+	log.Warnf("[HEALTH] [%s %d] is unhealthy, abstaining from elections", msg.Addr, msg.Rank)
+	c.peers.SetReady(msg.Rank, msg.Addr, false)
+	if msg.Rank == c.LeaderRank() && msg.Addr == c.LeaderAddress() {
+		c.ResetLeader(msg.Addr, msg.Rank)
+		c.Elect()
+	}
+}
+
+// health runs the health check every interval (or as soon as a new one is
+// set), standing for election again once an unhealthy captain recovers.
+//
+// NOTE: this function loops until the captain quits.
+func (c *Captain) health() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		case <-c.healthNow:
+		}
+		if recovered := c.checkHealth(); recovered && c.Ready {
+			c.Elect()
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package navy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(2)
+
+	// An admiral whose check fails steps down, and returns once it passes
+	var failing atomic.Bool
+	failing.Store(true)
+	captains[1].SetHealthCheck(func(context.Context) error {
+		if failing.Load() {
+			return errors.New("service is down")
+		}
+		return nil
+	})
+	waitForLeader(t, 1, captains...)
+	if captains[1].Healthy() {
+		t.Error("captain [2] is healthy with a failing check")
+	}
+
+	failing.Store(false)
+	waitForLeader(t, 2, captains...)
+}
+
+func TestSlowHealthCheck(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(2, WithHealthCheckInterval(5*time.Second))
+
+	// The admiral's check hangs, but it still answers elections straight away
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	captains[1].SetHealthCheck(func(ctx context.Context) error {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	events := captains[0].Events()
+	captains[0].Elect()
+	waitForLeader(t, 2, captains...)
+	for len(events) > 0 {
+		if e := <-events; e.Type == ElectionWon {
+			t.Fatal("captain [1] won the election while the admiral was checking its health")
+		}
+	}
+}
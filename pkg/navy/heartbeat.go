@@ -0,0 +1,47 @@
+package navy
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultHeartbeatMisses is the number of heartbeat intervals a peer can miss,
+// when heartbeats are enabled without a threshold.
+const defaultHeartbeatMisses = 3
+
+// heartbeat sends a `HEARTBEAT` to every peer each interval, any peer that
+// hasn't been heard from within the miss threshold is treated as lost. Peers
+// that don't support heartbeats are only lost when their connection closes.
+//
+// NOTE: this function loops until the captain quits.
+func (c *Captain) heartbeat() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+
+	deadline := c.heartbeatInterval * time.Duration(c.heartbeatMisses)
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+		for _, peer := range c.peers.PeerData() {
+			// An older captain will never reply to a heartbeat
+			if !c.supports(peer.Addr, HEARTBEAT) {
+				continue
+			}
+			seen, ok := c.peers.LastSeen(peer.Rank)
+			if ok && time.Since(seen) > deadline {
+				log.Warnf("[HEARTBEAT] no response from [%s %d] for %s", peer.Addr, peer.Rank, time.Since(seen).Round(time.Millisecond))
+				c.peerLost(peer.Addr, peer.Rank)
+				continue
+			}
+			err := c.Send(peer.Rank, peer.Addr, HEARTBEAT)
+			if err != nil {
+				log.Debugf("[HEARTBEAT] [%s %d] %v", peer.Addr, peer.Rank, err)
+			}
+		}
+	}
+}
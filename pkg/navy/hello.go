@@ -0,0 +1,56 @@
+package navy
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// hello tells the peer `rank` at `addr` which protocol version and message
+// types this captain supports, it is sent on every new framed connection.
+func (c *Captain) hello(rank int, addr string) error {
+	return c.write(rank, &Message{
+		Rank:     c.Rank(),
+		Addr:     c.extaddr,
+		Type:     HELLO,
+		CallSign: c.callsign,
+		Term:     c.Term(),
+		Version:  int(ProtocolVersion),
+		Types:    supportedTypes(),
+	}, addr)
+}
+
+// recordHello records the message types supported by the sender of `msg`.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) recordHello(msg Message) {
+	types := make(map[int]bool, len(msg.Types))
+	for _, t := range msg.Types {
+		types[t] = true
+	}
+	log.Debugf("[HELLO] from [%s %d] version [%d] types %v", msg.Addr, msg.Rank, msg.Version, msg.Types)
+
+	// Only a captain speaking the framed protocol says hello
+	c.clearLegacy(msg.Addr)
+
+	c.typesMu.Lock()
+	defer c.typesMu.Unlock()
+	c.peerTypes[msg.Addr] = types
+}
+
+// supports returns `true` if the peer at `addr` understands `msgType`. A peer
+// that hasn't said hello is assumed to understand everything, unless it
+// doesn't speak the framed protocol in which case it only understands the
+// types from before the `HELLO` handshake.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) supports(addr string, msgType int) bool {
+	c.typesMu.RLock()
+	types, ok := c.peerTypes[addr]
+	c.typesMu.RUnlock()
+	if ok {
+		return types[msgType]
+	}
+	if c.isLegacy(addr) {
+		return msgType <= legacyTypes
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package navy
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrDuplicateRank is returned when a captain joins a fleet where another
+// captain already has its rank.
+var ErrDuplicateRank = errors.New("rank already belongs to another captain")
+
+// newID returns a random (version 4) UUID for a captain.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("newID: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// loadID returns the ID saved in `path`, or saves a new ID there if the file
+// doesn't exist yet.
+func loadID(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(b))
+		if id == "" {
+			return "", fmt.Errorf("loadID: [%s] is empty", path)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("loadID: %v", err)
+	}
+
+	id := newID()
+	if err = writeFileAtomic(path, []byte(id+"\n")); err != nil {
+		return "", fmt.Errorf("loadID: %v", err)
+	}
+	return id, nil
+}
+
+// outranks returns `true` if the captain with `rank` and `id` outranks the
+// captain with `otherRank` and `otherID`, a tie in rank is broken by the ID.
+func outranks(rank int, id string, otherRank int, otherID string) bool {
+	if rank != otherRank {
+		return rank > otherRank
+	}
+	return id > otherID
+}
+
+// ID returns the unique ID of this captain.
+func (c *Captain) ID() string {
+	return c.id
+}
+
+// LeaderID returns the unique ID of the leader, it is empty when the leader
+// is from before captains had IDs.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) LeaderID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.leaderID
+}
+
+// identify records the ID of the sender of `msg` against its peer. A peer
+// that comes back on a new address with the same ID is the same captain, so
+// its old address is re-registered rather than left to linger.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) identify(msg Message) {
+	// A `LEADER` describes the leader rather than its sender
+	if msg.ID == "" || msg.ID == c.id || msg.Type == LEADER {
+		return
+	}
+	if rank, addr, ok := c.peers.Lookup(msg.ID); ok && addr != msg.Addr {
+		log.Infof("[PEER] [%s] has moved from [%s %d] to [%s %d]", msg.ID, addr, rank, msg.Addr, msg.Rank)
+		c.emit(Event{Type: PeerMoved, Rank: msg.Rank, Addr: msg.Addr, ID: msg.ID, OldRank: rank, OldAddr: addr})
+		// The old address is gone, and if it was the admiral then so is its leadership
+		c.peerLost(addr, rank)
+	}
+	c.peers.Identify(msg.Rank, msg.Addr, msg.ID)
+}
+
+// peerID returns the ID of the captain at `addr`, or an empty `string` if it
+// isn't known.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) peerID(addr string) string {
+	if addr == c.extaddr {
+		return c.id
+	}
+	for _, peer := range c.peers.PeerData() {
+		if peer.Addr == addr {
+			return peer.ID
+		}
+	}
+	return ""
+}
+
+// duplicate returns the address of the captain that already has `rank`, if
+// it isn't the captain at `addr`.
+func (c *Captain) duplicate(rank int, addr string) (string, bool) {
+	if rank == c.Rank() && addr != c.extaddr {
+		return c.extaddr, true
+	}
+	for _, peer := range c.peers.PeerData() {
+		if peer.Rank == rank && peer.Addr != addr {
+			return peer.Addr, true
+		}
+	}
+	return "", false
+}
+
+// rejectDuplicate tells the captain at `addr` that its `rank` already belongs
+// to the captain at `owner`.
+func (c *Captain) rejectDuplicate(addr string, rank int, owner string) error {
+	log.Warnf("[DUPLICATE] rank [%d] of [%s] already belongs to [%s]", rank, addr, owner)
+	msg := &Message{Rank: c.Rank(), Addr: c.extaddr, Type: DUPLICATE, CallSign: c.callsign, Term: c.Term(), OneShot: true}
+	msg.Peers = append(msg.Peers, struct {
+		Rank  int
+		Addr  string
+		Ready bool
+		ID    string
+	}{rank, owner, true, c.peerID(owner)})
+	return c.oneShot(addr, msg)
+}
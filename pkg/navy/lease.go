@@ -0,0 +1,218 @@
+package navy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minLeaseDuration is the shortest lease that can be configured, the lease is
+// renewed three times within its duration.
+const minLeaseDuration = 30 * time.Millisecond
+
+// acceptTerm returns `true` if the leader `rank` at `addr` announcing `term`
+// should be accepted, moving this captain on to that term. A `term` of zero
+// comes from a captain without terms and is always accepted. Only one captain
+// can lead a term, so another leader announcing the term the current leader
+// announced itself for is refused.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) acceptTerm(term uint64, rank int, addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if term == 0 {
+		return true
+	}
+	if term < c.term {
+		return false
+	}
+	if term == c.leaderTerm && c.leaderAddr != "" && (rank != c.leaderRank || addr != c.leaderAddr) {
+		return false
+	}
+	c.term = term
+	return true
+}
+
+// observeTerm moves this captain on to `term` if it is higher than any term
+// seen so far. If this captain is the admiral, then its leadership is stale
+// and it steps down.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) observeTerm(term uint64) {
+	c.mu.Lock()
+	if term <= c.term {
+		c.mu.Unlock()
+		return
+	}
+	previous := c.term
+	c.term = term
+	stale := c.leading
+	c.mu.Unlock()
+
+	if stale {
+		c.stepDown(fmt.Errorf("term [%d] is behind the fleet term [%d]", previous, term))
+	}
+}
+
+// stepDown gives up leadership, leaving the fleet without an admiral until a
+// new election takes place.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) stepDown(reason error) {
+	c.mu.Lock()
+	if !c.leading {
+		c.mu.Unlock()
+		return
+	}
+	term := c.term
+	c.demote(Leader{})
+	c.leaderRank = 0
+	c.leaderAddr = ""
+	c.leaderID = ""
+	c.leaderPayload = nil
+	c.leaderPayloadVersion = 0
+	c.leaderTerm = 0
+	c.mu.Unlock()
+
+	log.Warnf("[LEASE] stepping down from term [%d] [%v]", term, reason)
+	c.emit(Event{Type: SteppedDown, Rank: c.Rank(), Addr: c.extaddr, Term: term, Err: reason})
+
+	c.retryElection()
+}
+
+// resetLease starts the lease of a new term, which isn't held until a majority
+// has acknowledged the term. The admiral steps down if that doesn't happen
+// within the duration of a lease.
+//
+// NOTE: The caller must hold `c.mu`.
+func (c *Captain) resetLease() {
+	if c.leaseDuration == 0 {
+		return
+	}
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	c.leaseAcks = make(map[int]time.Time)
+	c.leaseHeld = false
+	c.leaseExpiry = time.Now().Add(c.leaseDuration)
+}
+
+// HasLease returns `true` if this captain is the admiral and (when leases are
+// enabled) its lease hasn't expired.
+func (c *Captain) HasLease() bool {
+	c.mu.RLock()
+	leading := c.leading
+	c.mu.RUnlock()
+	if !leading || c.leaseDuration == 0 {
+		return leading
+	}
+
+	c.leaseMu.Lock()
+	defer c.leaseMu.Unlock()
+	return c.leaseHeld && time.Now().Before(c.leaseExpiry)
+}
+
+// handleLease processes the `LEASE`, `LEASE_ACK` and `STALE` messages.
+func (c *Captain) handleLease(msg Message) {
+	switch msg.Type {
+	case LEASE:
+		// Only renew the lease of the admiral we know about, and tell a stale one
+		if msg.Term < c.Term() {
+			err := c.Send(msg.Rank, msg.Addr, STALE)
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+		if msg.Rank != c.LeaderRank() {
+			log.Debugf("[LEASE] not renewing for [%s %d], not the admiral", msg.Addr, msg.Rank)
+			return
+		}
+		err := c.Send(msg.Rank, msg.Addr, LEASE_ACK)
+		if err != nil {
+			log.Error(err)
+		}
+	case LEASE_ACK:
+		c.mu.RLock()
+		current := c.leading && msg.Term == c.term
+		c.mu.RUnlock()
+		if !current || !c.isMember(msg.Rank) {
+			return
+		}
+		c.leaseMu.Lock()
+		c.leaseAcks[msg.Rank] = time.Now()
+		c.leaseMu.Unlock()
+	case STALE:
+		// observing a newer term has already stepped us down (if needed), a peer
+		// on our own term is following another admiral for it
+		log.Debugf("[LEASE] [%s %d] is on a newer term [%d]", msg.Addr, msg.Rank, msg.Term)
+		c.mu.RLock()
+		contested := c.leading && msg.Term == c.term
+		c.mu.RUnlock()
+		if contested {
+			c.stepDown(fmt.Errorf("[%s %d] follows another admiral for term [%d]", msg.Addr, msg.Rank, msg.Term))
+		}
+	}
+}
+
+// lease renews the lease of this captain while it is the admiral, stepping
+// down if a majority of the fleet hasn't renewed it before it expires.
+//
+// NOTE: this function loops until the captain quits.
+func (c *Captain) lease() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.RLock()
+		leading, term := c.leading, c.term
+		c.mu.RUnlock()
+		if !leading {
+			continue
+		}
+
+		now := time.Now()
+		peers := c.peers.PeerData()
+
+		c.leaseMu.Lock()
+		// The lease lasts from the point a majority (including ourselves) renewed
+		// it, the majority comes from the size of the fleet rather than the peers
+		// that are connected, so losing peers never makes the lease easier to renew
+		renewed := []time.Time{now}
+		for _, peer := range peers {
+			if at, ok := c.leaseAcks[peer.Rank]; ok {
+				renewed = append(renewed, at)
+			}
+		}
+		sort.Slice(renewed, func(i, j int) bool { return renewed[i].After(renewed[j]) })
+		if q := c.quorum(); len(renewed) >= q {
+			if expiry := renewed[q-1].Add(c.leaseDuration); !c.leaseHeld || expiry.After(c.leaseExpiry) {
+				c.leaseExpiry = expiry
+			}
+			c.leaseHeld = true
+		}
+		expired := !now.Before(c.leaseExpiry)
+		c.leaseMu.Unlock()
+
+		if expired {
+			c.stepDown(fmt.Errorf("lease for term [%d] could not be renewed by a majority", term))
+			continue
+		}
+
+		for _, peer := range peers {
+			err := c.Send(peer.Rank, peer.Addr, LEASE)
+			if err != nil {
+				log.Debugf("[LEASE] [%s %d] %v", peer.Addr, peer.Rank, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package navy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcceptTerm(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Rank, cfg.BindAddress = 1, "captain-1:7946"
+	c := newCaptain(cfg)
+
+	if !c.acceptTerm(5, 3, "captain-3:7946") {
+		t.Fatal("admiral with a newer term was refused")
+	}
+	c.setLeader("captain-3:7946", 3, "", nil, 0, 5)
+
+	// Only one captain can lead a term
+	if c.acceptTerm(5, 2, "captain-2:7946") {
+		t.Error("a second admiral was accepted for term [5]")
+	}
+	if !c.acceptTerm(5, 3, "captain-3:7946") {
+		t.Error("the admiral of term [5] was refused when it announced itself again")
+	}
+	if c.acceptTerm(4, 3, "captain-3:7946") {
+		t.Error("an admiral with a stale term was accepted")
+	}
+	if !c.acceptTerm(6, 2, "captain-2:7946") || c.Term() != 6 {
+		t.Errorf("admiral with a newer term was refused, term is [%d]", c.Term())
+	}
+	c.setLeader("captain-2:7946", 2, "", nil, 0, 6)
+
+	// A term seen elsewhere hasn't been claimed by the current leader
+	c.observeTerm(7)
+	if !c.acceptTerm(7, 3, "captain-3:7946") {
+		t.Error("the first admiral announcing term [7] was refused")
+	}
+	if !c.acceptTerm(0, 2, "captain-2:7946") {
+		t.Error("admiral without terms was refused")
+	}
+}
+
+func TestLeaseNeedsAcknowledgement(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Rank, cfg.BindAddress, cfg.LeaseDuration = 1, "captain-1:7946", time.Minute
+	c := newCaptain(cfg)
+
+	// A new admiral doesn't hold the lease until a majority acknowledges its term
+	c.mu.Lock()
+	c.promote(Leader{Rank: 1, Addr: c.extaddr})
+	c.mu.Unlock()
+	if !c.isAdmiral() {
+		t.Fatal("captain wasn't promoted")
+	}
+	if c.HasLease() {
+		t.Error("the lease was held before anyone acknowledged the term")
+	}
+}
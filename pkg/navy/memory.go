@@ -0,0 +1,211 @@
+package navy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryTransport is a `struct` implementing the `Transport` interface in
+// memory, every captain sharing the same `MemoryTransport` can reach the
+// others by the address they listen on.
+//
+// NOTE: This is intended for running a whole fleet within a single process,
+// such as in tests. Addresses are only names and don't need to resolve.
+type MemoryTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+// NewMemoryTransport returns a new `MemoryTransport` with no listeners.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: make(map[string]*memoryListener)}
+}
+
+// Listen registers a listener on `addr`.
+func (t *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.listeners[addr]; ok {
+		return nil, fmt.Errorf("Listen: address [%s] already in use", addr)
+	}
+	l := &memoryListener{
+		transport: t,
+		addr:      memoryAddr(addr),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects to the listener on `addr`.
+func (t *MemoryTransport) Dial(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[addr]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("connect: [%s] connection refused", addr)
+	}
+
+	client, server := newMemoryConnPair(memoryAddr("memory"), l.addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("connect: [%s] connection refused", addr)
+	}
+}
+
+// memoryAddr is the `net.Addr` of an in-memory listener.
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryListener is a `net.Listener` that accepts in-memory connections.
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryBuffer is one direction of an in-memory connection. Unlike
+// `net.Pipe`, writes never block waiting for the reader, which matches the
+// behaviour of a socket buffer.
+type memoryBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	b := &memoryBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memoryBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 {
+		if b.closed {
+			return 0, io.EOF
+		}
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	return b.buf.Read(p)
+}
+
+func (b *memoryBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.buf.Write(p)
+	b.cond.Broadcast()
+	return n, err
+}
+
+func (b *memoryBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *memoryBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		// wake any reader once the deadline passes
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.cond.Broadcast()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// memoryConn is a `net.Conn` connected in memory to another `memoryConn`.
+type memoryConn struct {
+	in, out     *memoryBuffer
+	local, peer net.Addr
+}
+
+// newMemoryConnPair returns both ends of an in-memory connection.
+func newMemoryConnPair(clientAddr, serverAddr net.Addr) (*memoryConn, *memoryConn) {
+	a, b := newMemoryBuffer(), newMemoryBuffer()
+	return &memoryConn{in: a, out: b, local: clientAddr, peer: serverAddr},
+		&memoryConn{in: b, out: a, local: serverAddr, peer: clientAddr}
+}
+
+func (c *memoryConn) Read(p []byte) (int, error)  { return c.in.read(p) }
+func (c *memoryConn) Write(p []byte) (int, error) { return c.out.write(p) }
+func (c *memoryConn) LocalAddr() net.Addr         { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr        { return c.peer }
+
+// Close closes both directions, so the other end reads an `io.EOF`.
+func (c *memoryConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, as writes never block.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -1,21 +1,51 @@
 package navy
 
+import "sort"
+
 // Message Types.
+//
+// NOTE: These numbers are sent on the wire, so an existing type must never be
+// renumbered and a new type must take the next unused number.
 const (
-	ELECTION = iota
-	OK
-	ADMIRAL
-	WHOISLEADER // client > existing member
-	LEADER      // existing member (sends leader) to discover client
-	PEERS       // discover client asks leader
-	PEERLIST    // leader deliver peers
-	READY       // node is ready
-	UNREADY     // cluster is unready (no admiral)
-	UNKNOWN     // don't recognise the callsign
-	PROMOTION   // This captain got a promotion
-	CLOSE       // Close the connection
+	ELECTION        = 0
+	OK              = 1
+	ADMIRAL         = 2
+	WHOISLEADER     = 3  // client > existing member
+	LEADER          = 4  // existing member (sends leader) to discover client
+	PEERS           = 5  // discover client asks leader
+	PEERLIST        = 6  // leader deliver peers
+	READY           = 7  // node is ready
+	UNREADY         = 8  // cluster is unready (no admiral)
+	UNKNOWN         = 9  // don't recognise the callsign
+	PROMOTION       = 10 // This captain got a promotion
+	CLOSE           = 11 // Close the connection
+	HEARTBEAT       = 12 // Are you still there?
+	HEARTBEAT_ACK   = 13 // Still here
+	LEASE           = 14 // admiral asks to renew its lease
+	LEASE_ACK       = 15 // lease renewed for the admiral
+	STALE           = 16 // the term of the sender is behind the fleet
+	ADMIRAL_ACK     = 17 // acknowledges an admiral proposal or announcement
+	HELLO           = 18 // the protocol version and message types a captain supports
+	PAYLOAD_UPDATE  = 19 // the admiral has updated its payload
+	METADATA        = 20 // a captain has published its metadata
+	STATE_UPDATE    = 21 // the admiral has changed the replicated state
+	STATE_SNAPSHOT  = 22 // the admiral's complete replicated state
+	STATE_SYNC      = 23 // asks the admiral for a snapshot of the replicated state
+	RANK            = 24 // a captain has changed its rank
+	TRANSFER        = 25 // the admiral asks a captain to take over
+	TRANSFER_ACK    = 26 // the captain is ready to take over, or has taken over
+	TRANSFER_COMMIT = 27 // the admiral has handed leadership to a captain
+	DUPLICATE       = 28 // the rank of a joining captain already belongs to another captain
+	CONTROL         = 29 // a tool asks a captain to carry out a command
+	CONTROL_ACK     = 30 // the result of a command
+	ABSTAIN         = 31 // a captain is unhealthy and won't stand for election
+	PROPOSE         = 32 // a captain asks the fleet whether it may become the admiral (quorum mode)
 )
 
+// legacyTypes is the last message type understood by captains from before the
+// `HELLO` handshake.
+const legacyTypes = CLOSE
+
 var MessageStrings map[int]string
 
 func init() {
@@ -32,12 +62,44 @@ func init() {
 	MessageStrings[UNKNOWN] = "Unknown"
 	MessageStrings[PROMOTION] = "Promotion"
 	MessageStrings[CLOSE] = "Close"
+	MessageStrings[HEARTBEAT] = "Heartbeat"
+	MessageStrings[HEARTBEAT_ACK] = "HeartbeatAck"
+	MessageStrings[LEASE] = "Lease"
+	MessageStrings[LEASE_ACK] = "LeaseAck"
+	MessageStrings[STALE] = "Stale"
+	MessageStrings[ADMIRAL_ACK] = "AdmiralAck"
+	MessageStrings[HELLO] = "Hello"
+	MessageStrings[PAYLOAD_UPDATE] = "PayloadUpdate"
+	MessageStrings[METADATA] = "Metadata"
+	MessageStrings[STATE_UPDATE] = "StateUpdate"
+	MessageStrings[STATE_SNAPSHOT] = "StateSnapshot"
+	MessageStrings[STATE_SYNC] = "StateSync"
+	MessageStrings[RANK] = "Rank"
+	MessageStrings[TRANSFER] = "Transfer"
+	MessageStrings[TRANSFER_ACK] = "TransferAck"
+	MessageStrings[TRANSFER_COMMIT] = "TransferCommit"
+	MessageStrings[DUPLICATE] = "Duplicate"
+	MessageStrings[CONTROL] = "Control"
+	MessageStrings[CONTROL_ACK] = "ControlAck"
+	MessageStrings[ABSTAIN] = "Abstain"
+	MessageStrings[PROPOSE] = "Propose"
+}
+
+// supportedTypes returns the message types this captain understands.
+func supportedTypes() []int {
+	types := make([]int, 0, len(MessageStrings))
+	for t := range MessageStrings {
+		types = append(types, t)
+	}
+	sort.Ints(types)
+	return types
 }
 
 // Message is a `struct` used for communication between `captain`s.
 type Message struct {
 	Rank     int    // incoming rank of a captain
 	Addr     string // address they're coming from
+	ID       string // OPTIONAL, the unique ID of the captain at `Addr`
 	Type     int    // Message type
 	CallSign string //
 	OneShot  bool   // A OneShot message
@@ -45,6 +107,31 @@ type Message struct {
 		Rank  int
 		Addr  string
 		Ready bool
+		ID    string // OPTIONAL, the unique ID of the peer
 	}
-	Payload string // OPTIONAL
+	Payload string // OPTIONAL, the payload as understood by older captains
+
+	Data           []byte // OPTIONAL, the payload of the leader
+	PayloadVersion uint64 // OPTIONAL, the version of `Data`
+
+	Metadata []MemberMetadata // `METADATA` and `PEERLIST` only, the metadata of the sender or the whole fleet
+	Term     uint64           // the term of the sender (0 from captains without terms)
+
+	Seq     uint64       // `STATE_UPDATE` and `STATE_SNAPSHOT` only, the sequence number of the replicated state
+	Entries []StateEntry // `STATE_UPDATE` and `STATE_SNAPSHOT` only, the changed (or every) key of the replicated state
+
+	Timestamp int64  // OPTIONAL, when the message was sent (unix nanoseconds), set when signed
+	Nonce     uint64 // OPTIONAL, a random number used once, set when signed
+	MAC       []byte // OPTIONAL, the HMAC of the message using the fleet's shared secret
+	To        string // OPTIONAL, the address of the captain the message is for, set when signed
+
+	OldRank int // `RANK` only, the rank the sender had before
+	Target  int // `TRANSFER_COMMIT` and `CONTROL` only, the rank of the captain taking over
+
+	Command string // `CONTROL` and `CONTROL_ACK` only, the command for the captain
+	Token   string // `CONTROL` only, the control token of the captain
+	Error   string // `CONTROL_ACK` only, why the command failed
+
+	Version int   // `HELLO` only, the newest protocol version of the sender
+	Types   []int // `HELLO` only, the message types the sender understands
 }
@@ -0,0 +1,225 @@
+package navy
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MemberMetadata is a `struct` carrying the metadata published by a captain,
+// it is sent with `METADATA` and `PEERLIST` messages.
+type MemberMetadata struct {
+	Rank        int
+	Addr        string
+	Version     uint64 // incremented by the captain every time its metadata changes
+	Metadata    map[string]string
+	ID          string // the unique ID of the captain, empty from captains without IDs
+	Incarnation int64  // when the captain started (unix nanoseconds), as `Version` starts again with every start
+}
+
+// Member is a `struct` describing a member of the fleet, as seen by this
+// captain.
+type Member struct {
+	Rank     int
+	Addr     string
+	ID       string // the unique ID of the member, empty if it isn't known
+	Ready    bool
+	Leader   bool              // the member is the admiral
+	Self     bool              // the member is this captain
+	LastSeen time.Time         // the last time a message was received from the member (zero for this captain)
+	Version  uint64            // the version of the metadata
+	Metadata map[string]string // the metadata published by the member
+}
+
+// SetMetadata replaces the metadata published by this captain, such as its
+// zone, version, capacity or labels, and sends it to the fleet.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) SetMetadata(metadata map[string]string) {
+	rank := c.Rank()
+	c.metaMu.Lock()
+	c.metadataVersion++
+	self := MemberMetadata{Rank: rank, Addr: c.extaddr, Version: c.metadataVersion, Metadata: copyMetadata(metadata)}
+	c.metadata[rank] = self
+	c.metaMu.Unlock()
+
+	c.emit(Event{Type: MetadataChanged, Rank: rank, Addr: c.extaddr, Metadata: copyMetadata(metadata)})
+	for _, peer := range c.peers.PeerData() {
+		if err := c.Send(peer.Rank, peer.Addr, METADATA); err != nil {
+			log.Errorf("[METADATA] [%s %d] %v", peer.Addr, peer.Rank, err)
+		}
+	}
+}
+
+// Metadata returns the metadata published by this captain.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) Metadata() map[string]string {
+	rank := c.Rank()
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return copyMetadata(c.metadata[rank].Metadata)
+}
+
+// Members returns every member of the fleet known to this captain (including
+// itself) ordered by rank, along with the metadata each has published.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) Members() []Member {
+	rank, leaderRank, leaderAddr := c.Rank(), c.LeaderRank(), c.LeaderAddress()
+
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+
+	self := c.metadata[rank]
+	members := []Member{{
+		Rank:     rank,
+		Addr:     c.extaddr,
+		ID:       c.id,
+		Ready:    c.Ready,
+		Leader:   rank == leaderRank && c.extaddr == leaderAddr,
+		Self:     true,
+		Version:  self.Version,
+		Metadata: copyMetadata(self.Metadata),
+	}}
+	for _, peer := range c.peers.PeerData() {
+		member := Member{
+			Rank:   peer.Rank,
+			Addr:   peer.Addr,
+			ID:     peer.ID,
+			Ready:  peer.Ready,
+			Leader: peer.Rank == leaderRank && peer.Addr == leaderAddr,
+		}
+		member.LastSeen, _ = c.peers.LastSeen(peer.Rank)
+		if md, ok := c.metadata[peer.Rank]; ok && md.describes(peer.ID, peer.Addr) {
+			member.Version = md.Version
+			member.Metadata = copyMetadata(md.Metadata)
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Rank < members[j].Rank })
+	return members
+}
+
+// fleetMetadata returns the metadata of this captain and all of its peers, to
+// be sent with a `PEERLIST`.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) fleetMetadata() []MemberMetadata {
+	rank := c.Rank()
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+
+	fleet := []MemberMetadata{c.ownMetadata(rank)}
+	for _, peer := range c.peers.PeerData() {
+		if md, ok := c.metadata[peer.Rank]; ok && md.describes(peer.ID, peer.Addr) {
+			fleet = append(fleet, md)
+		}
+	}
+	return fleet
+}
+
+// selfMetadata returns the metadata of this captain, to be sent with a
+// `METADATA`.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) selfMetadata() []MemberMetadata {
+	rank := c.Rank()
+	c.metaMu.RLock()
+	defer c.metaMu.RUnlock()
+	return []MemberMetadata{c.ownMetadata(rank)}
+}
+
+// ownMetadata returns the metadata of this captain with its ID and incarnation,
+// the caller must hold `c.metaMu`.
+func (c *Captain) ownMetadata(rank int) MemberMetadata {
+	self := c.metadata[rank]
+	self.ID, self.Incarnation = c.id, c.incarnation
+	return self
+}
+
+// describes returns `true` if `md` is the metadata of the captain with `id` at
+// `addr`, going by the ID when both are known.
+func (md MemberMetadata) describes(id, addr string) bool {
+	if md.ID != "" && id != "" {
+		return md.ID == id
+	}
+	return md.Addr == addr
+}
+
+// supersedes returns `true` if `md` is newer than `known`, the metadata already
+// recorded for the same rank. A captain's versions start again every time it
+// starts, so they are only compared within one incarnation of one captain.
+func (md MemberMetadata) supersedes(known MemberMetadata) bool {
+	if md.ID != known.ID || md.ID == "" && md.Addr != known.Addr {
+		return true
+	}
+	if md.Incarnation != known.Incarnation {
+		return md.Incarnation > known.Incarnation
+	}
+	return md.Version > known.Version
+}
+
+// forgetMetadata removes the metadata of the captain at `addr` with `rank`,
+// once it has been lost.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) forgetMetadata(rank int, addr string) {
+	self := c.Rank()
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	if md, ok := c.metadata[rank]; ok && rank != self && md.Addr == addr {
+		delete(c.metadata, rank)
+	}
+}
+
+// mergeMetadata records any metadata in `fleet` that is newer than what this
+// captain already knows, emitting a `MetadataChanged` event for each update.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) mergeMetadata(fleet []MemberMetadata) {
+	var updated []MemberMetadata
+
+	rank := c.Rank()
+	ids := make(map[int]string)
+	for _, peer := range c.peers.PeerData() {
+		ids[peer.Rank] = peer.ID
+	}
+	c.metaMu.Lock()
+	for _, md := range fleet {
+		// Nobody else knows better about this captain
+		if md.Rank == rank {
+			continue
+		}
+		// The rank has since been taken by another captain
+		if id := ids[md.Rank]; md.ID != "" && id != "" && md.ID != id {
+			continue
+		}
+		if known, ok := c.metadata[md.Rank]; ok && !md.supersedes(known) {
+			continue
+		}
+		md.Metadata = copyMetadata(md.Metadata)
+		c.metadata[md.Rank] = md
+		updated = append(updated, md)
+	}
+	c.metaMu.Unlock()
+
+	for _, md := range updated {
+		log.Debugf("[METADATA] [%s %d] updated to version [%d]", md.Addr, md.Rank, md.Version)
+		c.emit(Event{Type: MetadataChanged, Rank: md.Rank, Addr: md.Addr, Metadata: copyMetadata(md.Metadata)})
+	}
+}
+
+// copyMetadata returns a copy of `metadata`, so that callers can't modify the
+// captain's copy.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,59 @@
+package navy
+
+import (
+	"testing"
+)
+
+func TestMergeMetadata(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Rank, cfg.BindAddress = 3, "captain-3:7946"
+	c := newCaptain(cfg)
+	// A peer that isn't the admiral can be lost without an election
+	c.leaderAddr, c.leaderRank = "captain-3:7946", 3
+
+	addr := "captain-1:7946"
+	zone := func() string {
+		c.metaMu.RLock()
+		defer c.metaMu.RUnlock()
+		return c.metadata[1].Metadata["zone"]
+	}
+	merge := func(id string, incarnation int64, version uint64, z string) {
+		c.mergeMetadata([]MemberMetadata{{Rank: 1, Addr: addr, ID: id, Incarnation: incarnation, Version: version, Metadata: map[string]string{"zone": z}}})
+	}
+
+	merge("id-1", 100, 3, "a")
+	merge("id-1", 100, 2, "stale")
+	if got := zone(); got != "a" {
+		t.Fatalf("older version replaced the metadata, zone is [%s]", got)
+	}
+
+	// A restarted captain starts its versions again, on the same address
+	merge("id-1", 200, 1, "b")
+	if got := zone(); got != "b" {
+		t.Fatalf("metadata of the restarted captain was dropped, zone is [%s]", got)
+	}
+	merge("id-1", 100, 9, "stale")
+	if got := zone(); got != "b" {
+		t.Fatalf("metadata of an earlier start replaced it, zone is [%s]", got)
+	}
+
+	// As does a captain that came back with a new ID
+	c.peers.Add(1, addr, "id-2", nil)
+	merge("id-2", 300, 1, "c")
+	if got := zone(); got != "c" {
+		t.Fatalf("metadata of the new captain was dropped, zone is [%s]", got)
+	}
+	// Metadata of the captain that had the rank before is left over
+	merge("id-1", 400, 5, "stale")
+	if got := zone(); got != "c" {
+		t.Fatalf("metadata of the previous captain replaced it, zone is [%s]", got)
+	}
+
+	c.peerLost(addr, 1)
+	c.metaMu.RLock()
+	_, ok := c.metadata[1]
+	c.metaMu.RUnlock()
+	if ok {
+		t.Error("metadata of the lost peer is still known")
+	}
+}
@@ -0,0 +1,222 @@
+package navy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the counters a captain keeps for its `Collector`.
+type metrics struct {
+	electionsStarted atomic.Uint64
+	electionsWon     atomic.Uint64
+	leaderChanges    atomic.Uint64
+	sendRetries      atomic.Uint64
+	sendFailures     atomic.Uint64
+	discovery        atomic.Int64 // how long the last discovery took (nanoseconds)
+
+	sent     typeCounts // messages sent by this captain
+	received typeCounts // messages received by this captain
+}
+
+// observe counts the events that are exposed as metrics.
+func (m *metrics) observe(e Event) {
+	switch e.Type {
+	case ElectionStarted:
+		m.electionsStarted.Add(1)
+	case ElectionWon:
+		m.electionsWon.Add(1)
+	case LeaderChanged:
+		m.leaderChanges.Add(1)
+	}
+}
+
+// typeCounts counts messages by their type.
+type typeCounts struct {
+	mu     sync.Mutex
+	counts map[int]uint64
+}
+
+// add counts a message of `msgType`.
+//
+// NOTE: This function is thread-safe.
+func (tc *typeCounts) add(msgType int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.counts == nil {
+		tc.counts = make(map[int]uint64)
+	}
+	tc.counts[msgType]++
+}
+
+// snapshot returns a copy of the counts.
+//
+// NOTE: This function is thread-safe.
+func (tc *typeCounts) snapshot() map[int]uint64 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	counts := make(map[int]uint64, len(tc.counts))
+	for t, n := range tc.counts {
+		counts[t] = n
+	}
+	return counts
+}
+
+// typeLabel returns the name of `msgType` for the `type` label, a type from a
+// newer captain is labelled with its number.
+func typeLabel(msgType int) string {
+	if name, ok := MessageStrings[msgType]; ok {
+		return name
+	}
+	return strconv.Itoa(msgType)
+}
+
+// collector is a `struct` implementing `prometheus.Collector` for a captain.
+type collector struct {
+	c *Captain
+
+	rank             *prometheus.Desc
+	leaderRank       *prometheus.Desc
+	isLeader         *prometheus.Desc
+	term             *prometheus.Desc
+	healthy          *prometheus.Desc
+	peers            *prometheus.Desc
+	electionsStarted *prometheus.Desc
+	electionsWon     *prometheus.Desc
+	leaderChanges    *prometheus.Desc
+	messagesSent     *prometheus.Desc
+	messagesReceived *prometheus.Desc
+	sendRetries      *prometheus.Desc
+	sendFailures     *prometheus.Desc
+	discovery        *prometheus.Desc
+}
+
+// Collector returns a `prometheus.Collector` exposing the metrics of this
+// captain, labelled with its callsign so that the captains of several fleets
+// can be registered together. They are also labelled with its ID when the ID
+// is set or saved (see `WithIDFile`), as a random ID would start new series on
+// every restart:
+//
+//	navy_rank                          the rank of this captain
+//	navy_leader_rank                   the rank of the admiral (absent without one)
+//	navy_is_leader                     1 if this captain is the admiral
+//	navy_term                          the current term of the fleet
+//	navy_healthy                       0 while the health check is failing
+//	navy_peers                         the number of connected peers
+//	navy_elections_started_total       elections started by this captain
+//	navy_elections_won_total           elections won by this captain
+//	navy_leader_changes_total          changes of admiral seen by this captain
+//	navy_messages_sent_total           messages sent, by type (once written)
+//	navy_messages_received_total       messages received, by type
+//	navy_send_retries_total            retried writes to a peer from `Send`
+//	navy_send_failures_total           messages `Send` gave up on
+//	navy_discovery_duration_seconds    how long discovering the fleet took (absent until it has)
+func (c *Captain) Collector() prometheus.Collector {
+	labels := prometheus.Labels{"callsign": c.callsign}
+	if c.idPersisted {
+		labels["id"] = c.id
+	}
+	desc := func(name, help string, variable ...string) *prometheus.Desc {
+		return prometheus.NewDesc("navy_"+name, help, variable, labels)
+	}
+	return &collector{
+		c:                c,
+		rank:             desc("rank", "The rank of this captain."),
+		leaderRank:       desc("leader_rank", "The rank of the admiral of the fleet."),
+		isLeader:         desc("is_leader", "Whether this captain is the admiral (1) or not (0)."),
+		term:             desc("term", "The current term of the fleet."),
+		healthy:          desc("healthy", "Whether the health check of this captain is passing (1) or not (0)."),
+		peers:            desc("peers", "The number of peers this captain is connected to."),
+		electionsStarted: desc("elections_started_total", "The number of elections started by this captain."),
+		electionsWon:     desc("elections_won_total", "The number of elections won by this captain."),
+		leaderChanges:    desc("leader_changes_total", "The number of times the admiral of the fleet has changed."),
+		messagesSent:     desc("messages_sent_total", "The number of messages sent, by type.", "type"),
+		messagesReceived: desc("messages_received_total", "The number of messages received, by type.", "type"),
+		sendRetries:      desc("send_retries_total", "The number of writes to a peer that were retried."),
+		sendFailures:     desc("send_failures_total", "The number of messages that couldn't be sent to a peer."),
+		discovery:        desc("discovery_duration_seconds", "How long discovering the fleet took."),
+	}
+}
+
+// Describe implements `prometheus.Collector`.
+func (col *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- col.rank
+	ch <- col.leaderRank
+	ch <- col.isLeader
+	ch <- col.term
+	ch <- col.healthy
+	ch <- col.peers
+	ch <- col.electionsStarted
+	ch <- col.electionsWon
+	ch <- col.leaderChanges
+	ch <- col.messagesSent
+	ch <- col.messagesReceived
+	ch <- col.sendRetries
+	ch <- col.sendFailures
+	ch <- col.discovery
+}
+
+// Collect implements `prometheus.Collector`.
+func (col *collector) Collect(ch chan<- prometheus.Metric) {
+	c := col.c
+	gauge := func(desc *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+	}
+	counter := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+	boolean := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	c.mu.RLock()
+	rank, leaderRank, leaderAddr, leading, term, abstaining := c.rank, c.leaderRank, c.leaderAddr, c.leading, c.term, c.abstaining
+	c.mu.RUnlock()
+
+	gauge(col.rank, float64(rank))
+	if leaderAddr != "" {
+		gauge(col.leaderRank, float64(leaderRank))
+	}
+	gauge(col.isLeader, boolean(leading))
+	gauge(col.term, float64(term))
+	gauge(col.healthy, boolean(!abstaining))
+	gauge(col.peers, float64(len(c.peers.PeerData())))
+
+	m := &c.metrics
+	counter(col.electionsStarted, m.electionsStarted.Load())
+	counter(col.electionsWon, m.electionsWon.Load())
+	counter(col.leaderChanges, m.leaderChanges.Load())
+	for t, n := range m.sent.snapshot() {
+		counter(col.messagesSent, n, typeLabel(t))
+	}
+	for t, n := range m.received.snapshot() {
+		counter(col.messagesReceived, n, typeLabel(t))
+	}
+	counter(col.sendRetries, m.sendRetries.Load())
+	counter(col.sendFailures, m.sendFailures.Load())
+	if d := m.discovery.Load(); d != 0 {
+		gauge(col.discovery, time.Duration(d).Seconds())
+	}
+}
+
+// MetricsHandler returns an `http.Handler` serving the metrics of this
+// captain (along with the Go runtime and process metrics) in the Prometheus
+// text format, to be mounted on `/metrics`.
+func (c *Captain) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		c.Collector(),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
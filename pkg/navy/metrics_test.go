@@ -0,0 +1,79 @@
+package navy
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// brokenEncoder fails every write, as a connection that has gone away does.
+type brokenEncoder struct{}
+
+func (brokenEncoder) Encode(interface{}) error {
+	return errors.New("connection reset")
+}
+
+func TestSentCountedOnceWritten(t *testing.T) {
+	c, err := New(WithRank(1), WithCallSign("test"), WithBindAddress("captain-1:7946"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err = c.encode(brokenEncoder{}, &Message{Type: HEARTBEAT}, ""); err == nil {
+		t.Fatal("write to a broken connection succeeded")
+	}
+	if err = c.write(2, &Message{Type: HEARTBEAT}, "captain-2:7946"); err == nil {
+		t.Fatal("write to an unknown peer succeeded")
+	}
+	if n := c.metrics.sent.snapshot()[HEARTBEAT]; n != 0 {
+		t.Fatalf("[%d] failed writes were counted as sent", n)
+	}
+
+	if err = c.encode(&frameEncoder{w: io.Discard, codec: c.codec}, &Message{Type: HEARTBEAT}, ""); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if n := c.metrics.sent.snapshot()[HEARTBEAT]; n != 1 {
+		t.Errorf("sent = %d, want 1", n)
+	}
+}
+
+func TestCollectorIDLabel(t *testing.T) {
+	labels := func(opts ...Option) map[string]string {
+		t.Helper()
+		c, err := New(append([]Option{WithRank(1), WithCallSign("test"), WithBindAddress("captain-1:7946")}, opts...)...)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.Collector())
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Gather: %v", err)
+		}
+		for _, mf := range families {
+			if mf.GetName() != "navy_rank" {
+				continue
+			}
+			found := map[string]string{}
+			for _, lp := range mf.GetMetric()[0].GetLabel() {
+				found[lp.GetName()] = lp.GetValue()
+			}
+			return found
+		}
+		t.Fatal("navy_rank wasn't collected")
+		return nil
+	}
+
+	// A random ID would start new series on every restart
+	if id, ok := labels()["id"]; ok {
+		t.Errorf("metrics are labelled with the random ID [%s]", id)
+	}
+	if id := labels(WithID("captain-1"))["id"]; id != "captain-1" {
+		t.Errorf("id label = [%s], want [captain-1]", id)
+	}
+	if id := labels(WithIDFile(t.TempDir() + "/id"))["id"]; id == "" {
+		t.Error("metrics aren't labelled with the saved ID")
+	}
+}
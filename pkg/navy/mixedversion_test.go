@@ -0,0 +1,192 @@
+package navy
+
+import (
+	"encoding/gob"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// legacy returns `m` as a captain from before the `HELLO` handshake decodes
+// it, with only the fields that it knows about.
+func (m *Message) legacy() *Message {
+	old := &Message{Rank: m.Rank, Addr: m.Addr, Type: m.Type, CallSign: m.CallSign, OneShot: m.OneShot, Payload: m.Payload}
+	for _, peer := range m.Peers {
+		peer.ID = ""
+		old.Peers = append(old.Peers, peer)
+	}
+	return old
+}
+
+// legacyTransport makes a captain speak as one from before the framed
+// protocol. The captain is given one end of an in-memory connection, and the
+// plain gob stream of a legacy captain is spoken on its behalf at the other:
+// greetings are never sent or answered, and only the fields and types from
+// before the `HELLO` handshake get through.
+type legacyTransport struct {
+	Transport
+
+	mu      sync.Mutex
+	unknown map[int]int // types the captain was sent that it doesn't understand
+}
+
+func newLegacyTransport(t Transport) *legacyTransport {
+	return &legacyTransport{Transport: t, unknown: make(map[int]int)}
+}
+
+func (t *legacyTransport) Listen(addr string) (net.Listener, error) {
+	l, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &legacyListener{Listener: l, transport: t}, nil
+}
+
+// Dial connects to `addr` without greeting it, the captain waits for a
+// greeting that never comes and falls back to gob.
+func (t *legacyTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	captain, legacy := newMemoryConnPair(conn.LocalAddr(), conn.RemoteAddr())
+	go t.translate(legacy, conn, false)
+	go discard(conn, legacy)
+	return captain, nil
+}
+
+// unknownTypes returns the number of each message type the captain was sent
+// that a legacy captain doesn't understand.
+func (t *legacyTransport) unknownTypes() map[int]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unknown := make(map[int]int)
+	for msgType, n := range t.unknown {
+		unknown[msgType] = n
+	}
+	return unknown
+}
+
+// translate decodes messages from `from` and writes them to `to` as a legacy
+// captain sees them, until either connection is closed. Types a legacy captain
+// doesn't understand are dropped, and counted when they're `received`.
+func (t *legacyTransport) translate(from, to net.Conn, received bool) {
+	defer from.Close()
+	defer to.Close()
+	dec, enc := gob.NewDecoder(from), gob.NewEncoder(to)
+	for {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Type > legacyTypes {
+			if received {
+				t.mu.Lock()
+				t.unknown[msg.Type]++
+				t.mu.Unlock()
+			}
+			continue
+		}
+		if err := enc.Encode(msg.legacy()); err != nil {
+			return
+		}
+	}
+}
+
+// discard reads and drops everything from `from`, which a legacy captain
+// never reads, until either connection is closed.
+func discard(from, to net.Conn) {
+	defer from.Close()
+	defer to.Close()
+	_, _ = io.Copy(io.Discard, from)
+}
+
+// legacyListener accepts connections for a legacy captain, which never greets
+// them.
+type legacyListener struct {
+	net.Listener
+	transport *legacyTransport
+}
+
+func (l *legacyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	legacy, captain := newMemoryConnPair(conn.RemoteAddr(), conn.LocalAddr())
+	go l.transport.translate(conn, legacy, true)
+	go discard(legacy, conn)
+	return captain, nil
+}
+
+// startLegacy starts a captain with `rank` that only speaks as a captain from
+// before the framed protocol, and runs it until the end of the test.
+func (f *testFleet) startLegacy(rank int, opts ...Option) (*Captain, *legacyTransport) {
+	f.t.Helper()
+	t := newLegacyTransport(&partitionTransport{fleet: f, addr: f.addr(rank)})
+	c := f.start(rank, append(opts, WithTransport(t))...)
+	return c, t
+}
+
+func TestMixedVersionFleet(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+
+	// Legacy and current captains join through each other
+	old100, t100 := f.startLegacy(100, WithReady(true))
+	waitForLeader(t, 100, old100)
+	new80 := f.start(80, WithFleet(f.addr(100)))
+	waitForLeader(t, 100, old100, new80)
+	old50, t50 := f.startLegacy(50, WithFleet(f.addr(80)))
+	waitForLeader(t, 100, old100, new80, old50)
+	new120 := f.start(120, WithFleet(f.addr(50)))
+	waitForLeader(t, 120, old100, new80, old50, new120)
+
+	if !new80.isLegacy(f.addr(100)) || !new120.isLegacy(f.addr(50)) {
+		t.Error("legacy captains weren't spoken to with gob")
+	}
+	if new80.isLegacy(f.addr(120)) {
+		t.Error("current captains fell back to gob between themselves")
+	}
+
+	// A legacy captain takes over when the current admiral leaves
+	new120.LeaveFleet()
+	waitForLeader(t, 100, old100, new80, old50)
+
+	// A current captain joining through a legacy captain is elected admiral
+	new130 := f.start(130, WithFleet(f.addr(100)))
+	waitForLeader(t, 130, old100, new80, old50, new130)
+
+	new130.LeaveFleet()
+	waitForLeader(t, 100, old100, new80, old50)
+
+	// Nothing a legacy captain doesn't understand was sent to it
+	for rank, lt := range map[int]*legacyTransport{100: t100, 50: t50} {
+		for msgType, n := range lt.unknownTypes() {
+			t.Errorf("captain [%d] was sent [%d] [%s] messages", rank, n, MessageStrings[msgType])
+		}
+	}
+}
+
+func TestLegacyMessage(t *testing.T) {
+	msg := &Message{Rank: 2, Addr: "captain-2:7946", ID: "id-2", Type: ADMIRAL, CallSign: "fleet", Term: 3, Payload: "payload", Data: []byte("payload"), PayloadVersion: 1}
+	msg.Peers = append(msg.Peers, struct {
+		Rank  int
+		Addr  string
+		Ready bool
+		ID    string
+	}{Rank: 1, Addr: "captain-1:7946", Ready: true, ID: "id-1"})
+
+	// A legacy captain only knows the fields from before the handshake
+	old := msg.legacy()
+	if old.ID != "" || old.Term != 0 || old.Data != nil || old.PayloadVersion != 0 || old.Peers[0].ID != "" {
+		t.Errorf("newer fields were kept: %+v", old)
+	}
+	if old.Rank != 2 || old.Addr != msg.Addr || old.Type != ADMIRAL || old.CallSign != "fleet" || old.Payload != "payload" || !old.Peers[0].Ready {
+		t.Errorf("legacy fields were lost: %+v", old)
+	}
+	if msg.Peers[0].ID != "id-1" {
+		t.Error("the original message was changed")
+	}
+}
@@ -1,7 +1,7 @@
 package navy
 
 import (
-	"encoding/gob"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -11,32 +11,113 @@ import (
 )
 
 // receive is a helper function handling communication between `Peer`s
-// and `b`. It creates a `gob.Decoder` and a from a `io.ReadCloser`. Each
+// and `b`. It creates a decoder for the protocol the peer speaks from a
+// `net.Conn`. Each
 // `Message` received that is not of type `CLOSE` or `OK` is pushed to
 // `b.receiveChan`.
 //
-// NOTE: this function is an infinite loop.
-func (c *Captain) receive(rwc io.ReadCloser) {
+// NOTE: this function loops until the connection is closed or the captain
+// quits.
+func (c *Captain) receive(rwc net.Conn) {
+	defer c.wg.Done()
+	c.trackConn(rwc)
+	defer c.untrackConn(rwc)
+
+	// A peer that fails the handshake never becomes part of the fleet
+	if conn, ok := rwc.(*tls.Conn); ok {
+		if err := c.acceptTLS(conn); err != nil {
+			_ = rwc.Close()
+			return
+		}
+	}
+
+	dec, err := c.accept(rwc)
+	if err != nil {
+		_ = rwc.Close()
+		c.protocolRejected(err)
+		return
+	}
+	// A client is answered on the connection it sent its command over
+	var reply encoder
+	if fd, ok := dec.(*frameDecoder); ok {
+		reply = &frameEncoder{w: rwc, codec: fd.codec}
+	}
+
 	var msg Message
-	dec := gob.NewDecoder(rwc)
 	for {
-		err := dec.Decode(&msg)
+		// Decode into a fresh message, as gob leaves absent fields untouched
+		var next Message
+		err = dec.Decode(&next)
+		if err == nil {
+			// Forged or replayed messages are dropped before they're acted upon
+			if !c.authentic(&next) {
+				continue
+			}
+			msg = next
+			c.metrics.received.add(msg.Type)
+			c.identify(msg)
+		}
 		log.Debugf("[RECEIVE] OneShot [%t] From [%s] Type [%s] err [%v]", msg.OneShot, msg.Addr, MessageStrings[msg.Type], err)
-		if err == io.EOF || msg.Type == CLOSE {
+		if err != nil || msg.Type == CLOSE {
 			_ = rwc.Close()
-			//check if this is an actual peer
-			if c.peers.Find(Peer{addr: msg.Addr, rank: msg.Rank}) {
-				log.Warnf("[PEER] lost [%s] Rank [%d] leaderRank [%d]", msg.Addr, msg.Rank, c.LeaderRank())
-				c.peers.Delete(msg.Rank)
-				// Check if this peer was the leader!
-				if msg.Rank >= c.LeaderRank() {
-					log.Errorf("[LEADER] lost [%s] ID [%d]", msg.Addr, msg.Rank)
-					c.ResetLeader(msg.Addr, msg.Rank)
-					c.Elect()
-				}
+			select {
+			case <-c.quit:
+				// We're shutting down, so there is no leader to reset
+				return
+			default:
+			}
+			if err != nil && err != io.EOF {
+				log.Debugf("[RECEIVE] closing connection [%v]", err)
 			}
+			c.peerLost(msg.Addr, msg.Rank)
+			return
+		}
 
-			break
+		// Any message over a peer connection shows that the peer is alive
+		if !msg.OneShot && msg.Type != LEADER {
+			c.peers.Seen(msg.Rank, msg.Addr)
+		}
+
+		// The admiral and its term are checked when the message is handled, and a
+		// proposal doesn't move the term on until it has been committed
+		if msg.Type != ADMIRAL && msg.Type != LEADER && msg.Type != PROPOSE {
+			c.observeTerm(msg.Term)
+		}
+
+		if _, ok := MessageStrings[msg.Type]; !ok {
+			// A newer captain may send types we don't know about yet
+			log.Debugf("[RECEIVE] ignoring unknown message type [%d] from [%s %d]", msg.Type, msg.Addr, msg.Rank)
+			continue
+		}
+
+		if msg.Type == HEARTBEAT_ACK {
+			continue
+		} else if msg.Type == HELLO {
+			c.recordHello(msg)
+		} else if msg.Type == METADATA {
+			c.mergeMetadata(msg.Metadata)
+		} else if msg.Type == LEASE || msg.Type == LEASE_ACK || msg.Type == STALE {
+			c.handleLease(msg)
+		} else if msg.Type == CONTROL {
+			c.control(msg, reply)
+		} else if msg.Type == PROPOSE {
+			// Replied to straight away, as the proposer only waits so long
+			c.proposed(msg)
+		} else if msg.Type == HEARTBEAT {
+			err = c.Send(msg.Rank, msg.Addr, HEARTBEAT_ACK)
+			if err != nil {
+				log.Error(err)
+			}
+		} else if msg.Type == ADMIRAL_ACK {
+			select {
+			case c.admiralAckChan <- msg:
+			default:
+			}
+		} else if msg.Type == TRANSFER_ACK {
+			select {
+			case c.transferChan <- msg:
+			default:
+			}
 		} else if msg.Type == OK {
 			select {
 			case c.electionChan <- msg:
@@ -44,22 +125,55 @@ func (c *Captain) receive(rwc io.ReadCloser) {
 			case <-time.After(200 * time.Millisecond):
 				continue
 			}
-		} else if msg.Type == LEADER || msg.Type == PEERLIST || msg.Type == UNREADY || msg.Type == UNKNOWN {
-			c.discoverChan <- msg
+		} else if msg.Type == LEADER || msg.Type == PEERLIST || msg.Type == UNREADY || msg.Type == UNKNOWN || msg.Type == DUPLICATE || msg.Type == CONTROL_ACK {
+			select {
+			case c.discoverChan <- msg:
+			case <-c.quit:
+				return
+			}
 		} else {
-			c.receiveChan <- msg
+			select {
+			case c.receiveChan <- msg:
+			case <-c.quit:
+				return
+			}
 		}
 	}
 }
 
+// trackConn records an accepted connection so that it can be closed when the
+// captain shuts down.
+func (c *Captain) trackConn(conn io.Closer) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.conns[conn] = struct{}{}
+}
+
+// untrackConn removes an accepted connection once it has been closed.
+func (c *Captain) untrackConn(conn io.Closer) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	delete(c.conns, conn)
+}
+
+// closeConns closes all of the accepted connections, unblocking any
+// `receive` goroutines.
+func (c *Captain) closeConns() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	for conn := range c.conns {
+		_ = conn.Close()
+	}
+}
+
 // listen is a helper function that spawns goroutines handling new `Peers`
 // connections to `b`'s socket.
 //
-// NOTE: this function is an infinite loop.
+// NOTE: this function loops until the captain quits.
 func (c *Captain) listen() {
 	defer c.wg.Done()
 	for {
-		conn, err := c.AcceptTCP()
+		conn, err := c.listener.Accept()
 		if err != nil {
 			select {
 			case <-c.quit:
@@ -70,66 +184,92 @@ func (c *Captain) listen() {
 		} else {
 			c.wg.Add(1)
 			go c.receive(conn)
-			c.wg.Done()
 		}
 	}
 }
 
-// Listen makes `b` listens on the address `addr` provided using the protocol
-// `proto` and returns an `error` if something occurs.
+// Listen makes `b` listens on the address `addr` using its `Transport` and
+// returns an `error` if something occurs.
 func (c *Captain) Listen() error {
-	laddr, err := net.ResolveTCPAddr(c.proto, c.bindaddr)
-	if err != nil {
-		return fmt.Errorf("Listen: %v", err)
-	}
-	c.TCPListener, err = net.ListenTCP(c.proto, laddr)
+	l, err := c.transport.Listen(c.bindaddr)
 	if err != nil {
-		return fmt.Errorf("Listen: %v", err)
+		return err
 	}
+	c.listener = l
 	c.wg.Add(1)
 	go c.listen()
 	return nil
 }
 
-// connect is a helper function that resolves the tcp address `addr` and try
-// to establish a tcp connection using the protocol `proto`. The established
-// connection is set to `c.peers[ID]` or the function returns an `error`
-// if something occurs.
+// connect is a helper function that tries to establish a connection to `addr`
+// using the captain's `Transport`. The established connection is set to
+// `c.peers[id]`, where `id` is the unique ID of the captain or empty if it
+// isn't known yet, or the function returns an `error` if something occurs.
 //
-// NOTE: In the case `ID` already exists in `c.peers`, the new connection
-// replaces the old one.
-func (c *Captain) connect(proto, addr string, rank int) error {
-	if c.peers.Find(Peer{addr: addr, rank: rank}) {
+// NOTE: In the case `id` or `rank` already exists in `c.peers`, the new
+// connection replaces the old one.
+func (c *Captain) connect(addr string, rank int, id string) error {
+	if c.peers.Find(Peer{addr: addr, rank: rank, id: id}) {
 		log.Debugf("[CONNECT] member already exists [%d]", rank)
 		return nil
 	}
+	// A second captain with the same rank would replace the first
+	if owner, ok := c.duplicate(rank, addr); ok {
+		return fmt.Errorf("connect: %w, rank [%d] of [%s] belongs to [%s]", ErrDuplicateRank, rank, addr, owner)
+	}
 	log.Debugf("[CONNECT] -> [%s]", addr)
-	raddr, err := net.ResolveTCPAddr(proto, addr)
+	sock, err := c.dial(addr)
 	if err != nil {
-		return fmt.Errorf("connect: %v", err)
+		return err
 	}
-	sock, err := net.DialTCP(proto, nil, raddr)
-	if err != nil {
-		return fmt.Errorf("connect: %v", err)
+	c.peers.Add(rank, addr, id, sock)
+	if _, ok := sock.(*protocolConn); ok {
+		if err = c.hello(rank, addr); err != nil {
+			log.Debugf("[HELLO] [%s %d] %v", addr, rank, err)
+		}
+		err = c.write(rank, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: METADATA, CallSign: c.callsign, Term: c.Term(), Metadata: c.selfMetadata()}, addr)
+		if err != nil {
+			log.Debugf("[METADATA] [%s %d] %v", addr, rank, err)
+		}
 	}
-	c.peers.Add(rank, addr, sock, sock)
+	c.emit(Event{Type: PeerJoined, Rank: rank, Addr: addr})
 	log.Debugf("[PEERLIST] %v", c.peers.PeerData())
 	return nil
 }
 
 // Connect performs a connection to the remote `Peer`s.
-func (c *Captain) Connect(proto string, peers map[int]string) {
+func (c *Captain) Connect(peers map[int]string) {
 	for Rank, addr := range peers {
-		if c.rank == Rank {
+		if c.Rank() == Rank {
 			continue
 		}
-		if err := c.connect(proto, addr, Rank); err != nil {
+		if err := c.connect(addr, Rank, ""); err != nil {
 			log.Errorf("[Connect] %v", err)
 			c.peers.Delete(Rank)
 		}
 	}
 }
 
+// write seals `msg` for the peer `rank` at `addr` and writes it to the peer,
+// it is only counted as sent once the write succeeds.
+func (c *Captain) write(rank int, msg *Message, addr string) error {
+	if err := c.peers.Write(rank, c.seal(msg, addr)); err != nil {
+		return err
+	}
+	c.metrics.sent.add(msg.Type)
+	return nil
+}
+
+// encode seals `msg` for the captain at `to` and encodes it on `e`, it is only
+// counted as sent once it has been written.
+func (c *Captain) encode(e encoder, msg *Message, to string) error {
+	if err := e.Encode(c.seal(msg, to)); err != nil {
+		return err
+	}
+	c.metrics.sent.add(msg.Type)
+	return nil
+}
+
 // Send sends a `captain.Message` of type `what` to `c.peer[to]` at the address
 // `addr`. If no connection is reachable at `addr` or if `c.peer[to]` does not
 // exist, the function retries five times and returns an `error` if it does not
@@ -138,37 +278,54 @@ func (c *Captain) Send(rank int, addr string, msg int) error {
 
 	if !c.peers.Find(Peer{addr: addr, rank: rank}) {
 		log.Debugf("[SEND] Didn't find [%d]", rank)
-		err := c.connect("tcp4", addr, rank)
+		err := c.connect(addr, rank, "")
 		if err != nil {
 			log.Error(err)
 		}
 	}
+	if !c.supports(addr, msg) {
+		log.Debugf("[SEND] [%s %d] doesn't support [%s]", addr, rank, MessageStrings[msg])
+		return nil
+	}
 	var err error
 	for attempts := 0; ; attempts++ {
 		switch msg {
 		case PEERLIST:
-			err = c.peers.Write(rank, &Message{Rank: c.rank, Addr: c.extaddr, Peers: c.peers.PeerData(), Type: msg, CallSign: c.callsign})
+			err = c.write(rank, &Message{Rank: c.Rank(), Addr: c.extaddr, Peers: c.peers.PeerData(), Metadata: c.fleetMetadata(), Type: msg, CallSign: c.callsign, Term: c.Term()}, addr)
 			if err != nil {
 				log.Error(err)
 			}
 		case LEADER:
 			log.Infof("[LEADER] informing %s of leader %s %d", addr, c.LeaderAddress(), c.LeaderRank())
-			err = c.peers.Write(rank, &Message{Rank: c.LeaderRank(), Addr: c.LeaderAddress(), Type: msg, CallSign: c.callsign, Payload: c.internalPayload}) //TODO: check if payload is needed here otherwise we're sending more data than needed
+			payload, version := c.LeaderPayload()
+			err = c.write(rank, c.withPayload(&Message{Rank: c.LeaderRank(), Addr: c.LeaderAddress(), ID: c.LeaderID(), Type: msg, CallSign: c.callsign, Term: c.Term()}, addr, payload, version), addr)
+			if err != nil {
+				log.Error(err)
+			}
+		case METADATA:
+			err = c.write(rank, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term(), Metadata: c.selfMetadata()}, addr)
+			if err != nil {
+				log.Error(err)
+			}
+		case STATE_SNAPSHOT:
+			entries, seq := c.stateSnapshot()
+			err = c.write(rank, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term(), Seq: seq, Entries: entries}, addr)
 			if err != nil {
 				log.Error(err)
 			}
 		case PEERS:
-			err = c.peers.Write(rank, &Message{Rank: c.rank, Addr: c.extaddr, Type: msg, CallSign: c.callsign})
+			err = c.write(rank, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term()}, addr)
 			if err != nil {
 				log.Error(err)
 			}
-		case ADMIRAL:
-			err = c.peers.Write(rank, &Message{Rank: c.rank, Addr: c.extaddr, Type: msg, CallSign: c.callsign, Payload: c.internalPayload})
+		case ADMIRAL, PAYLOAD_UPDATE, TRANSFER_ACK:
+			payload, version := c.Payload()
+			err = c.write(rank, c.withPayload(&Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term()}, addr, payload, version), addr)
 			if err != nil {
 				log.Error(err)
 			}
 		default:
-			err = c.peers.Write(rank, &Message{Rank: c.rank, Addr: c.extaddr, Type: msg, CallSign: c.callsign})
+			err = c.write(rank, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term()}, addr)
 			if err != nil {
 				log.Error(err)
 			}
@@ -178,9 +335,11 @@ func (c *Captain) Send(rank int, addr string, msg int) error {
 			break
 		}
 		if attempts > maxRetries && err != nil {
+			c.metrics.sendFailures.Add(1)
 			return fmt.Errorf("Send: %v", err)
 		}
-		err = c.connect("tcp4", addr, rank)
+		c.metrics.sendRetries.Add(1)
+		err = c.connect(addr, rank, "")
 		if err != nil {
 			log.Error(err)
 		}
@@ -190,54 +349,58 @@ func (c *Captain) Send(rank int, addr string, msg int) error {
 }
 
 func (c *Captain) SendOneShot(addr string, msg int) error {
-	raddr, err := net.ResolveTCPAddr(c.proto, addr)
+	sock, err := c.dial(addr)
 	if err != nil {
-		return fmt.Errorf("connect: %v", err)
-	}
-	sock, err := net.DialTCP(c.proto, nil, raddr)
-	if err != nil {
-		return fmt.Errorf("connect: %v", err)
+		return err
 	}
 	log.Debugf("[CONNECT] -> [%s], for discovery", addr)
 
-	defer sock.Close()
-	encoder := gob.NewEncoder(sock)
+	defer func() {
+		_ = sock.Close()
+	}()
+	encoder := newEncoder(sock)
 
+	to := addr
+	if msg == WHOISLEADER {
+		// A seed may be known by another address than the one it advertises
+		to = ""
+	}
 	for attempts := 0; ; attempts++ {
 		switch msg {
 		case PEERLIST:
-			err = encoder.Encode(&Message{Rank: c.rank, Addr: c.extaddr, Peers: c.peers.PeerData(), Type: msg, CallSign: c.callsign, OneShot: true})
+			err = c.encode(encoder, &Message{Rank: c.Rank(), Addr: c.extaddr, Peers: c.peers.PeerData(), Metadata: c.fleetMetadata(), Type: msg, CallSign: c.callsign, Term: c.Term(), OneShot: true}, to)
 			if err != nil {
 				log.Error(err)
 			}
 		case LEADER:
 			if c.LeaderAddress() == "" {
 				log.Warnf("[LEADER] unable to informing [%s] of a LEADER as one currently doesn't exist", addr)
-				err = encoder.Encode(&Message{Rank: c.LeaderRank(), Addr: c.LeaderAddress(), Type: UNREADY, CallSign: c.callsign, OneShot: true})
+				err = c.encode(encoder, &Message{Rank: c.LeaderRank(), Addr: c.LeaderAddress(), Type: UNREADY, CallSign: c.callsign, Term: c.Term(), OneShot: true}, to)
 				if err != nil {
 					log.Error(err)
 				}
 			} else {
 				log.Infof("[LEADER] informing %s of leader %s %d", addr, c.LeaderAddress(), c.LeaderRank())
-				err = encoder.Encode(&Message{Rank: c.LeaderRank(), Addr: c.LeaderAddress(), Type: msg, CallSign: c.callsign, OneShot: true})
+				payload, version := c.LeaderPayload()
+				err = c.encode(encoder, c.withPayload(&Message{Rank: c.LeaderRank(), Addr: c.LeaderAddress(), ID: c.LeaderID(), Type: msg, CallSign: c.callsign, Term: c.Term(), OneShot: true}, addr, payload, version), to)
 				if err != nil {
 					log.Error(err)
 				}
 			}
 		case PEERS:
-			err = encoder.Encode(&Message{Rank: c.rank, Addr: c.extaddr, Type: msg, CallSign: c.callsign, OneShot: true})
+			err = c.encode(encoder, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term(), OneShot: true}, to)
 			if err != nil {
 				log.Error(err)
 			}
 		case UNKNOWN:
 			log.Infof("[UNKNOWN] informing %s of leader %s %d", addr, c.LeaderAddress(), c.LeaderRank())
 
-			err = encoder.Encode(&Message{Rank: c.rank, Addr: c.extaddr, Type: msg, CallSign: c.callsign})
+			err = c.encode(encoder, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term()}, to)
 			if err != nil {
 				log.Error(err)
 			}
 		default:
-			err = encoder.Encode(&Message{Rank: c.rank, Addr: c.extaddr, Type: msg, CallSign: c.callsign})
+			err = c.encode(encoder, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: msg, CallSign: c.callsign, Term: c.Term()}, to)
 			if err != nil {
 				log.Error(err)
 			}
@@ -249,13 +412,14 @@ func (c *Captain) SendOneShot(addr string, msg int) error {
 		if attempts > maxRetries && err != nil {
 			return fmt.Errorf("Send: %v", err)
 		}
-		sock, err := net.DialTCP(c.proto, nil, raddr)
+		_ = sock.Close()
+		sock, err = c.dial(addr)
 		if err != nil {
-			return fmt.Errorf("connect: %v", err)
+			return err
 		}
-		encoder = gob.NewEncoder(sock)
+		encoder = newEncoder(sock)
 		time.Sleep(100 * time.Millisecond)
 	}
 	// Send a close message as this is a oneshot
-	return encoder.Encode(&Message{Rank: c.rank, Addr: c.extaddr, Type: CLOSE, CallSign: c.callsign})
+	return c.encode(encoder, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: CLOSE, CallSign: c.callsign, Term: c.Term()}, to)
 }
@@ -0,0 +1,164 @@
+package navy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxPayloadSize is the largest payload a captain accepts, unless
+// `Config.MaxPayloadSize` says otherwise.
+const DefaultMaxPayloadSize = 64 << 10
+
+// ErrPayloadTooLarge is returned when a payload exceeds the maximum size.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// SetPayloadBytes sets the payload transmitted by this captain when it leads,
+// every change increments the payload version. If this captain is the admiral
+// then the fleet is sent the new payload straight away.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) SetPayloadBytes(payload []byte) error {
+	if len(payload) > c.maxPayloadSize {
+		return fmt.Errorf("SetPayloadBytes: %w, [%d] bytes exceeds [%d]", ErrPayloadTooLarge, len(payload), c.maxPayloadSize)
+	}
+	payload = append([]byte(nil), payload...)
+
+	c.mu.Lock()
+	c.internalPayload = payload
+	c.payloadVersion++
+	version, leading, term := c.payloadVersion, c.leading, c.term
+	if leading {
+		c.leaderPayload = payload
+		c.leaderPayloadVersion = version
+	}
+	c.mu.Unlock()
+
+	if !leading {
+		return nil
+	}
+	log.Debugf("[PAYLOAD] updating the fleet to version [%d]", version)
+	c.emit(Event{Type: PayloadChanged, Rank: c.Rank(), Addr: c.extaddr, Payload: string(payload), PayloadVersion: version, Term: term})
+	for _, peer := range c.peers.PeerData() {
+		if err := c.Send(peer.Rank, peer.Addr, PAYLOAD_UPDATE); err != nil {
+			log.Errorf("[PAYLOAD] [%s %d] %v", peer.Addr, peer.Rank, err)
+		}
+	}
+	return nil
+}
+
+// SetPayload sets the payload transmitted by this captain when it leads.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) SetPayload(payload string) {
+	if err := c.SetPayloadBytes([]byte(payload)); err != nil {
+		log.Error(err)
+	}
+}
+
+// Payload returns the payload of this captain and its version.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) Payload() ([]byte, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]byte(nil), c.internalPayload...), c.payloadVersion
+}
+
+// LeaderPayload returns the payload of the admiral and its version.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) LeaderPayload() ([]byte, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]byte(nil), c.leaderPayload...), c.leaderPayloadVersion
+}
+
+// GetLeaderPayload returns the payload of the admiral as a `string`.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) GetLeaderPayload() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return string(c.leaderPayload)
+}
+
+// SetPayloadValue sets the payload of `c` to `v` encoded as JSON.
+func SetPayloadValue[T any](c *Captain, v T) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("SetPayloadValue: %v", err)
+	}
+	return c.SetPayloadBytes(payload)
+}
+
+// LeaderPayloadValue decodes the JSON payload of the admiral known to `c`,
+// along with its version.
+func LeaderPayloadValue[T any](c *Captain) (T, uint64, error) {
+	var v T
+	payload, version := c.LeaderPayload()
+	if len(payload) == 0 {
+		return v, version, nil
+	}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return v, version, fmt.Errorf("LeaderPayloadValue: %v", err)
+	}
+	return v, version, nil
+}
+
+// updateLeaderPayload applies a `PAYLOAD_UPDATE` from the admiral, updates
+// from anyone else or older than the payload we have are ignored.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) updateLeaderPayload(msg Message) {
+	payload := msg.payload()
+	if len(payload) > c.maxPayloadSize {
+		log.Warnf("[PAYLOAD] ignoring [%d] bytes from [%s %d], exceeds [%d]", len(payload), msg.Addr, msg.Rank, c.maxPayloadSize)
+		return
+	}
+
+	c.mu.Lock()
+	if msg.Rank != c.leaderRank || msg.Addr != c.leaderAddr {
+		c.mu.Unlock()
+		log.Debugf("[PAYLOAD] ignoring update from [%s %d], not the admiral", msg.Addr, msg.Rank)
+		return
+	}
+	if msg.PayloadVersion <= c.leaderPayloadVersion {
+		c.mu.Unlock()
+		log.Debugf("[PAYLOAD] ignoring version [%d], already have [%d]", msg.PayloadVersion, c.leaderPayloadVersion)
+		return
+	}
+	c.leaderPayload = payload
+	c.leaderPayloadVersion = msg.PayloadVersion
+	term := c.term
+	c.mu.Unlock()
+
+	log.Debugf("[PAYLOAD] updated to version [%d] from [%s %d]", msg.PayloadVersion, msg.Addr, msg.Rank)
+	c.emit(Event{Type: PayloadChanged, Rank: msg.Rank, Addr: msg.Addr, Payload: string(payload), PayloadVersion: msg.PayloadVersion, Term: term})
+}
+
+// withPayload attaches `payload` to `msg` for the peer at `addr`, a peer from
+// before versioned payloads only understands a `string`.
+func (c *Captain) withPayload(msg *Message, addr string, payload []byte, version uint64) *Message {
+	if c.supports(addr, PAYLOAD_UPDATE) {
+		msg.Data = payload
+		msg.PayloadVersion = version
+	} else {
+		msg.Payload = string(payload)
+	}
+	return msg
+}
+
+// payload returns the payload carried by the message, from either `Data` or
+// the `Payload` string of an older captain.
+func (m *Message) payload() []byte {
+	if m.Data != nil || m.PayloadVersion != 0 {
+		return m.Data
+	}
+	if m.Payload == "" {
+		return nil
+	}
+	return []byte(m.Payload)
+}
@@ -0,0 +1,120 @@
+package navy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// payloadsAgree returns `true` if every one of `captains` has the admiral's
+// `payload` at `version`.
+func payloadsAgree(captains []*Captain, payload []byte, version uint64) bool {
+	for _, c := range captains {
+		got, v := c.LeaderPayload()
+		if !bytes.Equal(got, payload) || v != version {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPayloadUpdate(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3)
+	admiral := captains[2]
+	events := captains[0].Events()
+
+	// Every change the admiral makes reaches the fleet with a newer version
+	for _, payload := range []string{"first", "second", "third"} {
+		if err := admiral.SetPayloadBytes([]byte(payload)); err != nil {
+			t.Fatalf("SetPayloadBytes: %v", err)
+		}
+		_, version := admiral.Payload()
+		eventually(t, settleTimeout, func() bool {
+			return payloadsAgree(captains, []byte(payload), version)
+		}, "fleet didn't get [%s] at version [%d]", payload, version)
+	}
+	if e := waitForEvent(t, events, PayloadChanged); e.Rank != admiral.Rank() || e.PayloadVersion == 0 {
+		t.Errorf("PayloadChanged from [%d] at version [%d]", e.Rank, e.PayloadVersion)
+	}
+
+	// A captain that joins later is given the current payload
+	payload, version := admiral.Payload()
+	late := f.start(0, WithFleet(f.addr(1)))
+	eventually(t, settleTimeout, func() bool {
+		return payloadsAgree([]*Captain{late}, payload, version)
+	}, "late joiner didn't get the payload")
+
+	// Only the admiral's payload is sent to the fleet
+	if err := captains[0].SetPayloadBytes([]byte("follower")); err != nil {
+		t.Fatalf("SetPayloadBytes: %v", err)
+	}
+	if got, v := captains[1].LeaderPayload(); string(got) != "third" || v != version {
+		t.Errorf("a follower's payload replaced the admiral's: [%s] at version [%d]", got, v)
+	}
+}
+
+func TestPayloadVersionOrder(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Rank, cfg.BindAddress, cfg.MaxPayloadSize = 1, "captain-1:7946", DefaultMaxPayloadSize
+	c := newCaptain(cfg)
+	c.setLeader("captain-2:7946", 2, "", []byte("initial"), 1, 0)
+
+	update := func(rank int, addr, payload string, version uint64) {
+		c.updateLeaderPayload(Message{Rank: rank, Addr: addr, Type: PAYLOAD_UPDATE, Data: []byte(payload), PayloadVersion: version})
+	}
+	update(2, "captain-2:7946", "third", 3)
+	// Updates delivered late, or twice, don't roll the payload back
+	update(2, "captain-2:7946", "second", 2)
+	update(2, "captain-2:7946", "again", 3)
+	if payload, version := c.LeaderPayload(); string(payload) != "third" || version != 3 {
+		t.Errorf("payload = [%s] at version [%d], want [third] at [3]", payload, version)
+	}
+
+	// Only the admiral can update its payload
+	update(3, "captain-3:7946", "imposter", 10)
+	if payload, version := c.LeaderPayload(); string(payload) != "third" || version != 3 {
+		t.Errorf("payload = [%s] at version [%d] after an update from another captain", payload, version)
+	}
+
+	// A captain from before versioned payloads sends a string
+	c.updateLeaderPayload(Message{Rank: 2, Addr: "captain-2:7946", Type: PAYLOAD_UPDATE, Payload: "legacy"})
+	if payload, _ := c.LeaderPayload(); string(payload) != "third" {
+		t.Errorf("an unversioned payload replaced version [3] with [%s]", payload)
+	}
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	follower := f.start(1, WithReady(true), WithMaxPayloadSize(8))
+	waitForLeader(t, 1, follower)
+	admiral := f.start(2, WithFleet(f.addr(1)), WithMaxPayloadSize(64))
+	waitForLeader(t, 2, follower, admiral)
+
+	// A payload is refused by the captain setting it if it is too large
+	err := admiral.SetPayloadBytes(make([]byte, 65))
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("SetPayloadBytes = %v, want %v", err, ErrPayloadTooLarge)
+	}
+	if _, version := admiral.Payload(); version != 0 {
+		t.Errorf("a refused payload moved the version on to [%d]", version)
+	}
+
+	// A payload too large for a follower is ignored by it, without holding
+	// back the smaller payloads that follow
+	events := follower.Events()
+	if err = admiral.SetPayloadBytes([]byte("too large for the follower")); err != nil {
+		t.Fatalf("SetPayloadBytes: %v", err)
+	}
+	if err = admiral.SetPayloadBytes([]byte("small")); err != nil {
+		t.Fatalf("SetPayloadBytes: %v", err)
+	}
+	eventually(t, settleTimeout, func() bool {
+		return payloadsAgree([]*Captain{follower}, []byte("small"), 2)
+	}, "follower didn't get the smaller payload")
+	if e := waitForEvent(t, events, PayloadChanged); e.Payload != "small" {
+		t.Errorf("follower took the payload [%s]", e.Payload)
+	}
+}
@@ -1,23 +1,33 @@
 package navy
 
 import (
-	"encoding/gob"
-	"io"
+	"fmt"
 	"net"
+	"time"
 )
 
 // Peer is a `struct` representing a remote Peer.
 type Peer struct {
-	sock  *gob.Encoder
-	conn  *net.TCPConn
+	sock  encoder
+	conn  net.Conn
 	Ready bool
 
-	rank int
-	addr string
+	rank     int
+	addr     string
+	id       string    // the unique ID of the captain, once it is known
+	lastSeen time.Time // the last time a message was received from this peer
 }
 
 // NewPeer returns a new `*Peer`.
-func NewPeer(rank int, addr string, fd io.Writer, conn *net.TCPConn) *Peer {
+func NewPeer(rank int, addr string, conn net.Conn) *Peer {
 
-	return &Peer{rank: rank, addr: addr, sock: gob.NewEncoder(fd), Ready: true, conn: conn}
+	return &Peer{rank: rank, addr: addr, sock: newEncoder(conn), Ready: true, conn: conn, lastSeen: time.Now()}
+}
+
+// key returns the key of the peer in a `PeerMap`, its ID once it is known.
+func (p *Peer) key() string {
+	if p.id != "" {
+		return p.id
+	}
+	return fmt.Sprintf("rank:%d", p.rank)
 }
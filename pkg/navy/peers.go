@@ -2,11 +2,15 @@ package navy
 
 import (
 	"fmt"
-	"io"
 	"net"
 	"sync"
+	"time"
 )
 
+// writeTimeout is how long a write to a peer can block before it fails, so
+// that a frozen peer can't hold up the rest of the fleet.
+const writeTimeout = 5 * time.Second
+
 // Peers is an `interface` exposing methods to handle communication with other
 // `captain.captain`s.
 //
@@ -15,94 +19,258 @@ import (
 // cases fo exemples, although I strongly recommend you provide your own, safer
 // implementation while doing real work.
 type Peers interface {
-	Add(rank int, addr string, fd io.Writer, conn *net.TCPConn)
+	Add(rank int, addr, id string, conn net.Conn)
 	Delete(rank int)
 	Find(Peer) bool
 	Write(rank int, msg interface{}) error
+	Rerank(oldRank, newRank int, addr string) bool
+	Identify(rank int, addr, id string)
+	Lookup(id string) (rank int, addr string, ok bool)
+	Seen(rank int, addr string)
+	SetReady(rank int, addr string, ready bool)
+	LastSeen(rank int) (time.Time, bool)
 	PeerData() []struct {
 		Rank  int
 		Addr  string
 		Ready bool
+		ID    string
 	}
 }
 
 // PeerMap is a `struct` implementing the `Peers` interface and representing
-// a container of `captain.Peer`s.
+// a container of `captain.Peer`s. Peers are keyed by their unique ID, so a
+// captain keeps its entry when it moves address or rank, and are looked up by
+// their ID and then by their rank.
+//
+// NOTE: A peer is added before it has said who it is, so until its ID is known
+// it is keyed by its rank.
 type PeerMap struct {
 	mu    *sync.RWMutex
-	peers map[int]*Peer
+	peers map[string]*Peer // every peer by its ID (or by its rank until the ID is known)
+	ranks map[int]string   // the key in `peers` of the peer with each rank
 }
 
 // NewPeerMap returns a new `captain.PeerMap`.
 func NewPeerMap() *PeerMap {
-	return &PeerMap{mu: &sync.RWMutex{}, peers: make(map[int]*Peer)}
+	return &PeerMap{mu: &sync.RWMutex{}, peers: make(map[string]*Peer), ranks: make(map[int]string)}
+}
+
+// get returns the peer with `id`, or with `rank` if `id` is empty or unknown,
+// the caller must hold `pm.mu`.
+func (pm *PeerMap) get(id string, rank int) *Peer {
+	if p, ok := pm.peers[id]; ok && id != "" && p.id == id {
+		return p
+	}
+	key, ok := pm.ranks[rank]
+	if !ok {
+		return nil
+	}
+	return pm.peers[key]
+}
+
+// insert adds `p` to `pm.peers` under its key, the caller must hold `pm.mu`.
+func (pm *PeerMap) insert(p *Peer) {
+	pm.peers[p.key()] = p
+	pm.ranks[p.rank] = p.key()
+}
+
+// remove removes `p` from `pm.peers`, the caller must hold `pm.mu`.
+func (pm *PeerMap) remove(p *Peer) {
+	key := p.key()
+	if pm.peers[key] == p {
+		delete(pm.peers, key)
+	}
+	if pm.ranks[p.rank] == key {
+		delete(pm.ranks, p.rank)
+	}
 }
 
-// Add creates a new `captain.Peer` and adds it to `pm.peers` using `ID` as a key.
+// Add creates a new `captain.Peer` with `rank` at `addr` and adds it to
+// `pm.peers` using `id` as a key, `id` is empty if it isn't known yet. It
+// replaces any peer with the same rank or ID.
 //
 // NOTE: This function is thread-safe.
-func (pm *PeerMap) Add(rank int, addr string, fd io.Writer, conn *net.TCPConn) {
+func (pm *PeerMap) Add(rank int, addr, id string, conn net.Conn) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	pm.peers[rank] = NewPeer(rank, addr, fd, conn)
+	if old := pm.get("", rank); old != nil {
+		pm.remove(old)
+	}
+	if old, ok := pm.peers[id]; ok && id != "" {
+		pm.remove(old)
+	}
+	p := NewPeer(rank, addr, conn)
+	p.id = id
+	pm.insert(p)
 }
 
-// Delete erases the `captain.Peer` corresponding to `ID` from `pm.peers`.
+// Delete erases the `captain.Peer` with `rank` from `pm.peers`.
 //
 // NOTE: This function is thread-safe.
 func (pm *PeerMap) Delete(rank int) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	peer := pm.peers[rank]
+	peer := pm.get("", rank)
+	if peer == nil {
+		return
+	}
 	if peer.conn != nil {
 		peer.conn.Close()
 	}
-	// close(*net.TCPConn(pm.peers[ID].sock))
-	delete(pm.peers, rank)
+	pm.remove(peer)
 }
 
-// Find returns `true` if `pm.peers[ID]` exists, `false` otherwise.
+// Find returns `true` if a peer with the ID of `p` (or with its rank, if its
+// ID isn't known) exists at the same rank and address, `false` otherwise.
 //
 // NOTE: This function is thread-safe.
 func (pm *PeerMap) Find(p Peer) bool {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	foundp := pm.peers[p.rank]
+	foundp := pm.get(p.id, p.rank)
 	if foundp == nil {
 		return false
 	}
-	if foundp.addr == p.addr && foundp.rank == p.rank {
-		return true
+	// A captain with another ID is a different captain, even at the same address
+	if p.id != "" && foundp.id != "" && foundp.id != p.id {
+		return false
 	}
-	return false
+	return foundp.addr == p.addr && foundp.rank == p.rank
 }
 
-// Write writes `msg` to `pm.peers[ID]`. It returns `nil` or an `error` if
-// something occurs.
+// Write writes `msg` to the peer with `rank`. It returns `nil` or an `error`
+// if something occurs.
 //
 // NOTE: This function is thread-safe.
 func (pm *PeerMap) Write(rank int, msg interface{}) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	if p, ok := pm.peers[rank]; !ok {
+	p := pm.get("", rank)
+	if p == nil {
 		return fmt.Errorf("Write: peer %d not found in PeerMap", rank)
-
-	} else if err := p.sock.Encode(msg); err != nil {
+	}
+	if p.conn != nil {
+		_ = p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if err := p.sock.Encode(msg); err != nil {
 		return fmt.Errorf("Write: %v", err)
 	}
 	return nil
 }
 
+// Rerank moves the peer with `oldRank` to `newRank`, as long as its address
+// matches `addr` and `newRank` isn't taken. It returns `true` if the peer was
+// moved.
+//
+// NOTE: This function is thread-safe.
+func (pm *PeerMap) Rerank(oldRank, newRank int, addr string) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	p := pm.get("", oldRank)
+	if p == nil || p.addr != addr {
+		return false
+	}
+	if _, taken := pm.ranks[newRank]; taken {
+		return false
+	}
+	pm.remove(p)
+	p.rank = newRank
+	pm.insert(p)
+	return true
+}
+
+// Identify records that the peer with `rank` has the unique `id`, as long as
+// its address matches `addr`, and keys it by `id` from then on.
+//
+// NOTE: This function is thread-safe.
+func (pm *PeerMap) Identify(rank int, addr, id string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	p := pm.get("", rank)
+	if p == nil || p.addr != addr || p.id == id {
+		return
+	}
+	// Any other entry with the ID is the same captain somewhere it no longer is
+	if old, ok := pm.peers[id]; ok && old != p {
+		if old.conn != nil {
+			old.conn.Close()
+		}
+		pm.remove(old)
+	}
+	pm.remove(p)
+	p.id = id
+	pm.insert(p)
+}
+
+// Lookup returns the rank and address of the peer with the unique `id`, or
+// `false` if no peer has it.
+//
+// NOTE: This function is thread-safe.
+func (pm *PeerMap) Lookup(id string) (int, string, bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	p, ok := pm.peers[id]
+	if !ok || id == "" || p.id != id {
+		return 0, "", false
+	}
+	return p.rank, p.addr, true
+}
+
+// Seen records that a message has just been received from the peer with `rank`,
+// as long as its address matches `addr`.
+//
+// NOTE: This function is thread-safe.
+func (pm *PeerMap) Seen(rank int, addr string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if p := pm.get("", rank); p != nil && p.addr == addr {
+		p.lastSeen = time.Now()
+	}
+}
+
+// SetReady records whether the peer with `rank` is fit to lead, as long as its
+// address matches `addr`.
+//
+// NOTE: This function is thread-safe.
+func (pm *PeerMap) SetReady(rank int, addr string, ready bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if p := pm.get("", rank); p != nil && p.addr == addr {
+		p.Ready = ready
+	}
+}
+
+// LastSeen returns the last time a message was received from the peer with `rank`,
+// or `false` if the peer doesn't exist.
+//
+// NOTE: This function is thread-safe.
+func (pm *PeerMap) LastSeen(rank int) (time.Time, bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	p := pm.get("", rank)
+	if p == nil {
+		return time.Time{}, false
+	}
+	return p.lastSeen, true
+}
+
 // PeerData returns a slice of anonymous structures representing a tupple
-// composed of a `Peer.ID` and `Peer.addr`.
+// composed of a `Peer.rank`, `Peer.addr` and `Peer.id`.
 //
 // NOTE: This function is thread-safe.
 func (pm *PeerMap) PeerData() []struct {
 	Rank  int
 	Addr  string
 	Ready bool
+	ID    string
 } {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
@@ -111,16 +279,19 @@ func (pm *PeerMap) PeerData() []struct {
 		Rank  int
 		Addr  string
 		Ready bool
+		ID    string
 	}
 	for _, peer := range pm.peers {
 		RankSlice = append(RankSlice, struct {
 			Rank  int
 			Addr  string
 			Ready bool
+			ID    string
 		}{
 			peer.rank,
 			peer.addr,
 			peer.Ready,
+			peer.id,
 		})
 	}
 	return RankSlice
@@ -0,0 +1,66 @@
+package navy
+
+import (
+	"testing"
+)
+
+func TestPeerMapKeyedByID(t *testing.T) {
+	pm := NewPeerMap()
+
+	// A peer added before it has said who it is is found by its rank
+	pm.Add(1, "captain-1:7946", "", nil)
+	if !pm.Find(Peer{rank: 1, addr: "captain-1:7946"}) {
+		t.Fatal("unidentified peer wasn't found by its rank")
+	}
+	pm.Identify(1, "captain-1:7946", "id-1")
+	if rank, addr, ok := pm.Lookup("id-1"); !ok || rank != 1 || addr != "captain-1:7946" {
+		t.Fatalf("Lookup = %d %s %t", rank, addr, ok)
+	}
+	if _, ok := pm.peers["id-1"]; !ok || len(pm.peers) != 1 {
+		t.Fatalf("peer isn't keyed by its ID: %v", pm.peers)
+	}
+
+	// A peer is found by its ID before its rank, so another captain with the
+	// same rank and address isn't mistaken for it
+	if !pm.Find(Peer{rank: 1, addr: "captain-1:7946", id: "id-1"}) {
+		t.Error("peer wasn't found by its ID")
+	}
+	if pm.Find(Peer{rank: 1, addr: "captain-1:7946", id: "id-restarted"}) {
+		t.Error("captain with another ID was found as the same peer")
+	}
+
+	// A new rank keeps the same entry
+	if !pm.Rerank(1, 5, "captain-1:7946") {
+		t.Fatal("Rerank failed")
+	}
+	if rank, _, ok := pm.Lookup("id-1"); !ok || rank != 5 {
+		t.Errorf("Lookup after Rerank = %d %t", rank, ok)
+	}
+	if _, ok := pm.LastSeen(1); ok {
+		t.Error("the old rank is still known")
+	}
+
+	// The same captain on a new address replaces its old entry
+	pm.Add(5, "captain-1b:7946", "id-1", nil)
+	if rank, addr, ok := pm.Lookup("id-1"); !ok || rank != 5 || addr != "captain-1b:7946" {
+		t.Errorf("Lookup after moving = %d %s %t", rank, addr, ok)
+	}
+	if len(pm.PeerData()) != 1 {
+		t.Errorf("the old address lingers: %v", pm.PeerData())
+	}
+
+	// An ID learnt for another entry takes the ID over from its stale entry
+	pm.Add(2, "captain-2:7946", "", nil)
+	pm.Identify(2, "captain-2:7946", "id-1")
+	if rank, _, ok := pm.Lookup("id-1"); !ok || rank != 2 {
+		t.Errorf("Lookup after Identify = %d %t", rank, ok)
+	}
+	if len(pm.PeerData()) != 1 {
+		t.Errorf("the stale entry lingers: %v", pm.PeerData())
+	}
+
+	pm.Delete(2)
+	if _, _, ok := pm.Lookup("id-1"); ok || len(pm.peers) != 0 || len(pm.ranks) != 0 {
+		t.Errorf("Delete left %v %v", pm.peers, pm.ranks)
+	}
+}
@@ -0,0 +1,221 @@
+package navy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	idFile    = "id"         // the ID of the captain, inside the state directory
+	fleetFile = "fleet.json" // the fleet as last seen by the captain, inside the state directory
+
+	// rejoinTimeout is how long a captain tries to rejoin its saved fleet before
+	// connecting to the saved peers directly.
+	rejoinTimeout = 5 * time.Second
+)
+
+// savedPeer is a captain as recorded in the state directory.
+type savedPeer struct {
+	Rank int    `json:"rank"`
+	Addr string `json:"addr"`
+	ID   string `json:"id,omitempty"`
+}
+
+// savedFleet is the fleet as last seen by a captain, it is kept in the state
+// directory so that the captain can rejoin after a restart without seeds.
+type savedFleet struct {
+	Term   uint64      `json:"term"`
+	Leader *savedPeer  `json:"leader,omitempty"`
+	Peers  []savedPeer `json:"peers"`
+}
+
+// writeFileAtomic replaces `path` with `data`, by writing to a temporary file
+// first, so that a crash never leaves a partly written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadFleet returns the fleet saved in `path`, which is empty if nothing has
+// been saved yet.
+func loadFleet(path string) (savedFleet, error) {
+	var saved savedFleet
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return saved, fmt.Errorf("loadFleet: %v", err)
+	}
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return saved, fmt.Errorf("loadFleet: [%s] %v", path, err)
+	}
+	return saved, nil
+}
+
+// restore loads the ID of the captain and the fleet it last saw, from
+// `cfg.IDFile` and `cfg.StateDir`. The fleet is saved as it changes once the
+// captain is started.
+func (c *Captain) restore(cfg Config) error {
+	if cfg.StateDir != "" {
+		if err := os.MkdirAll(cfg.StateDir, 0o700); err != nil {
+			return fmt.Errorf("restore: %v", err)
+		}
+		if cfg.IDFile == "" {
+			cfg.IDFile = filepath.Join(cfg.StateDir, idFile)
+		}
+	}
+	if cfg.ID == "" && cfg.IDFile != "" {
+		id, err := loadID(cfg.IDFile)
+		if err != nil {
+			return err
+		}
+		c.id = id
+	}
+	c.idPersisted = cfg.ID != "" || cfg.IDFile != ""
+	if !c.idPersisted {
+		// The fleet only recognises a captain that comes back with the same ID
+		log.Warnf("[ID] [%s] is random and changes on every restart, set an ID file or state directory to keep it", c.id)
+	}
+	if cfg.StateDir == "" {
+		return nil
+	}
+
+	c.stateDir = cfg.StateDir
+	saved, err := loadFleet(filepath.Join(c.stateDir, fleetFile))
+	if err != nil {
+		return err
+	}
+	c.saved = saved
+	c.term = saved.Term
+	if len(saved.Peers) != 0 {
+		log.Infof("[STATE] restored [%d] peers at term [%d] from [%s]", len(saved.Peers), saved.Term, c.stateDir)
+	}
+	return nil
+}
+
+// persist saves the fleet every time its membership or leadership changes,
+// until the captain shuts down.
+func (c *Captain) persist(events <-chan Event) {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			switch e.Type {
+			case LeaderChanged, PeerJoined, PeerLost, PeerMoved, RankChanged, SteppedDown, QuorumLost:
+			default:
+				continue
+			}
+			select {
+			case <-c.quit:
+				// A captain that is shutting down drops its peers, which isn't worth saving
+				return
+			default:
+			}
+			if err := c.saveFleet(); err != nil {
+				log.Errorf("[STATE] %v", err)
+			}
+		}
+	}
+}
+
+// saveFleet writes the peers, leader and term of this captain to the state
+// directory. A captain that has lost all of its peers keeps the ones that were
+// saved before, as they are still its best chance of finding the fleet.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) saveFleet() error {
+	c.savedMu.Lock()
+	defer c.savedMu.Unlock()
+
+	saved := savedFleet{Term: c.Term(), Peers: c.saved.Peers}
+	if peers := c.peers.PeerData(); len(peers) != 0 {
+		saved.Peers = make([]savedPeer, 0, len(peers))
+		for _, peer := range peers {
+			saved.Peers = append(saved.Peers, savedPeer{Rank: peer.Rank, Addr: peer.Addr, ID: peer.ID})
+		}
+		sort.Slice(saved.Peers, func(i, j int) bool { return saved.Peers[i].Rank < saved.Peers[j].Rank })
+	}
+	if addr := c.LeaderAddress(); addr != "" {
+		saved.Leader = &savedPeer{Rank: c.LeaderRank(), Addr: addr, ID: c.LeaderID()}
+	}
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("saveFleet: %v", err)
+	}
+	if err = writeFileAtomic(filepath.Join(c.stateDir, fleetFile), b); err != nil {
+		return fmt.Errorf("saveFleet: %v", err)
+	}
+	c.saved = saved
+	return nil
+}
+
+// savedPeers returns the peers saved in the state directory (rank -> address),
+// other than this captain.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) savedPeers() map[int]string {
+	c.savedMu.Lock()
+	defer c.savedMu.Unlock()
+
+	peers := make(map[int]string)
+	for _, peer := range c.saved.Peers {
+		if peer.Addr != c.extaddr && peer.ID != c.id {
+			peers[peer.Rank] = peer.Addr
+		}
+	}
+	return peers
+}
+
+// seeds returns the addresses to discover the fleet from, the fleet members
+// that were configured followed by the saved leader and peers.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) seeds() []string {
+	seeds := append([]string{}, c.fleet...)
+	seen := make(map[string]bool)
+	for _, addr := range seeds {
+		seen[addr] = true
+	}
+	add := func(peer savedPeer) {
+		if peer.Addr == "" || peer.Addr == c.extaddr || peer.ID == c.id || seen[peer.Addr] {
+			return
+		}
+		seen[peer.Addr] = true
+		seeds = append(seeds, peer.Addr)
+	}
+
+	c.savedMu.Lock()
+	defer c.savedMu.Unlock()
+	if c.saved.Leader != nil {
+		add(*c.saved.Leader)
+	}
+	for _, peer := range c.saved.Peers {
+		add(peer)
+	}
+	return seeds
+}
@@ -0,0 +1,100 @@
+package navy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveAndRestoreFleet(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Option{WithRank(2), WithCallSign("test"), WithBindAddress("captain-2:7946"), WithStateDir(dir)}
+	c, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	c.peers.Add(1, "captain-1:7946", "id-1", conn)
+	c.peers.Add(3, "captain-3:7946", "id-3", conn)
+	c.acceptTerm(4, 3, "captain-3:7946")
+	c.setLeader("captain-3:7946", 3, "id-3", nil, 0, 4)
+	if err = c.saveFleet(); err != nil {
+		t.Fatalf("saveFleet: %v", err)
+	}
+
+	// A captain restarted with the same state directory comes back as itself,
+	// knowing the fleet it last saw
+	restored, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if restored.ID() != c.ID() {
+		t.Errorf("ID = [%s], want [%s]", restored.ID(), c.ID())
+	}
+	if restored.Term() != 4 {
+		t.Errorf("term = [%d], want [4]", restored.Term())
+	}
+	want := map[int]string{1: "captain-1:7946", 3: "captain-3:7946"}
+	if peers := restored.savedPeers(); !reflect.DeepEqual(peers, want) {
+		t.Errorf("saved peers = %v, want %v", peers, want)
+	}
+	// The saved leader is tried first
+	if seeds := restored.seeds(); !reflect.DeepEqual(seeds, []string{"captain-3:7946", "captain-1:7946"}) {
+		t.Errorf("seeds = %v", seeds)
+	}
+
+	// Losing every peer doesn't forget the saved fleet
+	c.peers.Delete(1)
+	c.peers.Delete(3)
+	if err = c.saveFleet(); err != nil {
+		t.Fatalf("saveFleet: %v", err)
+	}
+	saved, err := loadFleet(filepath.Join(dir, fleetFile))
+	if err != nil {
+		t.Fatalf("loadFleet: %v", err)
+	}
+	if len(saved.Peers) != 2 {
+		t.Errorf("[%d] peers saved after losing them all, want the [2] saved before", len(saved.Peers))
+	}
+}
+
+func TestRestartFromStateDir(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	captains := []*Captain{f.start(1, WithReady(true), WithStateDir(dirs[0]))}
+	waitForLeader(t, 1, captains...)
+	for rank := 2; rank <= 3; rank++ {
+		captains = append(captains, f.start(rank, WithFleet(f.addr(1)), WithStateDir(dirs[rank-1])))
+		waitForLeader(t, rank, captains...)
+	}
+
+	// The captain saves the fleet as it joins
+	eventually(t, settleTimeout, func() bool {
+		saved, err := loadFleet(filepath.Join(dirs[1], fleetFile))
+		return err == nil && len(saved.Peers) == 2 && saved.Leader != nil && saved.Leader.Rank == 3
+	}, "fleet wasn't saved")
+
+	id := captains[1].ID()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := captains[1].Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Without any seeds, the restarted captain rejoins through the saved fleet
+	restarted := f.start(2, WithStateDir(dirs[1]))
+	captains[1] = restarted
+	waitForLeader(t, 3, captains...)
+	if restarted.ID() != id {
+		t.Errorf("restarted captain has ID [%s], want [%s]", restarted.ID(), id)
+	}
+	eventually(t, settleTimeout, func() bool {
+		return len(restarted.peers.PeerData()) == 2
+	}, "restarted captain has peers %v", restarted.peers.PeerData())
+}
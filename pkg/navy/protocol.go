@@ -0,0 +1,367 @@
+package navy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The wire protocol, once a connection is accepted (and the connecting captain
+// hasn't written anything) the listener sends a greeting of `protocolMagic` and the oldest and newest protocol versions it
+// speaks. The connecting captain replies with `protocolMagic`, the version it
+// has chosen and the codec ID, and the listener answers with `protocolMagic`,
+// the version and a status. Every message that follows is a frame of a 4 byte
+// big endian length and the encoded message.
+//
+// NOTE: A captain from before the framed protocol never sends a greeting, so
+// it is spoken to with a plain gob stream. The first byte of the magic is
+// never sent by a gob encoder, so a listener can tell the two apart.
+const (
+	protocolMagic = "\xf7NAVY"
+
+	ProtocolVersion    byte = 1 // the newest protocol version this captain speaks
+	minProtocolVersion byte = 1 // the oldest protocol version this captain accepts
+
+	maxFrameSize = 4 << 20 // the largest frame accepted from a peer
+
+	// negotiateTimeout is how long to wait for a listener's greeting, a
+	// captain without the framed protocol never sends one.
+	negotiateTimeout = time.Second
+
+	// greetDelay is how long a listener waits for a captain to write before
+	// sending its greeting.
+	greetDelay = 100 * time.Millisecond
+
+	// legacyRetry is how long a peer that didn't send a greeting is spoken to
+	// with gob before the framed protocol is tried with it again, as a busy
+	// peer may simply have been slow to greet.
+	legacyRetry = 30 * time.Second
+)
+
+// Preamble statuses.
+const (
+	protocolAccepted byte = iota
+	protocolBadVersion
+	protocolBadCodec
+)
+
+// errLegacyPeer is returned when a peer doesn't send a greeting.
+var errLegacyPeer = errors.New("peer doesn't speak the framed protocol")
+
+// ProtocolError is returned when a peer can't agree on a protocol version or
+// codec.
+type ProtocolError struct {
+	Addr   string
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol with [%s] rejected: %s", e.Addr, e.Reason)
+}
+
+// encoder writes messages to a connection, either a `frameEncoder` or a
+// `gob.Encoder` for a legacy peer.
+type encoder interface {
+	Encode(e interface{}) error
+}
+
+// decoder reads messages from a connection, either a `frameDecoder` or a
+// `gob.Decoder` for a legacy peer.
+type decoder interface {
+	Decode(e interface{}) error
+}
+
+// frameEncoder writes `*Message`s as frames using `codec`.
+type frameEncoder struct {
+	w     io.Writer
+	codec Codec
+}
+
+func (e *frameEncoder) Encode(v interface{}) error {
+	msg, ok := v.(*Message)
+	if !ok {
+		return fmt.Errorf("frame: can't encode [%T]", v)
+	}
+	data, err := e.codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("frame: %v", err)
+	}
+	if len(data) > maxFrameSize {
+		return fmt.Errorf("frame: [%d] bytes exceeds the maximum of [%d]", len(data), maxFrameSize)
+	}
+	// a frame is written in one go, so that it can't be interleaved
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = e.w.Write(frame)
+	return err
+}
+
+// frameDecoder reads frames into `*Message`s using `codec`.
+type frameDecoder struct {
+	r     io.Reader
+	codec Codec
+}
+
+func (d *frameDecoder) Decode(v interface{}) error {
+	msg, ok := v.(*Message)
+	if !ok {
+		return fmt.Errorf("frame: can't decode into [%T]", v)
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return fmt.Errorf("frame: [%d] bytes exceeds the maximum of [%d]", size, maxFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return err
+	}
+	return d.codec.Unmarshal(data, msg)
+}
+
+// protocolConn is a connection that has agreed on the framed protocol.
+type protocolConn struct {
+	net.Conn
+	version byte
+	codec   Codec
+}
+
+// newEncoder returns the `encoder` for `conn`, a connection that hasn't agreed
+// on the framed protocol is written to as a plain gob stream.
+func newEncoder(conn net.Conn) encoder {
+	if pc, ok := conn.(*protocolConn); ok {
+		return &frameEncoder{w: pc.Conn, codec: pc.codec}
+	}
+	return gob.NewEncoder(conn)
+}
+
+// newDecoder returns the `decoder` for `conn`, a connection this captain dialed
+// that hasn't agreed on the framed protocol is read as a plain gob stream.
+func newDecoder(conn net.Conn) decoder {
+	if pc, ok := conn.(*protocolConn); ok {
+		return &frameDecoder{r: pc.Conn, codec: pc.codec}
+	}
+	return gob.NewDecoder(conn)
+}
+
+// dial connects to `addr` using the captain's `Transport` and agrees on the
+// protocol, falling back to a plain gob stream for a legacy peer.
+func (c *Captain) dial(addr string) (net.Conn, error) {
+	conn, err := c.transport.Dial(addr)
+	if err != nil {
+		c.tlsRejected(err)
+		return nil, err
+	}
+	if !c.negotiable(addr) {
+		return conn, nil
+	}
+
+	pc, err := c.negotiate(conn, addr)
+	if err == errLegacyPeer {
+		// Nothing has been sent yet, so the connection can carry gob instead
+		log.Warnf("[PROTOCOL] [%s] %v, falling back to gob for [%s]", addr, err, legacyRetry)
+		c.setLegacy(addr)
+		return conn, nil
+	}
+	if err != nil {
+		_ = conn.Close()
+		c.protocolRejected(err)
+		return nil, err
+	}
+	c.clearLegacy(addr)
+	return pc, nil
+}
+
+// negotiate waits for the listener's greeting on `conn` and agrees on the
+// protocol version and codec.
+func (c *Captain) negotiate(conn net.Conn, addr string) (*protocolConn, error) {
+	_ = conn.SetDeadline(time.Now().Add(negotiateTimeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+
+	greeting, err := readPreamble(conn)
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil, errLegacyPeer
+		}
+		if pe, ok := err.(*ProtocolError); ok {
+			pe.Addr = addr
+		}
+		return nil, err
+	}
+	oldest, newest := greeting[0], greeting[1]
+	version := ProtocolVersion
+	if newest < version {
+		version = newest
+	}
+	if version < oldest || version < minProtocolVersion {
+		return nil, &ProtocolError{Addr: addr, Reason: fmt.Sprintf("no common version, peer speaks versions [%d-%d]", oldest, newest)}
+	}
+
+	if _, err = conn.Write(append([]byte(protocolMagic), version, c.codec.ID())); err != nil {
+		return nil, err
+	}
+	reply, err := readPreamble(conn)
+	if err != nil {
+		if pe, ok := err.(*ProtocolError); ok {
+			pe.Addr = addr
+		}
+		return nil, err
+	}
+	status := reply[1]
+	switch status {
+	case protocolAccepted:
+	case protocolBadVersion:
+		return nil, &ProtocolError{Addr: addr, Reason: fmt.Sprintf("version [%d] isn't supported", version)}
+	case protocolBadCodec:
+		return nil, &ProtocolError{Addr: addr, Reason: fmt.Sprintf("codec [%s] isn't supported", c.codec.Name())}
+	default:
+		return nil, &ProtocolError{Addr: addr, Reason: fmt.Sprintf("unknown status [%d]", status)}
+	}
+	log.Debugf("[PROTOCOL] -> [%s] version [%d] codec [%s]", addr, version, c.codec.Name())
+	return &protocolConn{Conn: conn, version: version, codec: c.codec}, nil
+}
+
+// accept greets an accepted connection and returns the `decoder` for it, a
+// connection that doesn't reply to the greeting is read as a plain gob stream.
+func (c *Captain) accept(conn net.Conn) (decoder, error) {
+	r := bufio.NewReader(conn)
+
+	// An older captain writes straight away, and is never sent the greeting as
+	// closing a socket with unread data can lose what it has just written
+	_ = conn.SetReadDeadline(time.Now().Add(greetDelay))
+	first, err := r.Peek(1)
+	_ = conn.SetReadDeadline(time.Time{})
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		_ = conn.SetWriteDeadline(time.Now().Add(negotiateTimeout))
+		_, err = conn.Write(append([]byte(protocolMagic), minProtocolVersion, ProtocolVersion))
+		_ = conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		first, err = r.Peek(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != protocolMagic[0] {
+		return gob.NewDecoder(r), nil
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(negotiateTimeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+
+	addr := conn.RemoteAddr().String()
+	preamble, err := readPreamble(r)
+	if err != nil {
+		if pe, ok := err.(*ProtocolError); ok {
+			pe.Addr = addr
+		}
+		return nil, err
+	}
+	version, id := preamble[0], preamble[1]
+
+	reply := func(version, status byte) error {
+		_, err := conn.Write(append([]byte(protocolMagic), version, status))
+		return err
+	}
+	if version < minProtocolVersion || version > ProtocolVersion {
+		_ = reply(version, protocolBadVersion)
+		return nil, &ProtocolError{Addr: addr, Reason: fmt.Sprintf("version [%d] isn't supported", version)}
+	}
+	codec, ok := lookupCodec(id)
+	if !ok {
+		_ = reply(version, protocolBadCodec)
+		return nil, &ProtocolError{Addr: addr, Reason: fmt.Sprintf("codec [%d] isn't supported", id)}
+	}
+	if err = reply(version, protocolAccepted); err != nil {
+		return nil, err
+	}
+	log.Debugf("[PROTOCOL] <- [%s] version [%d] codec [%s]", addr, version, codec.Name())
+	return &frameDecoder{r: r, codec: codec}, nil
+}
+
+// readPreamble reads `protocolMagic` followed by two bytes from `r`, returning
+// the two bytes.
+func readPreamble(r io.Reader) ([]byte, error) {
+	preamble := make([]byte, len(protocolMagic)+2)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return nil, err
+	}
+	if string(preamble[:len(protocolMagic)]) != protocolMagic {
+		return nil, &ProtocolError{Reason: "invalid preamble"}
+	}
+	return preamble[len(protocolMagic):], nil
+}
+
+// isLegacy returns `true` if the peer at `addr` didn't send a greeting the
+// last time the framed protocol was tried with it.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) isLegacy(addr string) bool {
+	c.legacyMu.Lock()
+	defer c.legacyMu.Unlock()
+	_, ok := c.legacyPeers[addr]
+	return ok
+}
+
+// negotiable returns `true` if the framed protocol should be tried with the
+// peer at `addr`, which it is once `legacyRetry` has passed since the peer
+// last didn't send a greeting.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) negotiable(addr string) bool {
+	c.legacyMu.Lock()
+	defer c.legacyMu.Unlock()
+	since, ok := c.legacyPeers[addr]
+	return !ok || time.Since(since) >= legacyRetry
+}
+
+// setLegacy records that the peer at `addr` didn't send a greeting.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) setLegacy(addr string) {
+	c.legacyMu.Lock()
+	defer c.legacyMu.Unlock()
+	c.legacyPeers[addr] = time.Now()
+}
+
+// clearLegacy records that the peer at `addr` speaks the framed protocol,
+// after it has agreed on it or said hello.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) clearLegacy(addr string) {
+	c.legacyMu.Lock()
+	defer c.legacyMu.Unlock()
+	if _, ok := c.legacyPeers[addr]; ok {
+		log.Infof("[PROTOCOL] [%s] speaks the framed protocol", addr)
+		delete(c.legacyPeers, addr)
+	}
+}
+
+// protocolRejected reports `err` with a `ProtocolRejected` event if a peer
+// couldn't agree on the protocol.
+func (c *Captain) protocolRejected(err error) {
+	var pe *ProtocolError
+	if !errors.As(err, &pe) {
+		return
+	}
+	log.Warnf("[PROTOCOL] rejected [%s] [%s]", pe.Addr, pe.Reason)
+	c.emit(Event{Type: ProtocolRejected, Addr: pe.Addr, Err: pe})
+}
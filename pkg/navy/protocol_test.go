@@ -0,0 +1,81 @@
+package navy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLegacyPeerRetried(t *testing.T) {
+	transport := NewMemoryTransport()
+	l, err := transport.Listen("captain-2:7946")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	cfg := DefaultConfig()
+	cfg.Rank, cfg.BindAddress, cfg.Transport = 2, "captain-2:7946", transport
+	peer := newCaptain(cfg)
+
+	// The peer is too busy to greet the first connection, then greets as usual
+	greet := make(chan bool, 3)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if <-greet {
+				go func(conn net.Conn) {
+					_, _ = peer.accept(conn)
+				}(conn)
+			}
+		}
+	}()
+
+	cfg = DefaultConfig()
+	cfg.Rank, cfg.BindAddress, cfg.Transport = 1, "captain-1:7946", transport
+	c := newCaptain(cfg)
+
+	greet <- false
+	conn, err := c.dial("captain-2:7946")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	if !c.isLegacy("captain-2:7946") {
+		t.Fatal("a peer that didn't greet wasn't spoken to with gob")
+	}
+
+	// Until the retry is due the greeting isn't waited for again
+	greet <- false
+	started := time.Now()
+	if conn, err = c.dial("captain-2:7946"); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	if waited := time.Since(started); waited >= negotiateTimeout {
+		t.Errorf("waited [%s] for a greeting before the retry was due", waited)
+	}
+
+	// Once it is due, a peer that greets is spoken to with the framed protocol again
+	c.legacyMu.Lock()
+	c.legacyPeers["captain-2:7946"] = time.Now().Add(-legacyRetry)
+	c.legacyMu.Unlock()
+	greet <- true
+	if conn, err = c.dial("captain-2:7946"); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	if _, ok := conn.(*protocolConn); !ok || c.isLegacy("captain-2:7946") {
+		t.Error("the framed protocol wasn't agreed on once the retry was due")
+	}
+
+	// A peer that says hello speaks the framed protocol
+	c.setLegacy("captain-3:7946")
+	c.recordHello(Message{Rank: 3, Addr: "captain-3:7946", Type: HELLO, Types: supportedTypes()})
+	if c.isLegacy("captain-3:7946") || !c.negotiable("captain-3:7946") {
+		t.Error("a peer that said hello was still spoken to with gob")
+	}
+}
@@ -0,0 +1,200 @@
+package navy
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// admiralAckBuffer is the number of `ADMIRAL_ACK` messages that can be queued
+// whilst a proposal is being made.
+const admiralAckBuffer = 64
+
+// quorum returns the number of captains (including this one) that make up a
+// majority of the fleet. In quorum mode this is based upon the expected size
+// of the fleet, otherwise on the peers currently known.
+func (c *Captain) quorum() int {
+	if c.fleetSize > 0 {
+		return c.fleetSize/2 + 1
+	}
+	return (len(c.peers.PeerData())+1)/2 + 1
+}
+
+// proposed replies to a `PROPOSE`, acknowledging it only if this captain would
+// follow the captain that sent it and hasn't acknowledged another captain for
+// the term it proposes. The leader isn't changed until the proposal has been
+// committed with an `ADMIRAL`.
+func (c *Captain) proposed(msg Message) {
+	if msg.CallSign != c.callsign {
+		log.Warnf("[QUORUM] ignoring proposal from [%s %d] with unknown callsign", msg.Addr, msg.Rank)
+		c.emit(Event{Type: CallsignRejected, Rank: msg.Rank, Addr: msg.Addr})
+		return
+	}
+	if msg.Term <= c.Term() {
+		log.Warnf("[QUORUM] ignoring proposal from [%s %d] for stale term [%d]", msg.Addr, msg.Rank, msg.Term)
+		err := c.Send(msg.Rank, msg.Addr, STALE)
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	if !c.follows(msg.Addr, msg.Rank, msg.ID) {
+		log.Infof("[QUORUM] rejecting proposal from [%s %d], leader is [%s %d]", msg.Addr, msg.Rank, c.LeaderAddress(), c.LeaderRank())
+		return
+	}
+	if !c.vote(msg.Term, msg.Addr, msg.Rank, msg.ID) {
+		log.Infof("[QUORUM] rejecting proposal from [%s %d], already acknowledged another captain for term [%d]", msg.Addr, msg.Rank, msg.Term)
+		return
+	}
+	log.Infof("[QUORUM] accepting proposal from [%s %d]", msg.Addr, msg.Rank)
+	err := c.Send(msg.Rank, msg.Addr, ADMIRAL_ACK)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// vote records that this captain acknowledges the captain `rank` at `addr` for
+// `term`, it returns `false` if another captain has already been acknowledged
+// for that term or a later one. A captain proposing itself votes for itself,
+// so at most one proposal for a term can reach a majority. Its own proposal
+// gives way to one that outranks it until it has been committed, as it is
+// only committed while this captain still holds its own vote (see
+// `setLeader`).
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) vote(term uint64, addr string, rank int, id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case term > c.votedTerm, term == c.votedTerm && addr == c.votedFor:
+	case term == c.votedTerm && c.votedFor == c.extaddr && !(c.leading && c.term >= term) && outranks(rank, id, c.rank, c.id):
+		log.Infof("[QUORUM] giving way to [%s %d] for term [%d]", addr, rank, term)
+	default:
+		return false
+	}
+	c.votedTerm, c.votedFor = term, addr
+	return true
+}
+
+// nextTerm returns the term an election by this captain is for, the one after
+// both the current term and any term it has voted in, so that a proposal that
+// failed to reach a majority isn't made again for the same term.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) nextTerm() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.votedTerm > c.term {
+		return c.votedTerm + 1
+	}
+	return c.term + 1
+}
+
+// isMember returns `true` if `rank` counts towards a majority.
+func (c *Captain) isMember(rank int) bool {
+	if c.members == nil {
+		return true
+	}
+	return c.members[rank]
+}
+
+// propose sends a `PROPOSE` for `term` to every peer and waits for a majority
+// of the fleet to acknowledge it, returning `false` if the majority isn't
+// reached or this captain has already acknowledged another captain for `term`. The
+// peers don't follow this captain until it announces itself with an `ADMIRAL`,
+// except for peers that don't understand a `PROPOSE` which are proposed to
+// with an `ADMIRAL` instead.
+func (c *Captain) propose(term uint64) bool {
+	if !c.vote(term, c.extaddr, c.Rank(), c.id) {
+		log.Infof("[QUORUM] not proposing, already acknowledged another captain for term [%d]", term)
+		return false
+	}
+
+	// Throw away any acknowledgements left over from a previous proposal
+	for drained := false; !drained; {
+		select {
+		case <-c.admiralAckChan:
+		default:
+			drained = true
+		}
+	}
+
+	for _, peers := range c.peers.PeerData() {
+		log.Infof("[QUORUM] proposing [%s] as leader to [%s] for term [%d]", c.extaddr, peers.Addr, term)
+		var err error
+		if c.supports(peers.Addr, PROPOSE) {
+			err = c.write(peers.Rank, &Message{Rank: c.Rank(), Addr: c.extaddr, Type: PROPOSE, CallSign: c.callsign, Term: term}, peers.Addr)
+		} else {
+			err = c.Send(peers.Rank, peers.Addr, ADMIRAL)
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	// We count towards the majority ourselves
+	need := c.quorum() - 1
+	acked := make(map[int]bool)
+	timeout := time.After(time.Second)
+	for len(acked) < need {
+		select {
+		case msg := <-c.admiralAckChan:
+			if c.isMember(msg.Rank) {
+				acked[msg.Rank] = true
+			}
+		case <-timeout:
+			c.quorumLost(fmt.Errorf("only [%d] of the [%d] captains acknowledged, [%d] needed", len(acked)+1, c.fleetSize, need+1))
+			return false
+		case <-c.quit:
+			return false
+		}
+	}
+	return true
+}
+
+// quorumLost leaves this captain without a leader (stepping down if it was the
+// admiral) and tries another election later.
+func (c *Captain) quorumLost(reason error) {
+	log.Warnf("[QUORUM] no majority, fleet is leaderless [%v]", reason)
+	c.emit(Event{Type: QuorumLost, Rank: c.Rank(), Addr: c.extaddr, Err: reason})
+
+	c.mu.RLock()
+	leading := c.leading
+	c.mu.RUnlock()
+	if leading {
+		c.stepDown(reason)
+		return
+	}
+	c.retryElection()
+}
+
+// retryElection starts another election after giving the rest of the fleet a
+// chance to settle, as long as there still isn't a leader. The delay is
+// randomised, so that captains that lost the same election don't all propose
+// themselves for the same term again.
+func (c *Captain) retryElection() {
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		retry := c.leaseDuration
+		if retry == 0 {
+			retry = time.Second
+		}
+		retry += time.Duration(rand.Int63n(int64(retry)))
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(retry):
+		}
+		if c.LeaderAddress() == "" {
+			c.Elect()
+		}
+	}()
+}
@@ -0,0 +1,98 @@
+package navy
+
+import (
+	"testing"
+)
+
+func TestProposalVote(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Rank, cfg.BindAddress, cfg.FleetSize = 2, "captain-2:7946", 3
+	c := newCaptain(cfg)
+
+	if !c.vote(2, "captain-3:7946", 3, "") {
+		t.Fatal("first proposal for term [2] was refused")
+	}
+	// Only one captain is acknowledged for a term
+	if c.vote(2, "captain-1:7946", 1, "") {
+		t.Error("a second captain was acknowledged for term [2]")
+	}
+	if !c.vote(2, "captain-3:7946", 3, "") {
+		t.Error("the same proposal was refused when it was repeated")
+	}
+	if c.vote(1, "captain-1:7946", 1, "") {
+		t.Error("a proposal for an earlier term was acknowledged")
+	}
+
+	// A captain proposing itself has voted for itself
+	if c.propose(2) {
+		t.Error("captain proposed itself for a term it acknowledged another captain for")
+	}
+	if !c.vote(3, c.extaddr, 2, c.id) {
+		t.Fatal("captain couldn't vote for itself for term [3]")
+	}
+	if c.vote(3, "captain-1:7946", 1, "") {
+		t.Error("a captain it outranks was acknowledged while it was proposing itself")
+	}
+
+	// It gives way to a captain that outranks it, and can then no longer take the term
+	if !c.vote(3, "captain-3:7946", 3, "") {
+		t.Fatal("captain didn't give way to a captain that outranks it")
+	}
+	if c.setLeader(c.extaddr, 2, c.id, nil, 0, 3) || c.isAdmiral() {
+		t.Error("captain took a term after giving its vote away")
+	}
+	if c.Term() != 0 {
+		t.Errorf("term = %d after giving the vote away", c.Term())
+	}
+}
+
+func TestProposersNeverShareTerm(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+
+	// A leaderless fleet, nobody is ready to stand for election on their own
+	var captains []*Captain
+	for rank := 1; rank <= 3; rank++ {
+		captains = append(captains, f.start(rank, WithQuorum(3)))
+	}
+	for _, c := range captains {
+		peers := make(map[int]string)
+		for _, other := range captains {
+			if other != c {
+				peers[other.Rank()] = other.extaddr
+			}
+		}
+		c.Connect(peers)
+	}
+
+	// Two captains propose themselves for the same term at the same time
+	term := captains[0].nextTerm()
+	if next := captains[1].nextTerm(); next != term {
+		t.Fatalf("captains would propose terms [%d] and [%d]", term, next)
+	}
+	won := make(chan *Captain, 2)
+	for _, c := range captains[:2] {
+		go func(c *Captain) {
+			payload, version := c.Payload()
+			if c.propose(term) && c.setLeader(c.extaddr, c.Rank(), c.id, payload, version, term) {
+				won <- c
+				return
+			}
+			won <- nil
+		}(c)
+	}
+	var leaders []*Captain
+	for i := 0; i < 2; i++ {
+		if c := <-won; c != nil {
+			leaders = append(leaders, c)
+		}
+	}
+	if len(leaders) > 1 {
+		t.Fatalf("captains [%d] and [%d] both took term [%d]", leaders[0].Rank(), leaders[1].Rank(), term)
+	}
+	for _, c := range captains[:2] {
+		if c.isAdmiral() && c.Term() != term {
+			t.Errorf("captain [%d] leads term [%d] rather than the proposed term [%d]", c.Rank(), c.Term(), term)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package navy
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetRank changes the rank of this captain at runtime and announces it to the
+// fleet with a `RANK` message. If the new rank changes who should be admiral
+// then an election takes place, so lowering the rank of the admiral is a way
+// of draining it before maintenance.
+//
+// NOTE: This function is thread-safe, it blocks while any election takes
+// place.
+func (c *Captain) SetRank(rank int) error {
+	old := c.Rank()
+	if rank == old {
+		return nil
+	}
+	for _, peer := range c.peers.PeerData() {
+		if peer.Rank == rank {
+			return fmt.Errorf("SetRank: rank [%d] belongs to [%s]", rank, peer.Addr)
+		}
+	}
+	if c.members != nil && !c.isMember(rank) {
+		return fmt.Errorf("SetRank: rank [%d] isn't a member of the fleet", rank)
+	}
+
+	c.mu.Lock()
+	c.rank = rank
+	// A new rank puts an admiral appointed by a transfer back in rank order
+	c.appointed = false
+	if c.leaderRank == old && c.leaderAddr == c.extaddr {
+		c.leaderRank = rank
+	}
+	c.mu.Unlock()
+	c.rerank(old, rank, c.extaddr)
+
+	log.Infof("[RANK] changed from [%d] to [%d]", old, rank)
+	c.emit(Event{Type: RankChanged, Rank: rank, Addr: c.extaddr, OldRank: old})
+	for _, peer := range c.peers.PeerData() {
+		if !c.supports(peer.Addr, RANK) {
+			log.Warnf("[RANK] [%s %d] doesn't support rank changes", peer.Addr, peer.Rank)
+			continue
+		}
+		err := c.write(peer.Rank, &Message{Rank: rank, Addr: c.extaddr, Type: RANK, CallSign: c.callsign, Term: c.Term(), OldRank: old}, peer.Addr)
+		if err != nil {
+			log.Errorf("[RANK] [%s %d] %v", peer.Addr, peer.Rank, err)
+		}
+	}
+	c.rebalance()
+	return nil
+}
+
+// peerRankChanged applies a `RANK` from a peer, moving it to its new rank.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) peerRankChanged(msg Message) {
+	if !c.peers.Rerank(msg.OldRank, msg.Rank, msg.Addr) {
+		log.Warnf("[RANK] unable to move [%s] from [%d] to [%d]", msg.Addr, msg.OldRank, msg.Rank)
+		return
+	}
+
+	c.mu.Lock()
+	if c.leaderRank == msg.OldRank && c.leaderAddr == msg.Addr {
+		c.leaderRank = msg.Rank
+	}
+	c.mu.Unlock()
+	c.rerank(msg.OldRank, msg.Rank, msg.Addr)
+
+	log.Infof("[RANK] [%s] changed from [%d] to [%d]", msg.Addr, msg.OldRank, msg.Rank)
+	c.emit(Event{Type: RankChanged, Rank: msg.Rank, Addr: msg.Addr, OldRank: msg.OldRank})
+	c.rebalance()
+}
+
+// rerank moves everything this captain knows about the captain at `addr` from
+// `oldRank` to `newRank`.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) rerank(oldRank, newRank int, addr string) {
+	c.metaMu.Lock()
+	if md, ok := c.metadata[oldRank]; ok && md.Addr == addr {
+		delete(c.metadata, oldRank)
+		md.Rank = newRank
+		c.metadata[newRank] = md
+	}
+	c.metaMu.Unlock()
+
+	c.stateMu.Lock()
+	if c.stateRank == oldRank && c.stateAddr == addr {
+		c.stateRank = newRank
+	}
+	c.stateMu.Unlock()
+
+	c.leaseMu.Lock()
+	if at, ok := c.leaseAcks[oldRank]; ok {
+		delete(c.leaseAcks, oldRank)
+		c.leaseAcks[newRank] = at
+	}
+	c.leaseMu.Unlock()
+}
+
+// rebalance starts an election if this captain now outranks the rest of the
+// fleet but isn't the admiral, after a change of rank.
+func (c *Captain) rebalance() {
+	if !c.Ready {
+		return
+	}
+	rank := c.Rank()
+	for _, peer := range c.peers.PeerData() {
+		if outranks(peer.Rank, peer.ID, rank, c.id) {
+			// The highest ranked captain is the one to start the election
+			return
+		}
+	}
+	if c.LeaderRank() == rank && c.LeaderAddress() == c.extaddr {
+		return
+	}
+	log.Infof("[RANK] [%d] outranks the admiral [%s %d], starting an election", rank, c.LeaderAddress(), c.LeaderRank())
+	c.Elect()
+}
@@ -0,0 +1,211 @@
+package navy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotAdmiral is returned when a captain that isn't the admiral tries to
+// change the replicated state.
+var ErrNotAdmiral = errors.New("not the admiral")
+
+// StateEntry is a `struct` carrying a single key of the replicated state, it is
+// sent with `STATE_UPDATE` and `STATE_SNAPSHOT` messages.
+type StateEntry struct {
+	Key     string
+	Value   []byte
+	Deleted bool // `STATE_UPDATE` only, the key has been removed
+}
+
+// SetState sets `key` to `value` in the state replicated from the admiral to
+// the fleet, only the admiral may change the state.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) SetState(key string, value []byte) error {
+	if len(value) > c.maxPayloadSize {
+		return fmt.Errorf("SetState: %w, [%d] bytes exceeds [%d]", ErrPayloadTooLarge, len(value), c.maxPayloadSize)
+	}
+	return c.writeState(StateEntry{Key: key, Value: append([]byte{}, value...)})
+}
+
+// DeleteState removes `key` from the state replicated from the admiral to the
+// fleet, only the admiral may change the state.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) DeleteState(key string) error {
+	return c.writeState(StateEntry{Key: key, Deleted: true})
+}
+
+// GetState returns the value of `key` in the replicated state, and whether it
+// exists.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) GetState(key string) ([]byte, bool) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	value, ok := c.state[key]
+	return append([]byte(nil), value...), ok
+}
+
+// State returns a copy of the replicated state and its sequence number, which
+// increases with every change made by the admiral.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) State() (map[string][]byte, uint64) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	state := make(map[string][]byte, len(c.state))
+	for k, v := range c.state {
+		state[k] = append([]byte(nil), v...)
+	}
+	return state, c.stateSeq
+}
+
+// writeState applies `entry` to the state of the admiral and pushes it to
+// every peer with the next sequence number.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) writeState(entry StateEntry) error {
+	if !c.HasLease() {
+		return fmt.Errorf("writeState: %w", ErrNotAdmiral)
+	}
+
+	// Updates are sent in the order of their sequence numbers
+	c.stateWriteMu.Lock()
+	defer c.stateWriteMu.Unlock()
+
+	rank := c.Rank()
+	c.stateMu.Lock()
+	c.stateSeq++
+	seq := c.stateSeq
+	c.stateRank, c.stateAddr = rank, c.extaddr
+	if entry.Deleted {
+		delete(c.state, entry.Key)
+	} else {
+		c.state[entry.Key] = entry.Value
+	}
+	c.stateMu.Unlock()
+
+	c.emitState(entry, seq)
+	for _, peer := range c.peers.PeerData() {
+		if !c.supports(peer.Addr, STATE_UPDATE) {
+			continue
+		}
+		// A peer that misses an update asks for a snapshot when the next one arrives
+		err := c.write(peer.Rank, &Message{Rank: rank, Addr: c.extaddr, Type: STATE_UPDATE, CallSign: c.callsign, Term: c.Term(), Seq: seq, Entries: []StateEntry{entry}}, peer.Addr)
+		if err != nil {
+			log.Errorf("[STATE] [%s %d] %v", peer.Addr, peer.Rank, err)
+		}
+	}
+	return nil
+}
+
+// stateSnapshot returns every key of the replicated state and its sequence
+// number, to be sent with a `STATE_SNAPSHOT`.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) stateSnapshot() ([]StateEntry, uint64) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	entries := make([]StateEntry, 0, len(c.state))
+	for k, v := range c.state {
+		entries = append(entries, StateEntry{Key: k, Value: v})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, c.stateSeq
+}
+
+// fromAdmiral returns `true` if `msg` was sent by the current admiral.
+func (c *Captain) fromAdmiral(msg Message) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return msg.Rank == c.leaderRank && msg.Addr == c.leaderAddr
+}
+
+// updateState applies a `STATE_UPDATE` from the admiral, an update that
+// doesn't follow on from our state is replaced by asking for a snapshot.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) updateState(msg Message) {
+	if !c.fromAdmiral(msg) {
+		log.Debugf("[STATE] ignoring update from [%s %d], not the admiral", msg.Addr, msg.Rank)
+		return
+	}
+
+	c.stateMu.Lock()
+	if msg.Rank == c.stateRank && msg.Addr == c.stateAddr && msg.Seq <= c.stateSeq {
+		c.stateMu.Unlock()
+		log.Debugf("[STATE] ignoring sequence [%d], already have [%d]", msg.Seq, c.stateSeq)
+		return
+	}
+	if msg.Rank != c.stateRank || msg.Addr != c.stateAddr || msg.Seq != c.stateSeq+1 {
+		seq := c.stateSeq
+		c.stateMu.Unlock()
+		log.Debugf("[STATE] sequence [%d] from [%s %d] doesn't follow [%d], asking for a snapshot", msg.Seq, msg.Addr, msg.Rank, seq)
+		if err := c.Send(msg.Rank, msg.Addr, STATE_SYNC); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	c.stateSeq = msg.Seq
+	for _, entry := range msg.Entries {
+		if entry.Deleted {
+			delete(c.state, entry.Key)
+		} else {
+			c.state[entry.Key] = entry.Value
+		}
+	}
+	c.stateMu.Unlock()
+
+	for _, entry := range msg.Entries {
+		c.emitState(entry, msg.Seq)
+	}
+}
+
+// restoreState replaces our state with a `STATE_SNAPSHOT` from the admiral,
+// emitting a `StateChanged` event for every key that differs.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) restoreState(msg Message) {
+	if !c.fromAdmiral(msg) {
+		log.Debugf("[STATE] ignoring snapshot from [%s %d], not the admiral", msg.Addr, msg.Rank)
+		return
+	}
+
+	c.stateMu.Lock()
+	if msg.Rank == c.stateRank && msg.Addr == c.stateAddr && msg.Seq < c.stateSeq {
+		c.stateMu.Unlock()
+		log.Debugf("[STATE] ignoring snapshot [%d], already have [%d]", msg.Seq, c.stateSeq)
+		return
+	}
+	state := make(map[string][]byte, len(msg.Entries))
+	var changed []StateEntry
+	for _, entry := range msg.Entries {
+		state[entry.Key] = entry.Value
+		if old, ok := c.state[entry.Key]; !ok || string(old) != string(entry.Value) {
+			changed = append(changed, entry)
+		}
+	}
+	for k := range c.state {
+		if _, ok := state[k]; !ok {
+			changed = append(changed, StateEntry{Key: k, Deleted: true})
+		}
+	}
+	c.state = state
+	c.stateSeq = msg.Seq
+	c.stateRank, c.stateAddr = msg.Rank, msg.Addr
+	c.stateMu.Unlock()
+
+	log.Debugf("[STATE] restored [%d] keys at sequence [%d] from [%s %d]", len(state), msg.Seq, msg.Addr, msg.Rank)
+	for _, entry := range changed {
+		c.emitState(entry, msg.Seq)
+	}
+}
+
+// emitState reports a change to a key of the replicated state.
+func (c *Captain) emitState(entry StateEntry, seq uint64) {
+	c.emit(Event{Type: StateChanged, Rank: c.LeaderRank(), Addr: c.LeaderAddress(), Key: entry.Key, Value: append([]byte(nil), entry.Value...), Deleted: entry.Deleted, Seq: seq})
+}
@@ -0,0 +1,120 @@
+package navy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// statesAgree returns `true` if every one of `captains` has `want` as its
+// replicated state at sequence `seq`.
+func statesAgree(captains []*Captain, want map[string][]byte, seq uint64) bool {
+	for _, c := range captains {
+		state, s := c.State()
+		if s != seq || !reflect.DeepEqual(state, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStateReplication(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(3)
+	admiral := captains[2]
+
+	if err := admiral.SetState("zone", []byte("a")); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+	if err := admiral.SetState("role", []byte("db")); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+	if err := admiral.DeleteState("zone"); err != nil {
+		t.Fatalf("DeleteState: %v", err)
+	}
+	want := map[string][]byte{"role": []byte("db")}
+	eventually(t, settleTimeout, func() bool {
+		return statesAgree(captains, want, 3)
+	}, "fleet didn't replicate the state")
+
+	// Only the admiral changes the state
+	if err := captains[0].SetState("zone", []byte("b")); !errors.Is(err, ErrNotAdmiral) {
+		t.Errorf("SetState on a follower = %v, want %v", err, ErrNotAdmiral)
+	}
+	if value, ok := captains[1].GetState("role"); !ok || string(value) != "db" {
+		t.Errorf("GetState = [%s] %t", value, ok)
+	}
+}
+
+func TestStateSnapshotForLateJoiner(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(2)
+	admiral := captains[1]
+	for _, key := range []string{"a", "b", "c"} {
+		if err := admiral.SetState(key, []byte(key)); err != nil {
+			t.Fatalf("SetState: %v", err)
+		}
+	}
+	if err := admiral.DeleteState("b"); err != nil {
+		t.Fatalf("DeleteState: %v", err)
+	}
+
+	// A captain joining after the changes were made is sent a snapshot of the
+	// state, rather than the updates it missed
+	joiner := f.create(0, WithFleet(f.addr(1)))
+	events := joiner.Events()
+	f.run(joiner)
+	want := map[string][]byte{"a": []byte("a"), "c": []byte("c")}
+	eventually(t, settleTimeout, func() bool {
+		return statesAgree([]*Captain{joiner}, want, 4)
+	}, "late joiner wasn't sent the state")
+	seen := make(map[string]bool)
+	for len(seen) < len(want) {
+		e := waitForEvent(t, events, StateChanged)
+		if e.Seq != 4 || e.Deleted {
+			t.Errorf("StateChanged for [%s] at sequence [%d] deleted [%t]", e.Key, e.Seq, e.Deleted)
+		}
+		seen[e.Key] = true
+	}
+	if !reflect.DeepEqual(seen, map[string]bool{"a": true, "c": true}) {
+		t.Errorf("StateChanged for keys %v", seen)
+	}
+}
+
+func TestStateSequenceGap(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	captains := f.startFleet(2)
+	follower, admiral := captains[0], captains[1]
+	if err := admiral.SetState("a", []byte("1")); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+	eventually(t, settleTimeout, func() bool {
+		return statesAgree(captains, map[string][]byte{"a": []byte("1")}, 1)
+	}, "fleet didn't replicate the state")
+
+	// The follower misses an update
+	f.isolate(follower.extaddr)
+	if err := admiral.SetState("b", []byte("2")); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+	f.heal(follower.extaddr)
+
+	// The next update doesn't follow on from what it has, so it asks for the
+	// whole state instead
+	if err := admiral.SetState("c", []byte("3")); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+	want := map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")}
+	eventually(t, settleTimeout, func() bool {
+		return statesAgree(captains, want, 3)
+	}, "follower didn't catch up after missing an update")
+
+	// An update from a captain that isn't the admiral is ignored
+	follower.updateState(Message{Rank: 5, Addr: "captain-5:7946", Type: STATE_UPDATE, Seq: 4, Entries: []StateEntry{{Key: "d", Value: []byte("4")}}})
+	if _, ok := follower.GetState("d"); ok {
+		t.Error("an update from another captain was applied")
+	}
+}
@@ -0,0 +1,147 @@
+package navy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handshakeTimeout is how long a TLS handshake with a peer may take.
+const handshakeTimeout = 5 * time.Second
+
+// HandshakeError is returned when a TLS handshake with a peer fails, such as
+// when its certificate isn't trusted.
+type HandshakeError struct {
+	Addr string
+	Err  error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("tls handshake with [%s] failed: %v", e.Addr, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// TLSTransport is a `struct` implementing the `Transport` interface by wrapping
+// the connections of another `Transport` in TLS.
+//
+// NOTE: Setting `ClientAuth` to `tls.RequireAndVerifyClientCert` in the
+// `tls.Config` gives mutual TLS, where both ends verify each other.
+type TLSTransport struct {
+	Transport Transport
+	Config    *tls.Config
+}
+
+// NewTLSTransport returns a new `TLSTransport` wrapping `t` with `cfg`.
+func NewTLSTransport(t Transport, cfg *tls.Config) *TLSTransport {
+	return &TLSTransport{Transport: t, Config: cfg}
+}
+
+// Listen listens on `addr`, the TLS handshake of an accepted connection takes
+// place when it is first read from or written to.
+func (t *TLSTransport) Listen(addr string) (net.Listener, error) {
+	l, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, t.Config), nil
+}
+
+// Dial establishes a connection to `addr` and completes the TLS handshake,
+// returning a `*HandshakeError` if the handshake fails.
+func (t *TLSTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := t.Config
+	if cfg.ServerName == "" {
+		// verify the peer against the host it was dialled on
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err = handshake(tlsConn); err != nil {
+		_ = conn.Close()
+		return nil, &HandshakeError{Addr: addr, Err: err}
+	}
+	return tlsConn, nil
+}
+
+// handshake completes the TLS handshake on `conn` within `handshakeTimeout`.
+func handshake(conn *tls.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// LoadTLSConfig builds a `tls.Config` from PEM encoded files, the certificate
+// and key are presented to peers and peers are verified against the CA. If
+// `mutual` is set then peers connecting to this captain must also present a
+// certificate signed by the CA.
+func LoadTLSConfig(certFile, keyFile, caFile string, mutual bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("LoadTLSConfig: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("LoadTLSConfig: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("LoadTLSConfig: no certificates found in [%s]", caFile)
+		}
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+	}
+	if mutual {
+		if cfg.ClientCAs == nil {
+			return nil, fmt.Errorf("LoadTLSConfig: mutual TLS requires a CA")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// acceptTLS completes the handshake of an accepted TLS connection, a peer that
+// fails the handshake is reported with a `TLSRejected` event.
+func (c *Captain) acceptTLS(conn *tls.Conn) error {
+	if err := handshake(conn); err != nil {
+		c.tlsRejected(&HandshakeError{Addr: conn.RemoteAddr().String(), Err: err})
+		return err
+	}
+	return nil
+}
+
+// tlsRejected reports `err` with a `TLSRejected` event if it is a failed TLS
+// handshake.
+func (c *Captain) tlsRejected(err error) {
+	var hs *HandshakeError
+	if !errors.As(err, &hs) {
+		return
+	}
+	log.Warnf("[TLS] rejected [%s] [%v]", hs.Addr, hs.Err)
+	c.emit(Event{Type: TLSRejected, Addr: hs.Addr, Err: hs.Err})
+}
@@ -0,0 +1,246 @@
+package navy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// host returns the host name of the captain with `rank`, which its certificate
+// is issued for.
+func (f *testFleet) host(rank int) string {
+	return fmt.Sprintf("captain-%d", rank)
+}
+
+// testCA is a certificate authority that only exists for the length of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self signed CA called `name`.
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a certificate for `hosts` that is valid both as a server and as
+// a client, returning it and its key PEM encoded.
+func (ca *testCA) issue(t *testing.T, hosts ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("serial: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// config returns a mutual TLS config for `hosts` that trusts only this CA.
+func (ca *testCA) config(t *testing.T, hosts ...string) *tls.Config {
+	t.Helper()
+	cert, err := tls.X509KeyPair(ca.issue(t, hosts...))
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// writeFiles writes the certificate, key and CA of a captain for `hosts` as
+// PEM files, returning their paths.
+func (ca *testCA) writeFiles(t *testing.T, hosts ...string) (certFile, keyFile, caFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, hosts...)
+	certFile, keyFile, caFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM, caFile: ca.pem} {
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return certFile, keyFile, caFile
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	ca := newTestCA(t, "fleet-ca")
+	certFile, keyFile, caFile := ca.writeFiles(t, "captain-1")
+
+	cfg, err := LoadTLSConfig(certFile, keyFile, caFile, true)
+	if err != nil {
+		t.Fatalf("LoadTLSConfig: %v", err)
+	}
+	if len(cfg.Certificates) != 1 || cfg.RootCAs == nil || cfg.ClientCAs == nil {
+		t.Errorf("certificate or CA pool missing: %+v", cfg)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want mutual TLS", cfg.ClientAuth)
+	}
+
+	// The pool only trusts the CA it was loaded from
+	leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	if _, err = leaf.Verify(x509.VerifyOptions{Roots: cfg.RootCAs, DNSName: "captain-1"}); err != nil {
+		t.Errorf("certificate isn't trusted by the loaded CA pool: %v", err)
+	}
+	other := newTestCA(t, "other-ca")
+	otherPool := x509.NewCertPool()
+	otherPool.AddCert(other.cert)
+	if _, err = leaf.Verify(x509.VerifyOptions{Roots: otherPool}); err == nil {
+		t.Error("certificate is trusted by an unrelated CA")
+	}
+
+	cfg, err = LoadTLSConfig(certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatalf("LoadTLSConfig without a CA: %v", err)
+	}
+	if cfg.RootCAs != nil || cfg.ClientAuth != tls.NoClientCert {
+		t.Error("a CA pool or client authentication was set up without a CA")
+	}
+
+	if _, err = LoadTLSConfig(certFile, keyFile, "", true); err == nil {
+		t.Error("mutual TLS was allowed without a CA")
+	}
+	if _, err = LoadTLSConfig(certFile, keyFile, keyFile, false); err == nil {
+		t.Error("a CA file without certificates was accepted")
+	}
+	if _, err = LoadTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), keyFile, caFile, false); err == nil {
+		t.Error("a missing certificate was accepted")
+	}
+}
+
+func TestTLSFleet(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	ca := newTestCA(t, "fleet-ca")
+
+	// Every captain trusts the CA loaded from file, joiners discover the fleet
+	// with one-shot messages over TLS
+	var captains []*Captain
+	for rank := 1; rank <= 3; rank++ {
+		certFile, keyFile, caFile := ca.writeFiles(t, f.host(rank))
+		cfg, err := LoadTLSConfig(certFile, keyFile, caFile, true)
+		if err != nil {
+			t.Fatalf("LoadTLSConfig: %v", err)
+		}
+		opts := []Option{WithTLS(cfg), WithFleet(f.addr(1))}
+		if rank == 1 {
+			opts = []Option{WithTLS(cfg), WithReady(true)}
+		}
+		captains = append(captains, f.start(rank, opts...))
+		waitForLeader(t, rank, captains...)
+	}
+
+	// The admiral's payload reaches the fleet over TLS
+	captains[2].SetPayload("over tls")
+	eventually(t, settleTimeout, func() bool {
+		for _, c := range captains[:2] {
+			if payload, _ := c.LeaderPayload(); string(payload) != "over tls" {
+				return false
+			}
+		}
+		return true
+	}, "payload wasn't sent over TLS: %s", leaders(captains))
+}
+
+func TestMutualTLSRejectsUnknownCA(t *testing.T) {
+	t.Parallel()
+	f := newTestFleet(t)
+	ca := newTestCA(t, "fleet-ca")
+	rogue := newTestCA(t, "rogue-ca")
+
+	admiral := f.start(1, WithTLS(ca.config(t, f.host(1))), WithReady(true))
+	waitForLeader(t, 1, admiral)
+	events := admiral.Events()
+
+	// A client certificate from an unknown CA is refused by the admiral, even
+	// though the client trusts the admiral
+	cfg := rogue.config(t, f.host(2))
+	cfg.RootCAs.AddCert(ca.cert)
+	intruder := f.create(2, WithTLS(cfg))
+	_ = intruder.SendOneShot(f.addr(1), WHOISLEADER)
+	e := waitForEvent(t, events, TLSRejected)
+	if e.Err == nil || e.Addr == "" {
+		t.Errorf("TLSRejected event is missing the failure: %+v", e)
+	}
+	if n := len(admiral.peers.PeerData()); n != 0 {
+		t.Errorf("admiral has [%d] peers after refusing the intruder", n)
+	}
+
+	// A captain that doesn't trust the admiral's certificate refuses it
+	outsider := f.create(3, WithTLS(rogue.config(t, f.host(3))))
+	outsiderEvents := outsider.Events()
+	err := outsider.SendOneShot(f.addr(1), WHOISLEADER)
+	var hs *HandshakeError
+	if !errors.As(err, &hs) || hs.Addr != f.addr(1) {
+		t.Fatalf("SendOneShot = %v, want a handshake error with [%s]", err, f.addr(1))
+	}
+	if e := waitForEvent(t, outsiderEvents, TLSRejected); e.Addr != f.addr(1) {
+		t.Errorf("TLSRejected for [%s], want [%s]", e.Addr, f.addr(1))
+	}
+	if !admiral.isAdmiral() || admiral.LeaderRank() != 1 {
+		t.Error("admiral was affected by the rejected captains")
+	}
+}
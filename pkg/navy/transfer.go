@@ -0,0 +1,227 @@
+package navy
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transferTimeout is how long the admiral waits for each step of a leadership
+// transfer.
+const transferTimeout = 5 * time.Second
+
+// TransferLeadership hands leadership of the fleet from this captain (which
+// must be the admiral) to the peer with `rank`. The peer is first asked with a
+// `TRANSFER` and confirms that it is ready, the admiral then steps down and
+// tells the fleet with a `TRANSFER_COMMIT`, and the peer confirms once it has
+// been promoted. If the peer doesn't confirm that it is ready then this
+// captain remains the admiral, and if it doesn't confirm its promotion then an
+// election takes place.
+//
+// NOTE: The peer keeps leadership through any later election for as long as
+// it remains the admiral, even against captains that outrank it. Changing its
+// rank with `SetRank` puts it back in rank order.
+func (c *Captain) TransferLeadership(rank int) error {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	if !c.HasLease() {
+		return fmt.Errorf("TransferLeadership: %w", ErrNotAdmiral)
+	}
+	if rank == c.Rank() {
+		return nil
+	}
+	addr := ""
+	for _, peer := range c.peers.PeerData() {
+		if !c.supports(peer.Addr, TRANSFER_COMMIT) {
+			return fmt.Errorf("TransferLeadership: [%s %d] doesn't support leadership transfers", peer.Addr, peer.Rank)
+		}
+		if peer.Rank == rank {
+			addr = peer.Addr
+		}
+	}
+	if addr == "" {
+		return fmt.Errorf("TransferLeadership: rank [%d] isn't a peer", rank)
+	}
+
+	// Throw away any acknowledgement left over from a previous transfer
+	select {
+	case <-c.transferChan:
+	default:
+	}
+
+	log.Infof("[TRANSFER] asking [%s %d] to take over", addr, rank)
+	if err := c.Send(rank, addr, TRANSFER); err != nil {
+		return fmt.Errorf("TransferLeadership: %v", err)
+	}
+	ready, err := c.transferAck(rank, addr, c.Term())
+	if err != nil {
+		// Nothing has changed, so we remain the admiral
+		return fmt.Errorf("TransferLeadership: [%s %d] isn't ready: %v", addr, rank, err)
+	}
+
+	// The new admiral starts a term after both of ours, so a late announcement from an election is stale
+	term := c.Term()
+	if ready.Term > term {
+		term = ready.Term
+	}
+	term++
+	payload, version := ready.payload(), ready.PayloadVersion
+	c.handover(rank, addr, payload, version, term)
+	for _, peer := range c.peers.PeerData() {
+		// The target is told last, so that the fleet follows it once it takes over
+		if peer.Rank == rank {
+			continue
+		}
+		c.commitTransfer(peer.Rank, peer.Addr, rank, payload, version)
+	}
+	c.commitTransfer(rank, addr, rank, payload, version)
+
+	if _, err = c.transferAck(rank, addr, term); err != nil {
+		log.Errorf("[TRANSFER] [%s %d] didn't take over, starting an election", addr, rank)
+		c.Elect()
+		return fmt.Errorf("TransferLeadership: [%s %d] didn't take over: %v", addr, rank, err)
+	}
+	log.Infof("[TRANSFER] [%s %d] is the admiral", addr, rank)
+	return nil
+}
+
+// transferAck waits for a `TRANSFER_ACK` from the peer `rank` at `addr` with
+// at least `term`.
+func (c *Captain) transferAck(rank int, addr string, term uint64) (Message, error) {
+	timeout := time.After(transferTimeout)
+	for {
+		select {
+		case msg := <-c.transferChan:
+			if msg.Rank == rank && msg.Addr == addr && msg.Term >= term {
+				return msg, nil
+			}
+		case <-timeout:
+			return Message{}, fmt.Errorf("no acknowledgement after %s", transferTimeout)
+		case <-c.quit:
+			return Message{}, fmt.Errorf("captain has quit")
+		}
+	}
+}
+
+// commitTransfer tells the peer `to` at `addr` that the captain `rank` is the
+// admiral, along with its payload.
+func (c *Captain) commitTransfer(to int, addr string, rank int, payload []byte, version uint64) {
+	msg := &Message{Rank: c.Rank(), Addr: c.extaddr, Type: TRANSFER_COMMIT, CallSign: c.callsign, Term: c.Term(), Target: rank}
+	err := c.write(to, c.withPayload(msg, addr, payload, version), addr)
+	if err != nil {
+		log.Errorf("[TRANSFER] [%s %d] %v", addr, to, err)
+	}
+}
+
+// handleTransfer processes the `TRANSFER` and `TRANSFER_COMMIT` messages from
+// the admiral.
+func (c *Captain) handleTransfer(msg Message) {
+	if !c.fromAdmiral(msg) {
+		log.Warnf("[TRANSFER] ignoring [%s] from [%s %d], not the admiral", MessageStrings[msg.Type], msg.Addr, msg.Rank)
+		return
+	}
+	switch msg.Type {
+	case TRANSFER:
+		if !c.Ready {
+			log.Warnf("[TRANSFER] not ready to take over from [%s %d]", msg.Addr, msg.Rank)
+			return
+		}
+		if !c.Healthy() {
+			log.Warnf("[TRANSFER] unhealthy, not taking over from [%s %d]", msg.Addr, msg.Rank)
+			return
+		}
+		log.Infof("[TRANSFER] ready to take over from [%s %d]", msg.Addr, msg.Rank)
+		if err := c.Send(msg.Rank, msg.Addr, TRANSFER_ACK); err != nil {
+			log.Error(err)
+		}
+	case TRANSFER_COMMIT:
+		rank := c.Rank()
+		addr := c.extaddr
+		if msg.Target != rank {
+			addr = ""
+			for _, peer := range c.peers.PeerData() {
+				if peer.Rank == msg.Target {
+					addr = peer.Addr
+				}
+			}
+			if addr == "" {
+				log.Errorf("[TRANSFER] unknown admiral [%d] from [%s %d]", msg.Target, msg.Addr, msg.Rank)
+				return
+			}
+		}
+		log.Infof("[TRANSFER] [%s %d] is taking over from [%s %d]", addr, msg.Target, msg.Addr, msg.Rank)
+		c.handover(msg.Target, addr, msg.payload(), msg.PayloadVersion, msg.Term)
+		if msg.Target != rank {
+			return
+		}
+
+		// We're the admiral, the fleet takes on our state and the old admiral is told
+		for _, peer := range c.peers.PeerData() {
+			if err := c.Send(peer.Rank, peer.Addr, STATE_SNAPSHOT); err != nil {
+				log.Error(err)
+			}
+		}
+		if err := c.Send(msg.Rank, msg.Addr, TRANSFER_ACK); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// isAppointed returns `true` if this captain is an admiral appointed by a
+// transfer.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) isAppointed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.leading && c.appointed
+}
+
+// holdLeadership answers an `ELECTION` as an admiral appointed by a transfer,
+// whatever the rank of the captain standing for election it is told to stand
+// down with an `OK` and that this captain remains the admiral.
+func (c *Captain) holdLeadership(msg Message) {
+	log.Infof("[TRANSFER] keeping leadership handed over by a transfer, informing [%s %d]", msg.Addr, msg.Rank)
+	if err := c.Send(msg.Rank, msg.Addr, OK); err != nil {
+		log.Error(err)
+	}
+	if err := c.Send(msg.Rank, msg.Addr, ADMIRAL); err != nil {
+		log.Error(err)
+	}
+}
+
+// handover makes the captain `rank` at `addr` the admiral for `term` regardless
+// of its rank, promoting or demoting this captain as needed.
+//
+// NOTE: This function is thread-safe.
+func (c *Captain) handover(rank int, addr string, payload []byte, version uint64, term uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	leader := Leader{Rank: rank, Addr: addr, Payload: string(payload), PayloadVersion: version, Term: term}
+	if rank == c.rank && addr == c.extaddr {
+		c.promote(leader)
+		c.appointed = true
+	} else {
+		c.demote(leader)
+		if term > c.term {
+			c.term = term
+		}
+	}
+	c.emit(Event{Type: LeaderChanged, Rank: rank, Addr: addr, OldRank: c.leaderRank, OldAddr: c.leaderAddr, Payload: string(payload), PayloadVersion: version, Term: c.term})
+
+	c.leaderRank = rank
+	c.leaderAddr = addr
+	c.leaderID = c.peerID(addr)
+	c.leaderPayload = payload
+	c.leaderPayloadVersion = version
+	c.leaderTerm = c.term
+
+	// The fleet has an admiral, so an election that is in progress is over
+	select {
+	case c.electionChan <- Message{Rank: rank, Addr: addr, Type: OK}:
+	default:
+	}
+}
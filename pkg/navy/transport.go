@@ -0,0 +1,57 @@
+package navy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// dialTimeout is how long the TCP transport waits for a connection to a peer.
+const dialTimeout = 5 * time.Second
+
+// Transport is an `interface` that provides the connections between captains,
+// it is used for both the listener and the connections to `Peer`s.
+//
+// NOTE: This project offers a TCP implementation (the default) and an
+// in-memory implementation that allows a whole fleet to run in one process.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCPTransport is a `struct` implementing the `Transport` interface over TCP.
+type TCPTransport struct {
+	Proto string // one of `tcp`, `tcp4`, `tcp6`
+}
+
+// NewTCPTransport returns a new `TCPTransport` using the protocol `proto`.
+func NewTCPTransport(proto string) *TCPTransport {
+	return &TCPTransport{Proto: proto}
+}
+
+// Listen listens on the tcp address `addr`.
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveTCPAddr(t.Proto, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Listen: %v", err)
+	}
+	l, err := net.ListenTCP(t.Proto, laddr)
+	if err != nil {
+		return nil, fmt.Errorf("Listen: %v", err)
+	}
+	return l, nil
+}
+
+// Dial establishes a tcp connection to `addr`.
+func (t *TCPTransport) Dial(addr string) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr(t.Proto, addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %v", err)
+	}
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.Dial(t.Proto, raddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("connect: %v", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,101 @@
+#!/bin/bash
+# Runs captains built from an older commit alongside captains built from the
+# working tree, to check that a fleet can be upgraded one captain at a time.
+# Each captain is asked for its admiral with navyctl until the fleet agrees.
+# TestMixedVersionFleet covers the same steps in memory, against captains
+# pinned to the legacy protocol.
+#
+# usage: ./mixedversion.sh [old ref] (defaults to the first commit)
+
+cd "$(dirname "$0")/.."
+ROOT=$(pwd)
+OLD_REF=${1:-$(git rev-list --max-parents=0 HEAD)}
+WORK=$(mktemp -d)
+export LOG=${LOG:-4}
+TIMEOUT=${TIMEOUT:-30} # how long a fleet is given to agree on an admiral, in seconds
+
+cleanup() {
+    kill $(jobs -p) 2>/dev/null
+    wait 2>/dev/null
+    git worktree remove --force "$WORK/old" 2>/dev/null
+    rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+echo "Building old captain from [$OLD_REF] and new captain from the working tree"
+git worktree add -q "$WORK/old" "$OLD_REF" || exit 1
+(cd "$WORK/old" && go build -o "$WORK/navy-old" ./examples/server) || exit 1
+go build -o "$WORK/navy-new" ./examples/server || exit 1
+go build -o "$WORK/navyctl" ./cmd/navyctl || exit 1
+
+# start <name> <binary> <args...>, the output of each captain is kept in $WORK/<name>.log
+start() {
+    local name=$1 bin=$2
+    shift 2
+    "$WORK/navy-$bin" -callsign mixed -log $LOG "$@" > "$WORK/$name.log" 2>&1 &
+    eval "$name=$!"
+}
+
+# admiral <address>, prints the rank of the admiral the captain at <address> follows
+admiral() {
+    "$WORK/navyctl" -address "$1" -callsign mixed -output json -timeout 2s admiral 2>/dev/null |
+        sed -n 's/.*"rank": *\([0-9]*\).*/\1/p'
+}
+
+# agreed <rank> <address...>, checks that every captain follows <rank>
+agreed() {
+    local rank=$1 addr
+    shift
+    for addr in "$@"; do
+        [ "$(admiral "$addr")" = "$rank" ] || return 1
+    done
+}
+
+# settle <rank> <address...>, waits up to $TIMEOUT seconds for the captains to agree on <rank>
+settle() {
+    local deadline=$((SECONDS + TIMEOUT))
+    until agreed "$@"; do
+        [ $SECONDS -lt $deadline ] || return 1
+        sleep 0.5
+    done
+}
+
+failed=0
+# expect <name> <rank> <description> <address...>, <name> is the captain whose log is shown on failure
+expect() {
+    local name=$1 rank=$2 description=$3
+    shift 3
+    if settle "$rank" "$@"; then
+        echo "PASS: $description"
+    else
+        echo "FAIL: $description"
+        for addr in "$@"; do
+            echo "[$addr] follows [$(admiral "$addr")]"
+        done
+        echo "----- $name.log"
+        tail -n 20 "$WORK/$name.log"
+        failed=1
+    fi
+}
+
+OLD100=127.0.0.1:9990 NEW80=127.0.0.1:9991 OLD50=127.0.0.1:9992 NEW120=127.0.0.1:9993 NEW130=127.0.0.1:9994
+
+start old100 old -address $OLD100 -rank 100 -ready
+settle 100 $OLD100
+start new80 new -address $NEW80 -rank 80 -fleet $OLD100
+settle 100 $OLD100 $NEW80
+start old50 old -address $OLD50 -rank 50 -fleet $NEW80
+settle 100 $OLD100 $NEW80 $OLD50
+start new120 new -address $NEW120 -rank 120 -fleet $OLD50
+expect new120 120 "new captain is elected admiral of a mixed fleet" $OLD100 $NEW80 $OLD50 $NEW120
+
+kill $new120
+expect old100 100 "old captain takes over when the new admiral leaves" $OLD100 $NEW80 $OLD50
+
+start new130 new -address $NEW130 -rank 130 -fleet $OLD100
+expect new130 130 "new captain joining through an old captain is elected admiral" $OLD100 $NEW80 $OLD50 $NEW130
+
+kill $new130
+expect old100 100 "old captain takes over again" $OLD100 $NEW80 $OLD50
+
+exit $failed